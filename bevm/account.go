@@ -0,0 +1,208 @@
+package bevm
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// Management of EVM account keys, compatible with the Ethereum tooling:
+// encrypted keystore files (Web3 Secret Storage, version 3) as used by geth,
+// and BIP-39 mnemonics derived according to BIP-32/BIP-44.
+
+// DefaultDerivationPath is the BIP-44 derivation path of the first Ethereum
+// account of a mnemonic, as used by most Ethereum wallets
+const DefaultDerivationPath = "m/44'/60'/0'/0/0"
+
+// Entropy (in bits) of the mnemonics generated, i.e. 12 words
+const mnemonicEntropyBits = 128
+
+// GenerateEvmAccount creates a new EvmAccount with a random private key
+func GenerateEvmAccount() (*EvmAccount, error) {
+	privKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return newEvmAccountFromKey(privKey), nil
+}
+
+// NewEvmAccountFromKeystore creates a new EvmAccount from an encrypted keystore
+// file, such as the ones created by geth
+func NewEvmAccountFromKeystore(keyFile string, passphrase string) (*EvmAccount, error) {
+	keyJSON, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.New("Error reading keystore file: " + err.Error())
+	}
+
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return nil, errors.New("Error decrypting keystore file: " + err.Error())
+	}
+
+	return newEvmAccountFromKey(key.PrivateKey), nil
+}
+
+// GenerateMnemonic creates a new random BIP-39 mnemonic of 12 words
+func GenerateMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+
+	return bip39.NewMnemonic(entropy)
+}
+
+// NewEvmAccountFromMnemonic creates a new EvmAccount from a BIP-39 mnemonic and
+// its (optional) passphrase, deriving its private key along the given BIP-32
+// path. An empty path stands for DefaultDerivationPath.
+func NewEvmAccountFromMnemonic(mnemonic string, passphrase string, derivationPath string) (*EvmAccount, error) {
+	if derivationPath == "" {
+		derivationPath = DefaultDerivationPath
+	}
+
+	path, err := accounts.ParseDerivationPath(derivationPath)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, passphrase)
+	if err != nil {
+		return nil, errors.New("Invalid mnemonic: " + err.Error())
+	}
+
+	privKey, err := deriveKey(seed, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEvmAccountFromKey(privKey), nil
+}
+
+// SaveKeystore encrypts the private key of the account with the given
+// passphrase, and saves it in a new keystore file of the given directory,
+// named as geth does. It returns the path of the file created.
+func (account EvmAccount) SaveKeystore(dir string, passphrase string) (string, error) {
+	return account.saveKeystore(dir, passphrase, keystore.StandardScryptN, keystore.StandardScryptP)
+}
+
+// Save the account in a keystore file, using the given scrypt parameters
+func (account EvmAccount) saveKeystore(dir string, passphrase string, scryptN int, scryptP int) (string, error) {
+	if account.PrivateKey == nil {
+		return "", errors.New("Account has no private key")
+	}
+
+	key := &keystore.Key{
+		Id:         uuid.NewRandom(),
+		Address:    account.Address,
+		PrivateKey: account.PrivateKey,
+	}
+
+	keyJSON, err := keystore.EncryptKey(key, passphrase, scryptN, scryptP)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	keyFile := filepath.Join(dir, keyFileName(account.Address, time.Now().UTC()))
+
+	// Do not overwrite an existing key
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(keyJSON)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+
+	return keyFile, f.Close()
+}
+
+// Name of a keystore file, following the geth convention
+// (UTC--<creation time>--<address>)
+func keyFileName(address common.Address, t time.Time) string {
+	return fmt.Sprintf("UTC--%s--%s", t.Format("2006-01-02T15-04-05.999999999Z"), hex.EncodeToString(address[:]))
+}
+
+// Create an EvmAccount from its private key
+func newEvmAccountFromKey(privKey *ecdsa.PrivateKey) *EvmAccount {
+	return &EvmAccount{
+		Address:    crypto.PubkeyToAddress(privKey.PublicKey),
+		PrivateKey: privKey,
+	}
+}
+
+// Derive the secp256k1 private key of a BIP-32 path from a BIP-39 seed
+func deriveKey(seed []byte, path accounts.DerivationPath) (*ecdsa.PrivateKey, error) {
+	curveOrder := crypto.S256().Params().N
+
+	// Master key
+	sum := hmacSHA512([]byte("Bitcoin seed"), seed)
+	key, chainCode := new(big.Int).SetBytes(sum[:32]), sum[32:]
+	if key.Sign() == 0 || key.Cmp(curveOrder) >= 0 {
+		return nil, errors.New("Invalid master key")
+	}
+
+	// Child keys
+	for _, index := range path {
+		var data []byte
+		if index >= 0x80000000 {
+			// Hardened child: derived from the parent private key
+			data = append([]byte{0}, math.PaddedBigBytes(key, 32)...)
+		} else {
+			// Normal child: derived from the parent public key
+			privKey, err := crypto.ToECDSA(math.PaddedBigBytes(key, 32))
+			if err != nil {
+				return nil, err
+			}
+			data = crypto.CompressPubkey(&privKey.PublicKey)
+		}
+		data = append(data, byte(index>>24), byte(index>>16), byte(index>>8), byte(index))
+
+		sum = hmacSHA512(chainCode, data)
+		tweak := new(big.Int).SetBytes(sum[:32])
+		if tweak.Cmp(curveOrder) >= 0 {
+			return nil, fmt.Errorf("Invalid child key at index %d", index)
+		}
+
+		key = tweak.Add(tweak, key)
+		key.Mod(key, curveOrder)
+		if key.Sign() == 0 {
+			return nil, fmt.Errorf("Invalid child key at index %d", index)
+		}
+		chainCode = sum[32:]
+	}
+
+	return crypto.ToECDSA(math.PaddedBigBytes(key, 32))
+}
+
+// Compute the HMAC-SHA512 of some data
+func hmacSHA512(key []byte, data []byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
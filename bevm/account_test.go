@@ -0,0 +1,72 @@
+package bevm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEvmAccountFromMnemonic(t *testing.T) {
+	// Well-known development mnemonic
+	mnemonic := "test test test test test test test test test test test junk"
+
+	a, err := NewEvmAccountFromMnemonic(mnemonic, "", "")
+	require.Nil(t, err)
+	require.Equal(t, common.HexToAddress("0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"), a.Address)
+	require.Equal(t, "ac0974bec39a17e36ba4a6b4d238ff944bacb478cbed5efcae784d7bf4f2ff80",
+		common.Bytes2Hex(crypto.FromECDSA(a.PrivateKey)))
+
+	a, err = NewEvmAccountFromMnemonic(mnemonic, "", "m/44'/60'/0'/0/1")
+	require.Nil(t, err)
+	require.Equal(t, common.HexToAddress("0x70997970C51812dc3A010C7d01b50e0d17dc79C8"), a.Address)
+
+	// The passphrase changes the seed
+	a, err = NewEvmAccountFromMnemonic(mnemonic, "passphrase", "")
+	require.Nil(t, err)
+	require.NotEqual(t, common.HexToAddress("0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"), a.Address)
+
+	// Invalid checksum
+	_, err = NewEvmAccountFromMnemonic("test test test test test test test test test test test test", "", "")
+	require.NotNil(t, err)
+
+	// Invalid path
+	_, err = NewEvmAccountFromMnemonic(mnemonic, "", "m/44'/x")
+	require.NotNil(t, err)
+
+	// Generated mnemonics are usable
+	mnemonic, err = GenerateMnemonic()
+	require.Nil(t, err)
+	_, err = NewEvmAccountFromMnemonic(mnemonic, "", "")
+	require.Nil(t, err)
+}
+
+func TestKeystore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "bevm")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	a, err := GenerateEvmAccount()
+	require.Nil(t, err)
+
+	// Light scrypt parameters keep the test fast
+	keyFile, err := a.saveKeystore(tmpDir, "secret", keystore.LightScryptN, keystore.LightScryptP)
+	require.Nil(t, err)
+	require.Equal(t, tmpDir, filepath.Dir(keyFile))
+
+	loaded, err := NewEvmAccountFromKeystore(keyFile, "secret")
+	require.Nil(t, err)
+	require.Equal(t, a.Address, loaded.Address)
+	require.Equal(t, crypto.FromECDSA(a.PrivateKey), crypto.FromECDSA(loaded.PrivateKey))
+
+	_, err = NewEvmAccountFromKeystore(keyFile, "wrong")
+	require.NotNil(t, err)
+
+	_, err = NewEvmAccountFromKeystore(filepath.Join(tmpDir, "missing"), "secret")
+	require.NotNil(t, err)
+}
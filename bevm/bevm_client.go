@@ -2,22 +2,33 @@ package bevm
 
 import (
 	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"path"
+	"reflect"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"go.dedis.ch/cothority/v3"
 	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/contracts"
 	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
 	"go.dedis.ch/protobuf"
 )
 
@@ -84,7 +95,7 @@ func (contract EvmContract) unpackResult(result interface{}, method string, resu
 type EvmAccount struct {
 	Address    common.Address
 	PrivateKey *ecdsa.PrivateKey
-	Nonce      uint64
+	Nonce      uint64 // Nonce of the next transaction, tracked locally
 }
 
 // NewEvmAccount creates a new EvmAccount
@@ -94,24 +105,18 @@ func NewEvmAccount(privateKey string) (*EvmAccount, error) {
 		return nil, err
 	}
 
-	address := crypto.PubkeyToAddress(privKey.PublicKey)
-
-	return &EvmAccount{
-		Address:    address,
-		PrivateKey: privKey,
-	}, nil
+	return newEvmAccountFromKey(privKey), nil
 }
 
 func (account EvmAccount) String() string {
 	return fmt.Sprintf("EvmAccount[%s]", account.Address.Hex())
 }
 
-// SignAndMarshalTx signs an Ethereum transaction and returns it in byte
-// format, ready to be included into a Byzcoin transaction
-func (account EvmAccount) SignAndMarshalTx(tx *types.Transaction) ([]byte, error) {
-	var signer types.Signer = types.HomesteadSigner{}
-
-	signedTx, err := types.SignTx(tx, signer, account.PrivateKey)
+// SignAndMarshalTx signs an Ethereum transaction for the given chain ID
+// (EIP-155) and returns it in byte format, ready to be included into a
+// Byzcoin transaction
+func (account EvmAccount) SignAndMarshalTx(tx *types.Transaction, chainID *big.Int) ([]byte, error) {
+	signedTx, err := account.signTx(tx, chainID)
 	if err != nil {
 		return nil, err
 	}
@@ -124,6 +129,13 @@ func (account EvmAccount) SignAndMarshalTx(tx *types.Transaction) ([]byte, error
 	return signedBuffer, err
 }
 
+// Sign an Ethereum transaction for the given chain ID
+func (account EvmAccount) signTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	var signer types.Signer = types.NewEIP155Signer(chainID)
+
+	return types.SignTx(tx, signer, account.PrivateKey)
+}
+
 // ---------------------------------------------------------------------------
 
 // Client is the abstraction for the ByzCoin EVM client
@@ -131,10 +143,67 @@ type Client struct {
 	bcClient   *byzcoin.Client
 	signer     darc.Signer
 	instanceID byzcoin.InstanceID
+	onetClient *onet.Client // Client of the BEVM service
+	nodeCache  *NodeCache   // Cache of the EVM state database entries read
+	autoNonce  bool         // Whether account nonces are filled from the EVM state
 }
 
-// NewBEvm creates a new ByzCoin EVM instance
+// NonceMismatchError is returned when an EVM transaction is rejected while
+// its nonce differs from the one of its sender in the EVM state. The nonce of
+// the account used, if any, is then set to the one of the EVM state.
+type NonceMismatchError struct {
+	Address  common.Address
+	TxNonce  uint64 // Nonce of the rejected transaction
+	Expected uint64 // Nonce of the sender in the EVM state
+	Err      error  // Error returned by ByzCoin
+}
+
+func (e *NonceMismatchError) Error() string {
+	return fmt.Sprintf("Nonce mismatch for '%s': transaction nonce is %d, expected %d (%v)",
+		e.Address.Hex(), e.TxNonce, e.Expected, e.Err)
+}
+
+// NewBEvm creates a new ByzCoin EVM instance with default parameters
 func NewBEvm(bcClient *byzcoin.Client, signer darc.Signer, gDarc *darc.Darc) (byzcoin.InstanceID, error) {
+	return NewBEvmWithParams(bcClient, signer, gDarc, Params{})
+}
+
+// NewBEvmWithParams creates a new ByzCoin EVM instance with the given
+// parameters. Zero values select the default value of the corresponding
+// parameters.
+func NewBEvmWithParams(bcClient *byzcoin.Client, signer darc.Signer, gDarc *darc.Darc, params Params) (byzcoin.InstanceID, error) {
+	return spawnBEvm(bcClient, signer, gDarc, params.ToArguments())
+}
+
+// NewBEvmFromSnapshot creates a new ByzCoin EVM instance with the given
+// parameters, whose initial state is imported from the given snapshot.
+// The whole snapshot is sent in a single ByzCoin transaction.
+func NewBEvmFromSnapshot(bcClient *byzcoin.Client, signer darc.Signer, gDarc *darc.Darc, params Params, snapshot *Snapshot) (byzcoin.InstanceID, error) {
+	snapshotData, err := json.Marshal(snapshot)
+	if err != nil {
+		return byzcoin.NewInstanceID(nil), err
+	}
+
+	args := append(params.ToArguments(), byzcoin.Argument{Name: "snapshot", Value: snapshotData})
+
+	return spawnBEvm(bcClient, signer, gDarc, args)
+}
+
+// NewBEvmWithAlloc creates a new ByzCoin EVM instance with the given
+// parameters, starting with the accounts of the given genesis allocation
+func NewBEvmWithAlloc(bcClient *byzcoin.Client, signer darc.Signer, gDarc *darc.Darc, params Params, alloc core.GenesisAlloc) (byzcoin.InstanceID, error) {
+	allocData, err := json.Marshal(alloc)
+	if err != nil {
+		return byzcoin.NewInstanceID(nil), err
+	}
+
+	args := append(params.ToArguments(), byzcoin.Argument{Name: "alloc", Value: allocData})
+
+	return spawnBEvm(bcClient, signer, gDarc, args)
+}
+
+// Spawn a new ByzCoin EVM instance with the given arguments
+func spawnBEvm(bcClient *byzcoin.Client, signer darc.Signer, gDarc *darc.Darc, args byzcoin.Arguments) (byzcoin.InstanceID, error) {
 	instanceID := byzcoin.NewInstanceID(nil)
 
 	counters, err := bcClient.GetSignerCounters(signer.Identity().String())
@@ -148,7 +217,7 @@ func NewBEvm(bcClient *byzcoin.Client, signer darc.Signer, gDarc *darc.Darc) (by
 			SignerCounter: []uint64{counters.Counters[0] + 1},
 			Spawn: &byzcoin.Spawn{
 				ContractID: ContractBEvmID,
-				Args:       byzcoin.Arguments{},
+				Args:       args,
 			},
 		}},
 	}
@@ -170,71 +239,156 @@ func NewBEvm(bcClient *byzcoin.Client, signer darc.Signer, gDarc *darc.Darc) (by
 	return instanceID, nil
 }
 
+// Maximum number of EVM state database entries cached by a client
+const nodeCacheCapacity = 4096
+
 // NewClient creates a new ByzCoin EVM client, connected to the given ByzCoin instance
 func NewClient(bcClient *byzcoin.Client, signer darc.Signer, instanceID byzcoin.InstanceID) (*Client, error) {
 	return &Client{
 		bcClient:   bcClient,
 		signer:     signer,
 		instanceID: instanceID,
+		onetClient: onet.NewClient(cothority.Suite, ServiceName),
+		nodeCache:  NewNodeCache(nodeCacheCapacity),
 	}, nil
 }
 
-// Deploy deploys a new Ethereum contract on the EVM
-func (client *Client) Deploy(gasLimit uint64, gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, args ...interface{}) error {
+// Deploy deploys a new Ethereum contract on the EVM, and returns the receipt
+// of the EVM transaction
+func (client *Client) Deploy(gasLimit uint64, gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, args ...interface{}) (*types.Receipt, error) {
 	log.Lvlf2(">>> Deploy EVM contract '%s'", contract.name)
 	defer log.Lvlf2("<<< Deploy EVM contract '%s'", contract.name)
 
-	packedArgs, err := contract.packConstructor(args...)
+	receipt, signedTx, err := client.invokeTx(account, func() (*types.Transaction, error) {
+		return newDeployTx(gasLimit, gasPrice, amount, account, contract, args...)
+	}, "transaction")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	callData := append(contract.Bytecode, packedArgs...)
-	tx := types.NewContractCreation(account.Nonce, big.NewInt(int64(amount)), gasLimit, gasPrice, callData)
-	signedTxBuffer, err := account.SignAndMarshalTx(tx)
-	if err != nil {
-		return err
-	}
+	contract.Address = crypto.CreateAddress(account.Address, signedTx.Nonce())
 
-	err = client.invoke("transaction", byzcoin.Arguments{
-		{Name: "tx", Value: signedTxBuffer},
-	})
+	return receipt, nil
+}
+
+// Transaction performs a new transaction (contract method call with state
+// change) on the EVM, and returns the receipt of the EVM transaction
+func (client *Client) Transaction(gasLimit uint64, gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, method string, args ...interface{}) (*types.Receipt, error) {
+	log.Lvlf2(">>> EVM method '%s()' on %s", method, contract)
+	defer log.Lvlf2("<<< EVM method '%s()' on %s", method, contract)
+
+	receipt, _, err := client.invokeTx(account, func() (*types.Transaction, error) {
+		return newMethodTx(gasLimit, gasPrice, amount, account, contract, method, args...)
+	}, "transaction")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	contract.Address = crypto.CreateAddress(account.Address, account.Nonce)
-	account.Nonce++
+	return receipt, nil
+}
 
-	return nil
+// Batch is an ordered list of EVM transactions, executed atomically by
+// Client.TransactionBatch()
+type Batch struct {
+	txs      []*types.Transaction
+	accounts []*EvmAccount
+	nonces   map[*EvmAccount]uint64 // Account nonces before the batch
 }
 
-// Transaction performs a new transaction (contract method call with state change) on the EVM
-func (client *Client) Transaction(gasLimit uint64, gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, method string, args ...interface{}) error {
-	log.Lvlf2(">>> EVM method '%s()' on %s", method, contract)
-	defer log.Lvlf2("<<< EVM method '%s()' on %s", method, contract)
+// NewBatch creates a new, empty batch of EVM transactions
+func NewBatch() *Batch {
+	return &Batch{
+		nonces: make(map[*EvmAccount]uint64),
+	}
+}
 
-	callData, err := contract.packMethod(method, args...)
+// Deploy adds the deployment of a new Ethereum contract to the batch. The
+// contract address and the account nonce are updated right away, so that
+// subsequent transactions of the batch can use them.
+func (batch *Batch) Deploy(gasLimit uint64, gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, args ...interface{}) error {
+	tx, err := newDeployTx(gasLimit, gasPrice, amount, account, contract, args...)
 	if err != nil {
 		return err
 	}
 
-	tx := types.NewTransaction(account.Nonce, contract.Address, big.NewInt(int64(amount)), gasLimit, gasPrice, callData)
-	signedTxBuffer, err := account.SignAndMarshalTx(tx)
+	batch.add(account, tx)
+	contract.Address = crypto.CreateAddress(account.Address, tx.Nonce())
+
+	return nil
+}
+
+// Transaction adds a transaction (contract method call with state change) to
+// the batch
+func (batch *Batch) Transaction(gasLimit uint64, gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, method string, args ...interface{}) error {
+	tx, err := newMethodTx(gasLimit, gasPrice, amount, account, contract, method, args...)
 	if err != nil {
 		return err
 	}
 
-	err = client.invoke("transaction", byzcoin.Arguments{
-		{Name: "tx", Value: signedTxBuffer},
-	})
-	if err != nil {
-		return err
+	batch.add(account, tx)
+
+	return nil
+}
+
+func (batch *Batch) add(account *EvmAccount, tx *types.Transaction) {
+	if _, ok := batch.nonces[account]; !ok {
+		batch.nonces[account] = account.Nonce
 	}
 
+	batch.txs = append(batch.txs, tx)
+	batch.accounts = append(batch.accounts, account)
 	account.Nonce++
+}
 
-	return nil
+// Restore the account nonces as they were before the batch
+func (batch *Batch) rollback() {
+	for account, nonce := range batch.nonces {
+		account.Nonce = nonce
+	}
+}
+
+// TransactionBatch atomically executes a batch of EVM transactions within a
+// single ByzCoin block, and returns their receipts. If any of the
+// transactions fails, none of them is applied and the account nonces are
+// restored, unless they do not match the EVM state, in which case they are
+// set to the ones of the EVM state and a *NonceMismatchError is returned for
+// the first account of the batch whose nonce did not match.
+// As the transactions of a batch are built beforehand, their nonces are not
+// filled automatically; SyncNonce() can be used before building the batch.
+func (client *Client) TransactionBatch(batch *Batch) ([]*types.Receipt, error) {
+	log.Lvlf2(">>> EVM batch of %d transactions", len(batch.txs))
+	defer log.Lvlf2("<<< EVM batch of %d transactions", len(batch.txs))
+
+	receipts, err := client.invokeBatch(batch)
+	if err != nil {
+		batch.rollback()
+
+		// All the accounts are synchronized, in the order of the batch
+		var firstMismatch *NonceMismatchError
+		checked := make(map[*EvmAccount]bool)
+		for _, account := range batch.accounts {
+			if checked[account] {
+				continue
+			}
+			checked[account] = true
+
+			mismatch := client.checkNonce(account.Address, batch.nonces[account], err)
+			if mismatch != nil {
+				account.Nonce = mismatch.Expected
+				if firstMismatch == nil {
+					firstMismatch = mismatch
+				}
+			}
+		}
+
+		if firstMismatch != nil {
+			return nil, firstMismatch
+		}
+
+		return nil, err
+	}
+
+	return receipts, nil
 }
 
 // Call performs a new call (contract view method call, without state change) on the EVM
@@ -248,28 +402,219 @@ func (client *Client) Call(account *EvmAccount, result interface{}, contract *Ev
 		return err
 	}
 
-	// Retrieve the EVM state
-	stateDb, err := getEvmDb(client.bcClient, client.instanceID)
+	// The call is performed by a conode
+	var resp ViewCallResponse
+	err = client.sendRequest(&ViewCallRequest{
+		ByzCoinID: client.bcClient.ID,
+		BEvmID:    client.instanceID,
+		From:      account.Address.Bytes(),
+		To:        contract.Address.Bytes(),
+		CallData:  callData,
+	}, &resp, &resp.Proof, nil)
 	if err != nil {
 		return err
 	}
 
-	// Instantiate a new EVM
-	evm := vm.NewEVM(getContext(), stateDb, getChainConfig(), getVMConfig())
-
-	// Perform the call (1 Ether should be enough for everyone [tm]...)
-	ret, _, err := evm.Call(vm.AccountRef(account.Address), contract.Address, callData, uint64(1*WeiPerEther), big.NewInt(0))
+	// Unpack the result into the caller's variable
+	err = contract.unpackResult(&result, method, resp.Result)
 	if err != nil {
 		return err
 	}
 
-	// Unpack the result into the caller's variable
-	err = contract.unpackResult(&result, method, ret)
+	return nil
+}
+
+// EstimateGas returns the gas limit needed by a transaction on the EVM. If
+// 'method' is empty, the deployment of the contract is estimated, 'args' being
+// the constructor arguments.
+func (client *Client) EstimateGas(gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, method string, args ...interface{}) (uint64, error) {
+	var tx *types.Transaction
+	var err error
+	if method == "" {
+		tx, err = newDeployTx(0, gasPrice, amount, account, contract, args...)
+	} else {
+		tx, err = newMethodTx(0, gasPrice, amount, account, contract, method, args...)
+	}
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	gasLimit, err := client.EstimateTxGas(tx, account.Address)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Lvlf2("Estimated gas for '%s': %d", contract.name, gasLimit)
+
+	return gasLimit, nil
+}
+
+// EstimateTxGas returns the gas limit needed by an unsigned EVM transaction,
+// sent from the given address. The gas limit and nonce of the transaction are
+// ignored.
+func (client *Client) EstimateTxGas(tx *types.Transaction, from common.Address) (uint64, error) {
+	var to []byte
+	if tx.To() != nil {
+		to = tx.To().Bytes()
+	}
+
+	// The estimation is performed by a conode
+	var resp EstimateGasResponse
+	err := client.sendRequest(&EstimateGasRequest{
+		ByzCoinID: client.bcClient.ID,
+		BEvmID:    client.instanceID,
+		From:      from.Bytes(),
+		To:        to,
+		Value:     tx.Value().Bytes(),
+		GasPrice:  tx.GasPrice().Bytes(),
+		Data:      tx.Data(),
+	}, &resp, &resp.Proof, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.GasLimit, nil
+}
+
+// SimulationResult is the outcome of a simulated EVM transaction
+type SimulationResult struct {
+	Receipt      *types.Receipt
+	ReturnData   []byte
+	RevertReason string          // Reason given by a failed transaction, if any
+	Changes      []AccountChange // Accounts modified by the transaction
+	// Number of ByzCoin instructions emitted by the transaction
+	EmittedInstructions uint64
+	// Reason for which the emitted instructions would be refused, failing the
+	// whole transaction, if any
+	InstructionsError string
+}
+
+// Simulate executes an EVM transaction against the current state of the EVM,
+// without submitting it to ByzCoin. The transaction can be signed or not; in
+// the latter case, it is sent from the given address and its nonce is not
+// checked.
+func (client *Client) Simulate(tx *types.Transaction, from common.Address) (*SimulationResult, error) {
+	req, err := client.newSimulateRequest(tx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	// The simulation is performed by a conode
+	var resp SimulateResponse
+	err = client.sendRequest(req, &resp, &resp.Proof, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt, err := decodeReceipt(resp.Receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SimulationResult{
+		Receipt:             receipt,
+		ReturnData:          resp.ReturnData,
+		RevertReason:        resp.RevertReason,
+		Changes:             resp.Changes,
+		EmittedInstructions: resp.EmittedInstructions,
+		InstructionsError:   resp.InstructionsError,
+	}, nil
+}
+
+// Helper function that builds the request simulating a signed or unsigned
+// EVM transaction
+func (client *Client) newSimulateRequest(tx *types.Transaction, from common.Address) (*SimulateRequest, error) {
+	req := &SimulateRequest{
+		ByzCoinID: client.bcClient.ID,
+		BEvmID:    client.instanceID,
+	}
+
+	_, r, _ := tx.RawSignatureValues()
+	if r != nil && r.Sign() != 0 {
+		txData, err := tx.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		req.Tx = txData
+	} else {
+		if tx.To() != nil {
+			req.To = tx.To().Bytes()
+		}
+		req.From = from.Bytes()
+		req.Value = tx.Value().Bytes()
+		req.GasLimit = tx.Gas()
+		req.GasPrice = tx.GasPrice().Bytes()
+		req.Data = tx.Data()
+	}
+
+	return req, nil
+}
+
+// TraceResult is the trace of an EVM transaction
+type TraceResult struct {
+	Receipt      *types.Receipt
+	ReturnData   []byte
+	RevertReason string      // Reason given by a failed transaction, if any
+	Steps        []TraceStep // Executed opcodes
+	Calls        []TraceCall // Calls made, the first one being the top-level call
+	Truncated    bool        // Set if the maximum number of steps was reached
+	Diverged     bool        // Set if the replay of an executed transaction does not match its receipt
+}
+
+// Trace simulates an EVM transaction in the same way as Simulate(), and
+// returns the trace of its execution
+func (client *Client) Trace(tx *types.Transaction, from common.Address) (*TraceResult, error) {
+	simulateReq, err := client.newSimulateRequest(tx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.trace(&TraceRequest{
+		ByzCoinID: client.bcClient.ID,
+		BEvmID:    client.instanceID,
+		Tx:        simulateReq.Tx,
+		From:      simulateReq.From,
+		To:        simulateReq.To,
+		Value:     simulateReq.Value,
+		GasLimit:  simulateReq.GasLimit,
+		GasPrice:  simulateReq.GasPrice,
+		Data:      simulateReq.Data,
+	})
+}
+
+// TraceTransaction replays an EVM transaction executed by the BEVM instance,
+// and returns the trace of its execution. This fails if the EVM state
+// preceding the transaction was pruned.
+func (client *Client) TraceTransaction(txHash common.Hash) (*TraceResult, error) {
+	return client.trace(&TraceRequest{
+		ByzCoinID: client.bcClient.ID,
+		BEvmID:    client.instanceID,
+		TxHash:    txHash.Bytes(),
+	})
+}
+
+// Helper function that sends a trace request to a conode
+func (client *Client) trace(req *TraceRequest) (*TraceResult, error) {
+	var resp TraceResponse
+	err := client.sendRequest(req, &resp, &resp.Proof, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt, err := decodeReceipt(resp.Receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TraceResult{
+		Receipt:      receipt,
+		ReturnData:   resp.ReturnData,
+		RevertReason: resp.RevertReason,
+		Steps:        resp.Steps,
+		Calls:        resp.Calls,
+		Truncated:    resp.Truncated,
+		Diverged:     resp.Diverged,
+	}, nil
 }
 
 // CreditAccount credits the given Ethereum address with the given amount
@@ -287,42 +632,381 @@ func (client *Client) CreditAccount(amount *big.Int, address common.Address) err
 	return nil
 }
 
+// Deposit converts ByzCoin coins, taken from the given coin instance, into
+// ether credited to the given Ethereum address. One coin is worth one ether.
+func (client *Client) Deposit(coinID byzcoin.InstanceID, amount uint64, address common.Address) error {
+	coinsBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coinsBuf, amount)
+
+	err := client.sendInstructions(
+		byzcoin.Instruction{
+			InstanceID: coinID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: contracts.ContractCoinID,
+				Command:    "fetch",
+				Args:       byzcoin.Arguments{{Name: "coins", Value: coinsBuf}},
+			},
+		},
+		byzcoin.Instruction{
+			InstanceID: client.instanceID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractBEvmID,
+				Command:    "deposit",
+				Args:       byzcoin.Arguments{{Name: "address", Value: address.Bytes()}},
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Lvlf2("Deposited %d coins on '%x'", amount, address)
+
+	return nil
+}
+
+// Withdraw converts ether from the given Ethereum account into ByzCoin coins,
+// sent to the given coin instance. The withdrawal is authorized by an EVM
+// transaction signed by the account, whose receipt is returned.
+func (client *Client) Withdraw(gasLimit uint64, gasPrice *big.Int, account *EvmAccount, amount uint64, coinID byzcoin.InstanceID) (*types.Receipt, error) {
+	receipt, _, err := client.invokeTx(account, func() (*types.Transaction, error) {
+		return types.NewTransaction(account.Nonce, WithdrawAddress, coinsToWei(amount), gasLimit, gasPrice, nil), nil
+	}, "withdraw", byzcoin.Argument{Name: "coinID", Value: coinID.Slice()})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Lvlf2("Withdrew %d coins from '%x'", amount, account.Address)
+
+	return receipt, nil
+}
+
 // GetAccountBalance returns the current balance of a Ethereum address
 func (client *Client) GetAccountBalance(address common.Address) (*big.Int, error) {
-	stateDb, err := getEvmDb(client.bcClient, client.instanceID)
+	var resp BalanceResponse
+	var balance *big.Int
+	err := client.sendRequest(&BalanceRequest{
+		ByzCoinID: client.bcClient.ID,
+		BEvmID:    client.instanceID,
+		Address:   address.Bytes(),
+	}, &resp, &resp.Proof, func(bs *State) error {
+		// The balance is read from the proof of the account
+		account, err := verifyAccountProof(bs.RootHash, address, resp.AccountProof)
+		if err != nil {
+			return err
+		}
+
+		balance = big.NewInt(0)
+		if account != nil {
+			balance = account.Balance
+		}
+		if balance.Cmp(new(big.Int).SetBytes(resp.Balance)) != 0 {
+			return fmt.Errorf("Balance of account '%s' does not match its proof", address.Hex())
+		}
+
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	balance := stateDb.GetBalance(address)
-
 	log.Lvlf2("Balance of '%x' is %d wei", address, balance)
 
 	return balance, nil
 }
 
+// GetNonce returns the nonce of an Ethereum address in the EVM state, i.e. the
+// nonce of its next transaction
+func (client *Client) GetNonce(address common.Address) (uint64, error) {
+	var resp NonceResponse
+	err := client.sendRequest(&NonceRequest{
+		ByzCoinID: client.bcClient.ID,
+		BEvmID:    client.instanceID,
+		Address:   address.Bytes(),
+	}, &resp, &resp.Proof, func(bs *State) error {
+		// The nonce must be the one of the proof of the account
+		account, err := verifyAccountProof(bs.RootHash, address, resp.AccountProof)
+		if err != nil {
+			return err
+		}
+
+		nonce := uint64(0)
+		if account != nil {
+			nonce = account.Nonce
+		}
+		if nonce != resp.Nonce {
+			return fmt.Errorf("Nonce of account '%s' does not match its proof", address.Hex())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Lvlf2("Nonce of '%x' is %d", address, resp.Nonce)
+
+	return resp.Nonce, nil
+}
+
+// SyncNonce sets the nonce of an account to the one of the EVM state
+func (client *Client) SyncNonce(account *EvmAccount) error {
+	nonce, err := client.GetNonce(account.Address)
+	if err != nil {
+		return err
+	}
+
+	account.Nonce = nonce
+
+	return nil
+}
+
+// SetAutoNonce enables or disables the automatic filling of the account
+// nonces from the EVM state before each transaction sent by Deploy(),
+// Transaction() and Withdraw(). This allows using the same account from
+// several clients, at the cost of an additional read of the EVM state per
+// transaction.
+func (client *Client) SetAutoNonce(enabled bool) {
+	client.autoNonce = enabled
+}
+
+// ChainID returns the EVM chain ID of the ByzCoin EVM instance, to be used
+// when signing EVM transactions
+func (client *Client) ChainID() (*big.Int, error) {
+	params, err := client.GetParams()
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetUint64(params.ChainID), nil
+}
+
+// GetParams returns the parameters of the ByzCoin EVM instance
+func (client *Client) GetParams() (*Params, error) {
+	bs, _, err := getBEvmState(client.bcClient, client.instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	params := bs.GetParams(client.instanceID)
+
+	return &params, nil
+}
+
+// UpdateParams updates the parameters of the ByzCoin EVM instance. Zero
+// values leave the corresponding parameters unchanged. The chain ID can only
+// be changed with ChangeChainID().
+func (client *Client) UpdateParams(params Params) error {
+	return client.invoke("config", params.ToArguments())
+}
+
+// ChangeChainID changes the EVM chain ID of the ByzCoin EVM instance. The
+// transactions signed for the previous chain ID are not accepted anymore.
+func (client *Client) ChangeChainID(chainID uint64) error {
+	if chainID == 0 {
+		return errors.New("Invalid chain ID: 0")
+	}
+
+	args := append(Params{ChainID: chainID}.ToArguments(),
+		byzcoin.Argument{Name: "changeChainID", Value: []byte{1}})
+
+	return client.invoke("config", args)
+}
+
+// Prune removes the entries of the EVM state database that are no longer
+// reachable from its current state, such as superseded trie nodes
+func (client *Client) Prune() error {
+	return client.invoke("prune", nil)
+}
+
+// PruneTxRecords prunes the EVM state database as Prune() does, and also
+// removes the records of the executed transactions whose preceding state is
+// not available anymore. These transactions cannot be traced anymore, and
+// GetTx() does not find them either; their receipts are kept.
+func (client *Client) PruneTxRecords() error {
+	return client.invoke("prune", byzcoin.Arguments{{Name: "txRecords", Value: []byte{1}}})
+}
+
+// Delete deletes the ByzCoin EVM instance along with its EVM state database.
+// Large databases need several ByzCoin transactions to be removed.
+func (client *Client) Delete() error {
+	for {
+		err := client.sendInstructions(byzcoin.Instruction{
+			InstanceID: client.instanceID,
+			Delete: &byzcoin.Delete{
+				ContractID: ContractBEvmID,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		proofResponse, err := client.bcClient.GetProof(client.instanceID.Slice())
+		if err != nil {
+			return err
+		}
+
+		exists, err := proofResponse.Proof.Exists(client.instanceID.Slice())
+		if err != nil {
+			return err
+		}
+		if !exists {
+			break
+		}
+
+		log.Lvl2("BEVM instance partially deleted, continuing")
+	}
+
+	log.Lvlf2("Deleted BEVM instance '%s'", client.instanceID)
+
+	return nil
+}
+
+// ExportState takes a snapshot of the world state of the ByzCoin EVM instance
+func (client *Client) ExportState() (*Snapshot, error) {
+	stateDb, _, _, err := getEvmDb(client.bcClient, client.instanceID, client.nodeCache)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := takeSnapshot(stateDb)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Lvlf2("Exported %d accounts", len(snapshot.Accounts))
+
+	return snapshot, nil
+}
+
+// SendSignedTx sends an EVM transaction, already signed for the chain ID of
+// the ByzCoin EVM instance, and returns its receipt
+func (client *Client) SendSignedTx(signedTx *types.Transaction) (*types.Receipt, error) {
+	signedTxBuffer, err := signedTx.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.invoke("transaction", byzcoin.Arguments{
+		{Name: "tx", Value: signedTxBuffer},
+	})
+	if err != nil {
+		chainID, chainErr := client.ChainID()
+		if chainErr != nil {
+			return nil, err
+		}
+
+		sender, senderErr := types.Sender(types.NewEIP155Signer(chainID), signedTx)
+		if senderErr != nil {
+			return nil, err
+		}
+
+		mismatch := client.checkNonce(sender, signedTx.Nonce(), err)
+		if mismatch != nil {
+			return nil, mismatch
+		}
+
+		return nil, err
+	}
+
+	return client.getExecutedTxReceipt(signedTx.Hash())
+}
+
+// GetStateDb returns a read-only view of the EVM state database, as of the
+// latest ByzCoin block
+func (client *Client) GetStateDb() (*state.StateDB, error) {
+	stateDb, _, _, err := getEvmDb(client.bcClient, client.instanceID, client.nodeCache)
+
+	return stateDb, err
+}
+
+// GetTx returns a previously executed EVM transaction, along with the number
+// of the EVM block in which it was executed
+func (client *Client) GetTx(txHash common.Hash) (*types.Transaction, uint64, error) {
+	byzDb, err := NewClientByzDatabase(client.instanceID, client.bcClient)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	recordData, err := byzDb.Get(getTxRecordKey(txHash))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var record txRecord
+	err = protobuf.Decode(recordData, &record)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var tx types.Transaction
+	err = tx.UnmarshalJSON(record.Tx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The EVM block number follows the index of the latest ByzCoin block
+	return &tx, record.BlockIndex + 1, nil
+}
+
+// GetTxReceipt returns the receipt of a previously executed EVM transaction
+func (client *Client) GetTxReceipt(txHash common.Hash) (*types.Receipt, error) {
+	byzDb, err := NewClientByzDatabase(client.instanceID, client.bcClient)
+	if err != nil {
+		return nil, err
+	}
+
+	receiptData, err := byzDb.Get(getReceiptKey(txHash))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeReceipt(receiptData)
+}
+
 // ---------------------------------------------------------------------------
 // Helper functions
 
-// Retrieve a read-only EVM state database from ByzCoin
-func getEvmDb(bcClient *byzcoin.Client, instID byzcoin.InstanceID) (*state.StateDB, error) {
+// Retrieve the state of a ByzCoin EVM instance, as well as its proof
+func getBEvmState(bcClient *byzcoin.Client, instID byzcoin.InstanceID) (*State, *byzcoin.Proof, error) {
 	// Retrieve the proof of the Byzcoin instance
 	proofResponse, err := bcClient.GetProof(instID[:])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	bs, err := verifyBEvmProof(bcClient, instID, &proofResponse.Proof)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	return bs, &proofResponse.Proof, nil
+}
+
+// Verify the proof of a ByzCoin EVM instance, and return the instance state
+func verifyBEvmProof(bcClient *byzcoin.Client, instID byzcoin.InstanceID, proof *byzcoin.Proof) (*State, error) {
 	// Validate the proof
-	err = proofResponse.Proof.Verify(bcClient.ID)
+	err := proof.Verify(bcClient.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := proof.Exists(instID[:])
 	if err != nil {
 		return nil, err
 	}
+	if !exists {
+		return nil, fmt.Errorf("BEVM instance '%s' does not exist", instID)
+	}
 
 	// Extract the value from the proof
-	_, value, _, _, err := proofResponse.Proof.KeyValue()
+	_, value, contractID, _, err := proof.KeyValue()
 	if err != nil {
 		return nil, err
 	}
+	if contractID != ContractBEvmID {
+		return nil, fmt.Errorf("Instance '%s' is not a BEVM instance", instID)
+	}
 
 	// Decode the proof value into an EVM State
 	var bs State
@@ -331,34 +1015,323 @@ func getEvmDb(bcClient *byzcoin.Client, instID byzcoin.InstanceID) (*state.State
 		return nil, err
 	}
 
+	return &bs, nil
+}
+
+// Retrieve a read-only EVM state database from ByzCoin, as well as the
+// ByzCoin EVM instance state and the corresponding EVM block information. The
+// EVM state database is pinned to the root hash of the ByzCoin EVM instance
+// state, as proven by the latest block, so that its reads are consistent with
+// this block.
+func getEvmDb(bcClient *byzcoin.Client, instID byzcoin.InstanceID, cache *NodeCache) (*state.StateDB, *State, *blockInfo, error) {
+	bs, proof, err := getBEvmState(bcClient, instID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	// Create a client ByzDB instance
 	byzDb, err := NewClientByzDatabase(instID, bcClient)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+	byzDb.SetCache(cache)
+	// The whole session reads the proven state
+	byzDb.Pin(bs.RootHash, &proof.Latest)
 
 	db := state.NewDatabase(byzDb)
 
-	return state.New(bs.RootHash, db)
+	stateDb, err := state.New(bs.RootHash, db)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The proof contains the latest ByzCoin block
+	bi, err := newBlockInfo(&proof.Latest, func(index int) (*skipchain.SkipBlock, error) {
+		reply, err := skipchain.NewClient().GetSingleBlockByIndex(&bcClient.Roster, bcClient.ID, index)
+		if err != nil {
+			return nil, err
+		}
+
+		return reply.SkipBlock, nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return stateDb, bs, bi, nil
+}
+
+// Build an EVM transaction deploying a contract
+func newDeployTx(gasLimit uint64, gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, args ...interface{}) (*types.Transaction, error) {
+	packedArgs, err := contract.packConstructor(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	callData := append(contract.Bytecode, packedArgs...)
+
+	return types.NewContractCreation(account.Nonce, big.NewInt(int64(amount)), gasLimit, gasPrice, callData), nil
+}
+
+// Build an EVM transaction calling a contract method
+func newMethodTx(gasLimit uint64, gasPrice *big.Int, amount uint64, account *EvmAccount, contract *EvmContract, method string, args ...interface{}) (*types.Transaction, error) {
+	callData, err := contract.packMethod(method, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return types.NewTransaction(account.Nonce, contract.Address, big.NewInt(int64(amount)), gasLimit, gasPrice, callData), nil
+}
+
+// Sign and send an EVM transaction of an account to a ByzCoin EVM instance
+// using the given command, and retrieve its receipt. The transaction is built
+// by newTx for the current nonce of the account, which is first filled from
+// the EVM state if automatic nonces are enabled, and is incremented once the
+// transaction is executed. If the transaction is rejected while its nonce
+// does not match the EVM state, the nonce of the account is set to the one of
+// the EVM state, and the transaction is retried once if automatic nonces are
+// enabled.
+func (client *Client) invokeTx(account *EvmAccount, newTx func() (*types.Transaction, error),
+	command string, args ...byzcoin.Argument) (*types.Receipt, *types.Transaction, error) {
+	if client.autoNonce {
+		err := client.SyncNonce(account)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	chainID, err := client.ChainID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		tx, err := newTx()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		signedTx, err := account.signTx(tx, chainID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		signedTxBuffer, err := signedTx.MarshalJSON()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = client.invoke(command, append(byzcoin.Arguments{
+			{Name: "tx", Value: signedTxBuffer},
+		}, args...))
+		if err != nil {
+			mismatch := client.checkNonce(account.Address, tx.Nonce(), err)
+			if mismatch == nil {
+				return nil, nil, err
+			}
+
+			account.Nonce = mismatch.Expected
+			if !client.autoNonce || attempt > 0 {
+				return nil, nil, mismatch
+			}
+
+			log.Lvlf2("Retrying EVM transaction with nonce %d: %v", account.Nonce, mismatch)
+			continue
+		}
+
+		account.Nonce++
+
+		receipt, err := client.getExecutedTxReceipt(signedTx.Hash())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return receipt, signedTx, nil
+	}
+}
+
+// Retrieve the receipt of an EVM transaction which was just executed
+func (client *Client) getExecutedTxReceipt(txHash common.Hash) (*types.Receipt, error) {
+	receipt, err := client.GetTxReceipt(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Lvlf2("EVM transaction '%s': status = %d, gas used = %d",
+		receipt.TxHash.Hex(), receipt.Status, receipt.GasUsed)
+
+	return receipt, nil
+}
+
+// Check whether the rejection of an EVM transaction with the given sender and
+// nonce may be due to a wrong nonce, by comparing it with the EVM state.
+// Return a *NonceMismatchError if so, nil otherwise.
+func (client *Client) checkNonce(sender common.Address, txNonce uint64, err error) *NonceMismatchError {
+	nonce, nonceErr := client.GetNonce(sender)
+	if nonceErr != nil {
+		log.Lvlf2("Cannot check the nonce of '%x': %v", sender, nonceErr)
+		return nil
+	}
+
+	if nonce == txNonce {
+		return nil
+	}
+
+	return &NonceMismatchError{Address: sender, TxNonce: txNonce, Expected: nonce, Err: err}
+}
+
+// Sign and send a batch of EVM transactions to a ByzCoin EVM instance, and
+// retrieve their receipts
+func (client *Client) invokeBatch(batch *Batch) ([]*types.Receipt, error) {
+	if len(batch.txs) == 0 {
+		return nil, errors.New("Empty batch of EVM transactions")
+	}
+
+	chainID, err := client.ChainID()
+	if err != nil {
+		return nil, err
+	}
+
+	var args byzcoin.Arguments
+	var txHashes []common.Hash
+	for i, tx := range batch.txs {
+		signedTx, err := batch.accounts[i].signTx(tx, chainID)
+		if err != nil {
+			return nil, err
+		}
+
+		signedTxBuffer, err := signedTx.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, byzcoin.Argument{Name: "tx", Value: signedTxBuffer})
+		txHashes = append(txHashes, signedTx.Hash())
+	}
+
+	err = client.invoke("transactions", args)
+	if err != nil {
+		return nil, err
+	}
+
+	var receipts []*types.Receipt
+	for _, txHash := range txHashes {
+		receipt, err := client.GetTxReceipt(txHash)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	return receipts, nil
+}
+
+// Send a request to the BEVM service of the conodes of the roster, in turn,
+// until one of them provides a valid response: the proof of the ByzCoin EVM
+// instance contained in the response is verified, as well as the response
+// itself against the instance state, if check is not nil
+func (client *Client) sendRequest(req interface{}, resp interface{}, proof *byzcoin.Proof, check func(*State) error) error {
+	servers := client.bcClient.Roster.List
+	if len(servers) == 0 {
+		return errors.New("Empty ByzCoin roster")
+	}
+
+	var err error
+	for _, server := range servers {
+		// Discard the response of the previous conode, if any
+		respValue := reflect.ValueOf(resp).Elem()
+		respValue.Set(reflect.Zero(respValue.Type()))
+
+		err = client.sendRequestTo(server, req, resp, proof, check)
+		if err == nil {
+			return nil
+		}
+
+		log.Lvlf2("Request to conode %s failed: %v", server, err)
+	}
+
+	return err
+}
+
+// Send a request to the BEVM service of a conode, and verify its response
+func (client *Client) sendRequestTo(server *network.ServerIdentity, req interface{}, resp interface{},
+	proof *byzcoin.Proof, check func(*State) error) error {
+	err := client.onetClient.SendProtobuf(server, req, resp)
+	if err != nil {
+		return err
+	}
+
+	bs, err := verifyBEvmProof(client.bcClient, client.instanceID, proof)
+	if err != nil {
+		return err
+	}
+
+	log.Lvlf3("Response based on EVM state root '%s'", bs.RootHash.Hex())
+
+	if check != nil {
+		err = check(bs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Verify the Merkle proof of an Ethereum account against the root hash of an
+// EVM state database, and return the account (nil if it does not exist)
+func verifyAccountProof(root common.Hash, address common.Address, proof [][]byte) (*state.Account, error) {
+	proofDb := ethdb.NewMemDatabase()
+	for _, node := range proof {
+		err := proofDb.Put(crypto.Keccak256(node), node)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	value, _, err := trie.VerifyProof(root, crypto.Keccak256(address.Bytes()), proofDb)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proof of account '%s': %v", address.Hex(), err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	var account state.Account
+	err = rlp.DecodeBytes(value, &account)
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
 }
 
 // Invoke a method on a ByzCoin EVM instance
 func (client *Client) invoke(command string, args byzcoin.Arguments) error {
+	return client.sendInstructions(byzcoin.Instruction{
+		InstanceID: client.instanceID,
+		Invoke: &byzcoin.Invoke{
+			ContractID: ContractBEvmID,
+			Command:    command,
+			Args:       args,
+		},
+	})
+}
+
+// Send instructions in a single ByzCoin transaction, signed by the client
+// signer
+func (client *Client) sendInstructions(instrs ...byzcoin.Instruction) error {
 	counters, err := client.bcClient.GetSignerCounters(client.signer.Identity().String())
 	if err != nil {
 		return err
 	}
 
+	for i := range instrs {
+		instrs[i].SignerCounter = []uint64{counters.Counters[0] + uint64(i) + 1}
+	}
+
 	ctx := byzcoin.ClientTransaction{
-		Instructions: []byzcoin.Instruction{{
-			InstanceID:    client.instanceID,
-			SignerCounter: []uint64{counters.Counters[0] + 1},
-			Invoke: &byzcoin.Invoke{
-				ContractID: ContractBEvmID,
-				Command:    command,
-				Args:       args,
-			},
-		}},
+		Instructions: instrs,
 	}
 
 	err = ctx.FillSignersAndSignWith(client.signer)
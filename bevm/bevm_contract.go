@@ -1,6 +1,7 @@
 package bevm
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
@@ -9,6 +10,10 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
 	"go.dedis.ch/cothority/v3/byzcoin"
 	"go.dedis.ch/cothority/v3/darc"
 	"go.dedis.ch/onet/v3/log"
@@ -23,10 +28,44 @@ var ContractBEvmValueID = "bevm_value"
 
 var nilAddress = common.HexToAddress("0x0000000000000000000000000000000000000000")
 
+// Prefix of the EVM state database keys holding transaction receipts
+var receiptKeyPrefix = []byte("bevm-receipt-")
+
+// Prefix of the EVM state database keys holding the records allowing to
+// replay transactions
+var txRecordKeyPrefix = []byte("bevm-tx-")
+
 // ByzCoin contract state for BEVM
 type contractBEvm struct {
 	byzcoin.BasicContract
 	State
+	service     *Service      // Provides access to the ByzCoin blocks
+	executedTxs []common.Hash // Transactions already executed by the current instruction
+	block       *txBlock      // EVM block formed by the transactions of the current instruction
+}
+
+// EVM block formed by the transactions executed by an instruction, which
+// share the block gas limit
+type txBlock struct {
+	gasPool *core.GasPool // Gas left to the following transactions
+	usedGas uint64        // Gas used by the transactions executed so far
+	txCount int           // Number of transactions executed so far
+}
+
+// Create a new EVM block with the given gas limit
+func newTxBlock(gasLimit uint64) *txBlock {
+	return &txBlock{gasPool: new(core.GasPool).AddGas(gasLimit)}
+}
+
+// Record of an executed transaction, allowing to replay it: the transaction
+// is executed on the EVM state of the instance before the instruction,
+// after the transactions previously executed by the same instruction.
+type txRecord struct {
+	Tx         []byte   // JSON-encoded transaction
+	Root       []byte   // Root of the EVM state before the instruction
+	BlockIndex uint64   // Index of the latest ByzCoin block when the transaction was executed
+	Previous   [][]byte // Hashes of the transactions previously executed by the same instruction
+	PostRoot   []byte   // Root of the EVM state after the transaction and its gas fees
 }
 
 // Deserialize a BEVM contract state
@@ -38,22 +77,55 @@ func contractBEvmFromBytes(in []byte) (byzcoin.Contract, error) {
 		return nil, err
 	}
 
+	contract.State.migrate()
+
 	return contract, nil
 }
 
 // State is the BEVM main contract persisted information, able to handle the EVM state database
 type State struct {
-	RootHash common.Hash // Hash of the last commit in the EVM state database
-	KeyList  []string    // List of keys contained in the EVM state database
+	RootHash     common.Hash // Hash of the last commit in the EVM state database
+	KeyList      []string    // Deprecated: list of keys of legacy instances, only kept for migration
+	Params       Params      // Parameters of the BEVM instance
+	Reserve      uint64      // ByzCoin coins deposited into the EVM, backing the bridged ether
+	KeyCount     uint64      // Number of keys contained in the EVM state database
+	KeyIndexSize uint64      // Number of entries in the key index of the EVM state database
+	Deleting     bool        // Set while the instance storage is being removed
+	Minted       bool        // Set once ether was created with the "credit" command, which disables deposits
+}
+
+// Migrate a legacy state, which kept the list of all the keys contained in
+// the EVM state database. The existence of the keys is now given by the
+// ByzCoin state trie, and only their number is kept; the keys are moved to
+// the key index by the next instruction modifying the EVM state database.
+func (bs *State) migrate() {
+	if len(bs.KeyList) == 0 {
+		return
+	}
+
+	bs.KeyCount = uint64(len(bs.KeyList))
+}
+
+// GetParams returns the parameters of a BEVM instance, with default values
+// filled in
+func (bs *State) GetParams(instanceID byzcoin.InstanceID) Params {
+	return bs.Params.withDefaults(instanceID)
 }
 
 // NewEvmDb creates a new EVM state database from the contract state
 func NewEvmDb(es *State, roStateTrie byzcoin.ReadOnlyStateTrie, instanceID byzcoin.InstanceID) (*state.StateDB, error) {
-	byzDb, err := NewServerByzDatabase(instanceID, es.KeyList, roStateTrie)
+	byzDb, err := NewServerByzDatabase(instanceID, es.KeyCount, es.KeyIndexSize, roStateTrie)
 	if err != nil {
 		return nil, err
 	}
 
+	// Legacy keys are moved to the key index
+	var legacyKeys [][]byte
+	for _, key := range es.KeyList {
+		legacyKeys = append(legacyKeys, []byte(key))
+	}
+	byzDb.addUnindexedKeys(legacyKeys)
+
 	db := state.NewDatabase(byzDb)
 
 	return state.New(es.RootHash, db)
@@ -79,13 +151,13 @@ func NewContractState(stateDb *state.StateDB) (*State, []byzcoin.StateChange, er
 	}
 
 	// Dump the low-level database contents changes
-	stateChanges, keyList, err := byzDb.Dump()
+	stateChanges, keyCount, keyIndexSize, err := byzDb.Dump()
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Build the new EVM state
-	return &State{RootHash: root, KeyList: keyList}, stateChanges, nil
+	return &State{RootHash: root, KeyCount: keyCount, KeyIndexSize: keyIndexSize}, stateChanges, nil
 }
 
 // Spawn creates a new BEVM contract
@@ -95,24 +167,70 @@ func (c *contractBEvm) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 	// Convention for newly-spawned instances
 	instanceID := inst.DeriveID("")
 
-	stateDb, err := NewEvmDb(&c.State, rst, instanceID)
+	params, err := Params{}.updateFromArgs(inst.Spawn.Args)
+	if err != nil {
+		return nil, nil, err
+	}
+	params = params.withDefaults(instanceID)
+	err = params.validate()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	contractState, _, err := NewContractState(stateDb)
+	stateDb, err := NewEvmDb(&State{}, rst, instanceID)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// The initial state can be imported from a snapshot
+	var snapshot *Snapshot
+	if arg := inst.Spawn.Args.Search("snapshot"); arg != nil {
+		snapshot = &Snapshot{}
+		err = json.Unmarshal(arg, snapshot)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		applyGenesisAlloc(stateDb, snapshot.Accounts)
+	}
+
+	// Accounts can be pre-allocated, as in Ethereum genesis files
+	if arg := inst.Spawn.Args.Search("alloc"); arg != nil {
+		if snapshot != nil {
+			return nil, nil, errors.New("The 'snapshot' and 'alloc' arguments cannot be used together")
+		}
+
+		var alloc core.GenesisAlloc
+		err = json.Unmarshal(arg, &alloc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		applyGenesisAlloc(stateDb, alloc)
+	}
+
+	contractState, stateChanges, err := NewContractState(stateDb)
+	if err != nil {
+		return nil, nil, err
+	}
+	contractState.Params = params
+
+	if snapshot != nil {
+		err = snapshot.checkRoot(contractState.RootHash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	contractData, err := protobuf.Encode(contractState)
 	if err != nil {
 		return nil, nil, err
 	}
-	// State changes to ByzCoin contain a single Create
-	sc = []byzcoin.StateChange{
+	// State changes to ByzCoin contain the Create of the main contract state,
+	// plus the initial content of the EVM state database
+	sc = append([]byzcoin.StateChange{
 		byzcoin.NewStateChange(byzcoin.Create, instanceID, ContractBEvmID, contractData, darc.ID(inst.InstanceID.Slice())),
-	}
+	}, stateChanges...)
 
 	return
 }
@@ -137,6 +255,10 @@ func (c *contractBEvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instru
 		return
 	}
 
+	if c.Deleting {
+		return nil, nil, errors.New("BEVM instance is being deleted")
+	}
+
 	stateDb, err := NewEvmDb(&c.State, rst, inst.InstanceID)
 	if err != nil {
 		return nil, nil, err
@@ -149,15 +271,22 @@ func (c *contractBEvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instru
 			return nil, nil, err
 		}
 
+		// Ether created out of nothing would be indistinguishable from
+		// the one backed by the deposited coins
+		if c.Reserve != 0 {
+			return nil, nil, fmt.Errorf("Cannot credit ether: the instance holds %d deposited coins", c.Reserve)
+		}
+
 		address := common.BytesToAddress(inst.Invoke.Args.Search("address"))
 		amount := new(big.Int).SetBytes(inst.Invoke.Args.Search("amount"))
 
 		stateDb.AddBalance(address, amount)
 
-		contractState, stateChanges, err := NewContractState(stateDb)
+		contractState, stateChanges, err := c.newContractState(stateDb, inst.InstanceID)
 		if err != nil {
 			return nil, nil, err
 		}
+		contractState.Minted = true
 
 		contractData, err := protobuf.Encode(contractState)
 		if err != nil {
@@ -182,20 +311,22 @@ func (c *contractBEvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instru
 			return nil, nil, err
 		}
 
-		txReceipt, err := sendTx(&ethTx, stateDb)
+		bi, err := c.service.getBlockInfo(rst)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		txReceipt, err := c.executeTx(rst, stateDb, bi, &ethTx, inst.InstanceID)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		if txReceipt.ContractAddress.Hex() != nilAddress.Hex() {
-			log.Lvlf2("Contract deployed at '%s'", txReceipt.ContractAddress.Hex())
-		} else {
-			log.Lvlf2("Transaction to '%s'", ethTx.To().Hex())
+		instrs, err := emittedInstructions(txReceipt)
+		if err != nil {
+			return nil, nil, err
 		}
-		log.Lvlf2("\\--> status = %d, gas used = %d, receipt = %s",
-			txReceipt.Status, txReceipt.GasUsed, txReceipt.TxHash.Hex())
 
-		contractState, stateChanges, err := NewContractState(stateDb)
+		contractState, stateChanges, err := c.newContractState(stateDb, inst.InstanceID)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -205,12 +336,241 @@ func (c *contractBEvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instru
 			return nil, nil, err
 		}
 
+		var emittedChanges []byzcoin.StateChange
+		emittedChanges, cout, err = c.executeEmittedInstructions(rst, inst.InstanceID, darcID, instrs, coins)
+		if err != nil {
+			return nil, nil, err
+		}
+
 		// State changes to ByzCoin contain the Update to the main contract state, plus whatever changes
-		// were produced by the EVM on its state database.
+		// were produced by the EVM on its state database, and by the ByzCoin instructions it emitted.
+		sc = append([]byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractBEvmID, contractData, darcID),
+		}, stateChanges...)
+		sc = append(sc, emittedChanges...)
+
+	case "transactions": // Atomically perform an ordered batch of Ethereum transactions
+		var ethTxs []*types.Transaction
+		for _, arg := range inst.Invoke.Args {
+			if arg.Name != "tx" {
+				continue
+			}
+
+			ethTx := &types.Transaction{}
+			err := ethTx.UnmarshalJSON(arg.Value)
+			if err != nil {
+				return nil, nil, err
+			}
+			ethTxs = append(ethTxs, ethTx)
+		}
+		if len(ethTxs) == 0 {
+			return nil, nil, errors.New("Missing 'tx' argument")
+		}
+
+		bi, err := c.service.getBlockInfo(rst)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// All the transactions are executed on the same EVM state database;
+		// any failure aborts the whole batch.
+		var instrs []byzcoin.Instruction
+		for i, ethTx := range ethTxs {
+			txReceipt, err := c.executeTx(rst, stateDb, bi, ethTx, inst.InstanceID)
+			if err != nil {
+				return nil, nil, fmt.Errorf("EVM transaction #%d of the batch: %v", i, err)
+			}
+			if txReceipt.Status != types.ReceiptStatusSuccessful {
+				return nil, nil, fmt.Errorf("EVM transaction #%d of the batch failed", i)
+			}
+
+			txInstrs, err := emittedInstructions(txReceipt)
+			if err != nil {
+				return nil, nil, fmt.Errorf("EVM transaction #%d of the batch: %v", i, err)
+			}
+			instrs = append(instrs, txInstrs...)
+		}
+
+		contractState, stateChanges, err := c.newContractState(stateDb, inst.InstanceID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		contractData, err := protobuf.Encode(contractState)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var emittedChanges []byzcoin.StateChange
+		emittedChanges, cout, err = c.executeEmittedInstructions(rst, inst.InstanceID, darcID, instrs, coins)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// State changes to ByzCoin contain the Update to the main contract state, plus whatever changes
+		// were produced by the EVM on its state database, and by the ByzCoin instructions it emitted.
+		sc = append([]byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractBEvmID, contractData, darcID),
+		}, stateChanges...)
+		sc = append(sc, emittedChanges...)
+
+	case "deposit": // Convert ByzCoin coins into ether on an Ethereum account
+		err := checkArguments(inst, "address")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The deposited coins could otherwise be withdrawn using credited
+		// ether
+		if c.Minted {
+			return nil, nil, errors.New("Cannot deposit coins: ether was credited on the instance")
+		}
+
+		address := common.BytesToAddress(inst.Invoke.Args.Search("address"))
+
+		var amount uint64
+		amount, cout, err = takeCoins(coins)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if c.Reserve+amount < c.Reserve {
+			return nil, nil, errors.New("Coin reserve overflow")
+		}
+
+		stateDb.AddBalance(address, coinsToWei(amount))
+
+		contractState, stateChanges, err := c.newContractState(stateDb, inst.InstanceID)
+		if err != nil {
+			return nil, nil, err
+		}
+		contractState.Reserve += amount
+
+		contractData, err := protobuf.Encode(contractState)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		log.Lvlf2("Deposited %d coins on '%s'", amount, address.Hex())
+
+		sc = append([]byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractBEvmID, contractData, darcID),
+		}, stateChanges...)
+
+	case "withdraw": // Convert ether from an Ethereum account back into ByzCoin coins
+		err := checkArguments(inst, "tx", "coinID")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var ethTx types.Transaction
+		err = ethTx.UnmarshalJSON(inst.Invoke.Args.Search("tx"))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The withdrawal is authorized by an EVM transaction transferring the
+		// ether to the withdrawal address, signed by the account owner
+		amount, err := withdrawnCoins(&ethTx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if amount > c.Reserve {
+			return nil, nil, fmt.Errorf("Cannot withdraw %d coins: only %d coins are in reserve", amount, c.Reserve)
+		}
+
+		bi, err := c.service.getBlockInfo(rst)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		txReceipt, err := c.executeTx(rst, stateDb, bi, &ethTx, inst.InstanceID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if txReceipt.Status != types.ReceiptStatusSuccessful {
+			return nil, nil, errors.New("Withdrawal EVM transaction failed")
+		}
+
+		// The withdrawn ether is destroyed
+		stateDb.SubBalance(WithdrawAddress, ethTx.Value())
+
+		coinID := byzcoin.NewInstanceID(inst.Invoke.Args.Search("coinID"))
+		coinStateChange, err := creditCoins(rst, coinID, amount)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		contractState, stateChanges, err := c.newContractState(stateDb, inst.InstanceID)
+		if err != nil {
+			return nil, nil, err
+		}
+		contractState.Reserve -= amount
+
+		contractData, err := protobuf.Encode(contractState)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		log.Lvlf2("Withdrew %d coins to coin instance '%s'", amount, coinID)
+
+		sc = append([]byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractBEvmID, contractData, darcID),
+			coinStateChange,
+		}, stateChanges...)
+
+	case "prune": // Remove the EVM state database entries no longer reachable from its root
+		_, err := pruneEvmDb(stateDb, inst.Invoke.Args.Search("txRecords") != nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		contractState, stateChanges, err := c.newContractState(stateDb, inst.InstanceID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		contractData, err := protobuf.Encode(contractState)
+		if err != nil {
+			return nil, nil, err
+		}
+
 		sc = append([]byzcoin.StateChange{
 			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractBEvmID, contractData, darcID),
 		}, stateChanges...)
 
+	case "config": // Update the parameters of the BEVM instance
+		current := c.GetParams(inst.InstanceID)
+		params, err := current.updateFromArgs(inst.Invoke.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+		params = params.withDefaults(inst.InstanceID)
+		err = params.validate()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Changing the chain ID invalidates the transactions signed for the
+		// current one, and must therefore be explicitly requested
+		if params.ChainID != current.ChainID && inst.Invoke.Args.Search("changeChainID") == nil {
+			return nil, nil, fmt.Errorf("Changing the chain ID from %d to %d requires the 'changeChainID' argument",
+				current.ChainID, params.ChainID)
+		}
+
+		contractState := c.State
+		contractState.Params = params
+
+		contractData, err := protobuf.Encode(&contractState)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The EVM state database is not affected
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractBEvmID, contractData, darcID),
+		}
+
 	default:
 		err = fmt.Errorf("Unknown Invoke command: '%s'", inst.Invoke.Command)
 	}
@@ -218,36 +578,491 @@ func (c *contractBEvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instru
 	return
 }
 
-// Helper function that sends a transaction to the EVM
-func sendTx(tx *types.Transaction, stateDb *state.StateDB) (*types.Receipt, error) {
+// Maximum number of key index chunks whose keys are removed by a single
+// Delete instruction
+var deleteMaxIndexChunks uint64 = 4
+
+// Delete removes a BEVM instance along with its EVM state database. Large
+// databases are removed in bounded chunks: as long as the removal is not
+// complete, the instance is kept (but cannot be used anymore), and further
+// Delete instructions are needed.
+func (c *contractBEvm) Delete(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) (sc []byzcoin.StateChange, cout []byzcoin.Coin, err error) {
+	cout = coins
+	var darcID darc.ID
+	_, _, _, darcID, err = rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return
+	}
+
+	// Deleting the instance would destroy the coins backing the bridged ether
+	if c.Reserve != 0 {
+		return nil, nil, fmt.Errorf("Cannot delete a BEVM instance holding %d coins in reserve", c.Reserve)
+	}
+
+	byzDb, err := NewServerByzDatabase(inst.InstanceID, c.KeyCount, c.KeyIndexSize, rst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var legacyKeys [][]byte
+	for _, key := range c.KeyList {
+		legacyKeys = append(legacyKeys, []byte(key))
+	}
+	byzDb.addUnindexedKeys(legacyKeys)
+
+	done, err := byzDb.deleteIndexedKeys(deleteMaxIndexChunks)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stateChanges, keyCount, keyIndexSize, err := byzDb.Dump()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if done {
+		if keyCount != 0 {
+			log.Warnf("BEVM instance deleted, leaving %d unindexed values", keyCount)
+		}
+
+		sc = append([]byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID, ContractBEvmID, nil, darcID),
+		}, stateChanges...)
+
+		return
+	}
+
+	contractState := c.State
+	contractState.KeyList = nil
+	contractState.KeyCount = keyCount
+	contractState.KeyIndexSize = keyIndexSize
+	contractState.Deleting = true
+
+	contractData, err := protobuf.Encode(&contractState)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Lvlf2("BEVM instance partially deleted, %d values left", keyCount)
+
+	sc = append([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractBEvmID, contractData, darcID),
+	}, stateChanges...)
+
+	return
+}
+
+// Helper function that builds the new contract state from the EVM state
+// database, retaining the instance parameters
+func (c *contractBEvm) newContractState(stateDb *state.StateDB, instanceID byzcoin.InstanceID) (*State, []byzcoin.StateChange, error) {
+	contractState, stateChanges, err := NewContractState(stateDb)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contractState.Params = c.GetParams(instanceID)
+	contractState.Reserve = c.Reserve
+	contractState.Minted = c.Minted
+
+	return contractState, stateChanges, nil
+}
+
+// Helper function that executes an EVM transaction on behalf of a BEVM
+// instance: the gas fees are distributed and the receipt is stored in the EVM
+// state database, so that clients can retrieve it.
+func (c *contractBEvm) executeTx(rst byzcoin.ReadOnlyStateTrie, stateDb *state.StateDB, bi *blockInfo, ethTx *types.Transaction, instanceID byzcoin.InstanceID) (*types.Receipt, error) {
+	params := c.GetParams(instanceID)
+
+	if c.block == nil {
+		c.block = newTxBlock(params.GasLimit)
+	}
+
+	txReceipt, err := applyTx(rst, stateDb, bi, params, c.block, ethTx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if txReceipt.ContractAddress.Hex() != nilAddress.Hex() {
+		log.Lvlf2("Contract deployed at '%s'", txReceipt.ContractAddress.Hex())
+	} else {
+		log.Lvlf2("Transaction to '%s'", ethTx.To().Hex())
+	}
+	log.Lvlf2("\\--> status = %d, gas used = %d, receipt = %s",
+		txReceipt.Status, txReceipt.GasUsed, txReceipt.TxHash.Hex())
+
+	err = storeReceipt(stateDb, bi, txReceipt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.storeTxRecord(stateDb, bi, ethTx, postStateRoot(stateDb, bi, params))
+	if err != nil {
+		return nil, err
+	}
+
+	return txReceipt, nil
+}
+
+// Helper function that applies an EVM transaction to the EVM state database,
+// as the next one of the given EVM block, and distributes its gas fees. This
+// is the part of executeTx() which is replayed by traces, optionally with a
+// tracer.
+func applyTx(rst byzcoin.ReadOnlyStateTrie, stateDb *state.StateDB, bi *blockInfo, params Params, block *txBlock,
+	ethTx *types.Transaction, tracer vm.Tracer) (*types.Receipt, error) {
+	// Give the precompiled contracts access to the ByzCoin state
+	unbind := bindPrecompileContext(rstInstanceReader(rst))
+	txReceipt, err := sendTx(ethTx, stateDb, bi, params, block, tracer)
+	unbind()
+	if err != nil {
+		return nil, err
+	}
+
+	feeRecipients, err := getFeeRecipients(rst, params)
+	if err != nil {
+		return nil, err
+	}
+
+	distributeFees(stateDb, new(big.Int).Mul(new(big.Int).SetUint64(txReceipt.GasUsed), ethTx.GasPrice()), feeRecipients)
+
+	return txReceipt, nil
+}
+
+// Helper function that executes an unsigned EVM message on behalf of a BEVM
+// instance, for another ByzCoin contract: the message is free of gas fees,
+// and its receipt is stored in the EVM state database under a hash computed
+// from its content and the nonce of its sender (see messageHash()). It
+// returns the receipt along with the data returned by the execution.
+func (c *contractBEvm) executeMessage(rst byzcoin.ReadOnlyStateTrie, stateDb *state.StateDB, bi *blockInfo,
+	from common.Address, to *common.Address, value *big.Int, data []byte, instanceID byzcoin.InstanceID) (*types.Receipt, []byte, error) {
+	params := c.GetParams(instanceID)
+
+	if c.block == nil {
+		c.block = newTxBlock(params.GasLimit)
+	}
+
+	if value == nil {
+		value = big.NewInt(0)
+	}
+
+	// The message can use all the gas left in the EVM block
+	nonce := stateDb.GetNonce(from)
+	msg := types.NewMessage(from, to, nonce, value, c.block.gasPool.Gas(), big.NewInt(0), data, false)
+
+	msgHash, err := messageHash(instanceID, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Give the precompiled contracts access to the ByzCoin state
+	unbind := bindPrecompileContext(rstInstanceReader(rst))
+	receipt, ret, err := sendMessage(msg, msgHash, stateDb, bi, params, c.block)
+	unbind()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Lvlf2("Message from '%s' --> status = %d, gas used = %d, receipt = %s",
+		from.Hex(), receipt.Status, receipt.GasUsed, receipt.TxHash.Hex())
+
+	err = storeReceipt(stateDb, bi, receipt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return receipt, ret, nil
+}
+
+// Helper function that computes the hash identifying an unsigned EVM message,
+// used in place of a transaction hash. As the nonce of the sender is
+// incremented by each message, the hash is unique for a BEVM instance.
+func messageHash(instanceID byzcoin.InstanceID, msg types.Message) (common.Hash, error) {
+	var to []byte
+	if msg.To() != nil {
+		to = msg.To().Bytes()
+	}
+
+	encoded, err := rlp.EncodeToBytes([]interface{}{
+		instanceID.Slice(), msg.From(), msg.Nonce(), to, msg.Value(), msg.Data(),
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	return crypto.Keccak256Hash(encoded), nil
+}
+
+// Helper function that stores the record of an executed transaction in the
+// EVM state database, so that it can be replayed. The root of the EVM state
+// following the transaction is recorded, so that replays can be checked.
+func (c *contractBEvm) storeTxRecord(stateDb *state.StateDB, bi *blockInfo, ethTx *types.Transaction,
+	postRoot common.Hash) error {
+	txData, err := ethTx.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	record := txRecord{
+		Tx:   txData,
+		Root: c.RootHash.Bytes(),
+		// The EVM block number follows the index of the latest ByzCoin block
+		BlockIndex: bi.number.Uint64() - 1,
+		PostRoot:   postRoot.Bytes(),
+	}
+	for _, txHash := range c.executedTxs {
+		record.Previous = append(record.Previous, txHash.Bytes())
+	}
+
+	recordData, err := protobuf.Encode(&record)
+	if err != nil {
+		return err
+	}
+
+	db, ok := stateDb.Database().TrieDB().DiskDB().(ethdb.Putter)
+	if !ok {
+		return errors.New("Internal error: EVM State DB is not writable")
+	}
+
+	err = db.Put(getTxRecordKey(ethTx.Hash()), recordData)
+	if err != nil {
+		return err
+	}
+
+	c.executedTxs = append(c.executedTxs, ethTx.Hash())
+
+	return nil
+}
+
+// Helper function that computes the root of the EVM state following a
+// transaction, deleting the empty accounts as the EVM does
+func postStateRoot(stateDb *state.StateDB, bi *blockInfo, params Params) common.Hash {
+	return stateDb.IntermediateRoot(getChainConfig(params).IsEIP158(bi.number))
+}
+
+// Helper function that sends a transaction to the EVM, as the next one of the
+// given EVM block, optionally tracing its execution
+func sendTx(tx *types.Transaction, stateDb *state.StateDB, bi *blockInfo, params Params, block *txBlock,
+	tracer vm.Tracer) (*types.Receipt, error) {
+	// Only accept transactions signed for this EVM (EIP-155), to prevent
+	// replaying transactions from other chains
+	if !tx.Protected() {
+		return nil, errors.New("EVM transaction is not replay-protected (EIP-155)")
+	}
+
+	if tx.GasPrice().Cmp(new(big.Int).SetUint64(params.MinGasPrice)) < 0 {
+		return nil, fmt.Errorf("EVM transaction gas price (%d) is lower than the minimum (%d)",
+			tx.GasPrice(), params.MinGasPrice)
+	}
 
 	// Gets parameters defined in params
-	chainConfig := getChainConfig()
+	chainConfig := getChainConfig(params)
 	vmConfig := getVMConfig()
-
-	// GasPool tracks the amount of gas available during execution of the transactions in a block
-	gp := new(core.GasPool).AddGas(uint64(1e18))
-	usedGas := uint64(0)
-	ug := &usedGas
+	if tracer != nil {
+		vmConfig.Debug = true
+		vmConfig.Tracer = tracer
+	}
 
 	// ChainContext supports retrieving headers and consensus parameters from the
 	// current blockchain to be used during transaction processing.
-	var bc core.ChainContext
+	bc := byzChainContext{bi: bi}
 
 	// Header represents a block header in the Ethereum blockchain.
-	var header *types.Header
-	header = &types.Header{
-		Number:     big.NewInt(0),
-		Difficulty: big.NewInt(0),
-		ParentHash: common.Hash{0},
-		Time:       0,
+	header := bi.header()
+	header.GasLimit = params.GasLimit
+
+	// Associate the logs produced by the transaction with its hash and its
+	// position in the block
+	stateDb.Prepare(tx.Hash(), common.Hash{}, block.txCount)
+
+	// Apply transaction to the general EVM state; the gas pool tracks the
+	// amount of gas available to the transactions of the block
+	receipt, _, err := core.ApplyTransaction(chainConfig, bc, &nilAddress, block.gasPool, stateDb, header, tx, &block.usedGas, vmConfig)
+	if err != nil {
+		return nil, err
 	}
+	block.txCount++
 
-	// Apply transaction to the general EVM state
-	receipt, usedGas, err := core.ApplyTransaction(chainConfig, bc, &nilAddress, gp, stateDb, header, tx, ug, vmConfig)
+	// A missing block hash would make the outcome differ from the one of
+	// the other nodes
+	err = bi.checkHashLookups()
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkTxOutcome(stateDb, params, receipt, tx.To() == nil)
 	if err != nil {
 		return nil, err
 	}
 
 	return receipt, nil
 }
+
+// Helper function that sends an unsigned EVM message to the EVM, as the next
+// transaction of the given EVM block, in the same way as sendTx()
+func sendMessage(msg types.Message, msgHash common.Hash, stateDb *state.StateDB, bi *blockInfo, params Params,
+	block *txBlock) (*types.Receipt, []byte, error) {
+	header := bi.header()
+	header.GasLimit = params.GasLimit
+
+	stateDb.Prepare(msgHash, common.Hash{}, block.txCount)
+
+	ctx := core.NewEVMContext(msg, header, byzChainContext{bi: bi}, &nilAddress)
+	evm := vm.NewEVM(ctx, stateDb, getChainConfig(params), getVMConfig())
+
+	ret, gasUsed, failed, err := core.ApplyMessage(evm, msg, block.gasPool)
+	if err != nil {
+		return nil, nil, err
+	}
+	block.txCount++
+	block.usedGas += gasUsed
+
+	err = bi.checkHashLookups()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stateDb.Finalise(true)
+
+	receipt := types.NewReceipt(nil, failed, block.usedGas)
+	receipt.TxHash = msgHash
+	receipt.GasUsed = gasUsed
+	if msg.To() == nil {
+		receipt.ContractAddress = crypto.CreateAddress(msg.From(), msg.Nonce())
+	}
+	receipt.Logs = stateDb.GetLogs(msgHash)
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+
+	err = checkTxOutcome(stateDb, params, receipt, msg.To() == nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return receipt, ret, nil
+}
+
+// Helper function that checks the outcome of an executed EVM transaction
+// against the constraints of the instance which the EVM does not enforce.
+// The transaction is rejected as a whole if they are not met.
+func checkTxOutcome(stateDb *state.StateDB, params Params, receipt *types.Receipt, deployment bool) error {
+	// The EVM only enforces the EIP-170 limit; stricter limits are checked on
+	// the deployed contract.
+	if deployment {
+		codeSize := stateDb.GetCodeSize(receipt.ContractAddress)
+		if uint64(codeSize) > params.MaxCodeSize {
+			return fmt.Errorf("Deployed contract code size (%d) exceeds the maximum (%d)",
+				codeSize, params.MaxCodeSize)
+		}
+	}
+
+	return nil
+}
+
+// Helper function that determines the recipients of the gas fees, according
+// to the fee policy of the instance
+func getFeeRecipients(rst byzcoin.ReadOnlyStateTrie, params Params) ([]common.Address, error) {
+	switch params.FeePolicy {
+	case FeePolicyBurn:
+		return nil, nil
+
+	case FeePolicyTreasury:
+		return []common.Address{params.FeeTreasury}, nil
+
+	case FeePolicyRoster:
+		config, err := byzcoin.LoadConfigFromTrie(rst)
+		if err != nil {
+			return nil, err
+		}
+
+		// Conodes without fee address do not receive any share
+		var recipients []common.Address
+		for _, si := range config.Roster.List {
+			address, ok := params.feeAddress(si.Public.String())
+			if !ok {
+				log.Lvlf2("Conode %s has no fee address", si)
+				continue
+			}
+			recipients = append(recipients, address)
+		}
+		if len(recipients) == 0 {
+			log.Warn("No conode of the roster has a fee address, burning the gas fees")
+		}
+
+		return recipients, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown fee policy: '%s'", params.FeePolicy)
+	}
+}
+
+// Helper function that distributes the gas fees of a transaction.
+// The EVM credits the gas fees to the coinbase, which we set to the nil
+// address; they are moved from there to the recipients, split evenly (the
+// first recipient receiving the remainder), or simply destroyed if there are
+// no recipients.
+func distributeFees(stateDb *state.StateDB, fee *big.Int, recipients []common.Address) {
+	stateDb.SubBalance(nilAddress, fee)
+
+	if len(recipients) == 0 {
+		log.Lvlf2("Burnt %d wei of gas fees", fee)
+		return
+	}
+
+	share, remainder := new(big.Int).DivMod(fee, big.NewInt(int64(len(recipients))), new(big.Int))
+	for i, recipient := range recipients {
+		amount := new(big.Int).Set(share)
+		if i == 0 {
+			amount.Add(amount, remainder)
+		}
+		stateDb.AddBalance(recipient, amount)
+
+		log.Lvlf2("Credited %d wei of gas fees to '%s'", amount, recipient.Hex())
+	}
+}
+
+// Compute the key of a transaction receipt in the EVM state database
+func getReceiptKey(txHash common.Hash) []byte {
+	return append(common.CopyBytes(receiptKeyPrefix), txHash.Bytes()...)
+}
+
+// Compute the key of a transaction record in the EVM state database
+func getTxRecordKey(txHash common.Hash) []byte {
+	return append(common.CopyBytes(txRecordKeyPrefix), txHash.Bytes()...)
+}
+
+// Helper function that stores a transaction receipt in the EVM state
+// database, and indexes it under the current EVM block
+func storeReceipt(stateDb *state.StateDB, bi *blockInfo, receipt *types.Receipt) error {
+	receiptData, err := encodeReceipt(receipt)
+	if err != nil {
+		return err
+	}
+
+	db, ok := stateDb.Database().TrieDB().DiskDB().(ethdb.Putter)
+	if !ok {
+		return errors.New("Internal error: EVM State DB is not writable")
+	}
+
+	err = db.Put(getReceiptKey(receipt.TxHash), receiptData)
+	if err != nil {
+		return err
+	}
+
+	return indexReceipt(stateDb, bi.number.Uint64(), receipt.TxHash)
+}
+
+// Helper function that encodes a transaction receipt. The storage encoding of
+// receipts retains the logs and the created contract address.
+func encodeReceipt(receipt *types.Receipt) ([]byte, error) {
+	return rlp.EncodeToBytes((*types.ReceiptForStorage)(receipt))
+}
+
+// Helper function that decodes a transaction receipt retrieved from the EVM state database
+func decodeReceipt(receiptData []byte) (*types.Receipt, error) {
+	var receipt types.ReceiptForStorage
+
+	err := rlp.DecodeBytes(receiptData, &receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	return (*types.Receipt)(&receipt), nil
+}
@@ -1,20 +1,32 @@
 package bevm
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
 	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"go.dedis.ch/cothority/v3"
 	"go.dedis.ch/onet/v3/log"
 
 	"github.com/stretchr/testify/require"
 	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/contracts"
 	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/cothority/v3/darc/expression"
 	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/protobuf"
 )
 
 var txParams = struct {
@@ -39,8 +51,15 @@ func Test_Spawn(t *testing.T) {
 	defer bct.Close()
 
 	// Spawn a new BEVM instance
-	_, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// The instance gets its own chain ID
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
 	require.Nil(t, err)
+	chainID, err := bevmClient.ChainID()
+	require.Nil(t, err)
+	require.Equal(t, defaultChainID(instanceID), chainID.Uint64())
 }
 
 // Credit and display three accounts balances
@@ -110,7 +129,7 @@ func Test_InvokeCandyContract(t *testing.T) {
 	candySupply := big.NewInt(100)
 	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
 	require.Nil(t, err)
-	err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, candySupply)
+	_, err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, candySupply)
 	require.Nil(t, err)
 
 	// Get initial candy balance
@@ -120,7 +139,7 @@ func Test_InvokeCandyContract(t *testing.T) {
 	require.Equal(t, candySupply, candyBalance)
 
 	// Eat 10 candies
-	err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
 	require.Nil(t, err)
 
 	// Get remaining candies
@@ -161,8 +180,10 @@ func Test_InvokeTokenContract(t *testing.T) {
 	// Deploy an ERC20 Token contract
 	erc20Contract, err := NewEvmContract(getContractPath(t, "ERC20Token"))
 	require.Nil(t, err)
-	err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract)
+	receipt, err := bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract)
 	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.Equal(t, erc20Contract.Address, receipt.ContractAddress)
 
 	// Retrieve the total supply
 	supply := big.NewInt(0)
@@ -182,8 +203,12 @@ func Test_InvokeTokenContract(t *testing.T) {
 	assertBigInt0(t, balance)
 
 	// Transfer 100 tokens from A to B
-	err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", b.Address, big.NewInt(100))
+	receipt, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", b.Address, big.NewInt(100))
 	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	// The transfer emits a 'Transfer' event
+	require.Equal(t, 1, len(receipt.Logs))
+	require.Equal(t, erc20Contract.Address, receipt.Logs[0].Address)
 
 	// Check the new balances
 	newA := new(big.Int).Sub(supply, big.NewInt(100))
@@ -198,8 +223,16 @@ func Test_InvokeTokenContract(t *testing.T) {
 	require.Equal(t, newB, balance)
 
 	// Try to transfer 101 tokens from B to A; this should be rejected by the EVM
-	err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, b, erc20Contract, "transfer", a.Address, big.NewInt(101))
+	receipt, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, b, erc20Contract, "transfer", a.Address, big.NewInt(101))
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+	require.Equal(t, 0, len(receipt.Logs))
+
+	// The receipt can also be retrieved afterwards
+	receipt2, err := bevmClient.GetTxReceipt(receipt.TxHash)
 	require.Nil(t, err)
+	require.Equal(t, receipt.Status, receipt2.Status)
+	require.Equal(t, receipt.GasUsed, receipt2.GasUsed)
 
 	// Check that the balances have not changed
 	err = bevmClient.Call(a, &balance, erc20Contract, "balanceOf", a.Address)
@@ -211,6 +244,85 @@ func Test_InvokeTokenContract(t *testing.T) {
 	require.Equal(t, newB, balance)
 }
 
+func Test_TransactionBatch(t *testing.T) {
+	log.LLvl1("Transaction batch")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	// Initialize two accounts
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	b, err := NewEvmAccount(testPrivateKeys[1])
+	require.Nil(t, err)
+
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), b.Address)
+	require.Nil(t, err)
+
+	erc20Contract, err := NewEvmContract(getContractPath(t, "ERC20Token"))
+	require.Nil(t, err)
+
+	// Deploy an ERC20 Token contract and transfer tokens in a single batch
+	batch := NewBatch()
+	require.Nil(t, batch.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract))
+	require.Nil(t, batch.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", b.Address, big.NewInt(100)))
+	require.Nil(t, batch.Transaction(txParams.GasLimit, txParams.GasPrice, 0, b, erc20Contract, "transfer", a.Address, big.NewInt(40)))
+
+	receipts, err := bevmClient.TransactionBatch(batch)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(receipts))
+	for _, receipt := range receipts {
+		require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	}
+	require.Equal(t, erc20Contract.Address, receipts[0].ContractAddress)
+	require.Equal(t, uint64(2), a.Nonce)
+	require.Equal(t, uint64(1), b.Nonce)
+
+	balance := big.NewInt(0)
+	err = bevmClient.Call(a, &balance, erc20Contract, "balanceOf", b.Address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(60), balance)
+
+	// The replay of a transaction of the batch follows the earlier ones, in
+	// the same EVM block
+	result, err := bevmClient.TraceTransaction(receipts[2].TxHash)
+	require.Nil(t, err)
+	require.False(t, result.Diverged)
+	require.Equal(t, receipts[2].GasUsed, result.Receipt.GasUsed)
+	require.Equal(t, receipts[2].CumulativeGasUsed, result.Receipt.CumulativeGasUsed)
+	require.Equal(t, len(receipts[2].Logs), len(result.Receipt.Logs))
+
+	// A batch containing a failing transaction is not applied at all
+	batch = NewBatch()
+	require.Nil(t, batch.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", b.Address, big.NewInt(100)))
+	require.Nil(t, batch.Transaction(txParams.GasLimit, txParams.GasPrice, 0, b, erc20Contract, "transfer", a.Address, big.NewInt(1000)))
+
+	_, err = bevmClient.TransactionBatch(batch)
+	require.NotNil(t, err)
+	require.Equal(t, uint64(2), a.Nonce)
+	require.Equal(t, uint64(1), b.Nonce)
+
+	err = bevmClient.Call(a, &balance, erc20Contract, "balanceOf", b.Address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(60), balance)
+
+	// The nonces are still in sync
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", b.Address, big.NewInt(1))
+	require.Nil(t, err)
+}
+
 func Test_InvokeLoanContract(t *testing.T) {
 	log.LLvl1("LoanContract")
 	//Preparing ledger
@@ -241,7 +353,7 @@ func Test_InvokeLoanContract(t *testing.T) {
 	// Deploy an ERC20 Token contract
 	erc20Contract, err := NewEvmContract(getContractPath(t, "ERC20Token"))
 	require.Nil(t, err)
-	err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract)
+	_, err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract)
 	require.Nil(t, err)
 
 	// Deploy a Loan contract
@@ -250,7 +362,7 @@ func Test_InvokeLoanContract(t *testing.T) {
 
 	loanContract, err := NewEvmContract(getContractPath(t, "LoanContract"))
 	require.Nil(t, err)
-	err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, loanContract,
+	_, err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, loanContract,
 		loanAmount,            // wantedAmount: the amount in Ether that the borrower wants to borrow
 		big.NewInt(0),         // interest: the amount in Ether that the borrower will pay pack in addition to the borrowed amount
 		guarantee,             // tokenAmount: the number of tokens provided by the borrower as guarantee
@@ -277,7 +389,7 @@ func Test_InvokeLoanContract(t *testing.T) {
 	assertBigInt0(t, tokBal)
 
 	// Transfer tokens from A as a guarantee (A owns all the tokens as he deployed the Token contract)
-	err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", loanContract.Address, guarantee)
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", loanContract.Address, guarantee)
 	require.Nil(t, err)
 
 	tokBal, _ = getBalances(a, a.Address)
@@ -288,13 +400,13 @@ func Test_InvokeLoanContract(t *testing.T) {
 	require.Equal(t, guarantee, tokBal)
 
 	// Check that there are enough tokens
-	err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, loanContract, "checkTokens")
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, loanContract, "checkTokens")
 	require.Nil(t, err)
 
 	// Lend
 	_, initEtherBalA := getBalances(a, a.Address)
 
-	err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, loanAmount.Uint64(), b, loanContract, "lend")
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, loanAmount.Uint64(), b, loanContract, "lend")
 	require.Nil(t, err)
 
 	_, bal = getBalances(a, a.Address)
@@ -304,7 +416,7 @@ func Test_InvokeLoanContract(t *testing.T) {
 	// Pay back
 	_, initEtherBalB := getBalances(a, b.Address)
 
-	err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, loanAmount.Uint64(), a, loanContract, "payback")
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, loanAmount.Uint64(), a, loanContract, "payback")
 	require.Nil(t, err)
 
 	_, bal = getBalances(a, b.Address)
@@ -312,50 +424,1437 @@ func Test_InvokeLoanContract(t *testing.T) {
 	require.Equal(t, expected, bal)
 }
 
-// bcTest is used here to provide some simple test structure for different
-// tests.
-type bcTest struct {
-	t       *testing.T
-	local   *onet.LocalTest
-	signer  darc.Signer
-	servers []*onet.Server
-	roster  *onet.Roster
-	cl      *byzcoin.Client
-	gMsg    *byzcoin.CreateGenesisBlock
-	gDarc   *darc.Darc
+// Spawn a BEVM with custom parameters and update them
+func Test_Params(t *testing.T) {
+	log.LLvl1("BEVM parameters")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance with custom parameters
+	instanceID, err := NewBEvmWithParams(bct.cl, bct.signer, bct.gDarc, Params{
+		ChainID:     1234,
+		MinGasPrice: 2,
+	})
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	params, err := bevmClient.GetParams()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1234), params.ChainID)
+	require.Equal(t, uint64(2), params.MinGasPrice)
+	require.Equal(t, defaultForks, params.Forks)
+	require.Equal(t, defaultGasLimit, params.GasLimit)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+
+	// The gas price is below the minimum
+	_, err = bevmClient.Deploy(txParams.GasLimit, big.NewInt(1), 0, a, candyContract, big.NewInt(100))
+	require.NotNil(t, err)
+
+	// Lower the minimum gas price; the other parameters are unchanged
+	err = bevmClient.UpdateParams(Params{MinGasPrice: 1})
+	require.Nil(t, err)
+
+	params, err = bevmClient.GetParams()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), params.MinGasPrice)
+	require.Equal(t, uint64(1234), params.ChainID)
+
+	_, err = bevmClient.Deploy(txParams.GasLimit, big.NewInt(1), 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	// Invalid parameters are rejected
+	err = bevmClient.UpdateParams(Params{Forks: []string{"homestead"}})
+	require.NotNil(t, err)
+
+	// The chain ID is only changed on explicit request
+	err = bevmClient.UpdateParams(Params{ChainID: 5678})
+	require.NotNil(t, err)
+	err = bevmClient.UpdateParams(Params{ChainID: 1234, GasLimit: 1e9})
+	require.Nil(t, err)
+
+	err = bevmClient.ChangeChainID(5678)
+	require.Nil(t, err)
+
+	params, err = bevmClient.GetParams()
+	require.Nil(t, err)
+	require.Equal(t, uint64(5678), params.ChainID)
+	require.Equal(t, uint64(1e9), params.GasLimit)
+	require.Equal(t, uint64(1), params.MinGasPrice)
 }
 
-func newBCTest(t *testing.T) (out *bcTest) {
-	out = &bcTest{t: t}
-	// First create a local test environment with three nodes.
-	out.local = onet.NewTCPTest(cothority.Suite)
+// Check the distribution of gas fees
+func Test_Fees(t *testing.T) {
+	log.LLvl1("Gas fees")
 
-	out.signer = darc.NewSignerEd25519(nil, nil)
-	out.servers, out.roster, _ = out.local.GenTree(3, true)
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
 
-	// Then create a new ledger with the genesis darc having the right
-	// to create and update keyValue contracts.
-	var err error
-	out.gMsg, err = byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, out.roster,
-		[]string{"spawn:bevm", "invoke:bevm.credit", "invoke:bevm.transaction"}, out.signer.Identity())
+	treasury := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	// Spawn a new BEVM instance sending the gas fees to a treasury
+	instanceID, err := NewBEvmWithParams(bct.cl, bct.signer, bct.gDarc, Params{
+		FeePolicy:   FeePolicyTreasury,
+		FeeTreasury: treasury,
+	})
 	require.Nil(t, err)
-	out.gDarc = &out.gMsg.GenesisDarc
 
-	// This BlockInterval is good for testing, but in real world applications this
-	// should be more like 5 seconds.
-	out.gMsg.BlockInterval = time.Second
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
 
-	out.cl, _, err = byzcoin.NewLedger(out.gMsg, false)
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
 	require.Nil(t, err)
 
-	return out
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+
+	receipt, err := bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	treasuryFee := new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), txParams.GasPrice)
+	balance, err := bevmClient.GetAccountBalance(treasury)
+	require.Nil(t, err)
+	require.Equal(t, treasuryFee, balance)
+
+	// The roster fee policy requires the fee addresses of the conodes
+	err = bevmClient.UpdateParams(Params{FeePolicy: FeePolicyRoster})
+	require.NotNil(t, err)
+
+	// Switch to splitting the gas fees among the roster, each conode
+	// operator providing an account it controls
+	var operators []*EvmAccount
+	var feeAddresses []FeeAddress
+	for _, si := range bct.roster.List {
+		operator, err := GenerateEvmAccount()
+		require.Nil(t, err)
+		operators = append(operators, operator)
+		feeAddresses = append(feeAddresses, FeeAddress{Conode: si.Public.String(), Address: operator.Address})
+	}
+
+	err = bevmClient.UpdateParams(Params{FeePolicy: FeePolicyRoster, FeeAddresses: feeAddresses})
+	require.Nil(t, err)
+
+	receipt, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), txParams.GasPrice)
+	total := big.NewInt(0)
+	for _, operator := range operators {
+		balance, err := bevmClient.GetAccountBalance(operator.Address)
+		require.Nil(t, err)
+		require.Equal(t, 1, balance.Sign())
+		total.Add(total, balance)
+	}
+	require.Equal(t, fee, total)
+
+	// The fees can be spent by the conode operator (the transfer itself is
+	// free, as the instance has no minimum gas price)
+	share, err := bevmClient.GetAccountBalance(operators[0].Address)
+	require.Nil(t, err)
+
+	chainID, err := bevmClient.ChainID()
+	require.Nil(t, err)
+	recipient := common.HexToAddress("0xfee")
+	transferTx, err := operators[0].signTx(types.NewTransaction(0, recipient, share, 21000, big.NewInt(0), nil), chainID)
+	require.Nil(t, err)
+	receipt, err = bevmClient.SendSignedTx(transferTx)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+
+	balance, err = bevmClient.GetAccountBalance(recipient)
+	require.Nil(t, err)
+	require.Equal(t, share, balance)
+
+	// The treasury does not receive anything anymore
+	balance, err = bevmClient.GetAccountBalance(treasury)
+	require.Nil(t, err)
+	require.Equal(t, treasuryFee, balance)
 }
 
-func (bct *bcTest) Close() {
-	bct.local.CloseAll()
+// Check the conversion between ByzCoin coins and ether
+func Test_Bridge(t *testing.T) {
+	log.LLvl1("Coin bridge")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	// Create a coin instance holding 10 coins
+	coinID := bct.spawnCoins(10)
+	require.Equal(t, uint64(10), bct.getCoins(coinID))
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+
+	// Deposit 4 coins
+	err = bevmClient.Deposit(coinID, 4, a.Address)
+	require.Nil(t, err)
+	require.Equal(t, uint64(6), bct.getCoins(coinID))
+
+	balance, err := bevmClient.GetAccountBalance(a.Address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(4*WeiPerEther), balance)
+
+	// Credited ether would not be backed by coins
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.NotNil(t, err)
+
+	// Withdrawals cannot exceed the reserve
+	_, err = bevmClient.Withdraw(txParams.GasLimit, txParams.GasPrice, a, 5, coinID)
+	require.NotNil(t, err)
+
+	// Withdraw 3 coins
+	receipt, err := bevmClient.Withdraw(txParams.GasLimit, txParams.GasPrice, a, 3, coinID)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.Equal(t, uint64(9), bct.getCoins(coinID))
+
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), txParams.GasPrice)
+	expectedBalance := new(big.Int).Sub(big.NewInt(1*WeiPerEther), fee)
+	balance, err = bevmClient.GetAccountBalance(a.Address)
+	require.Nil(t, err)
+	require.Equal(t, expectedBalance, balance)
+
+	balance, err = bevmClient.GetAccountBalance(WithdrawAddress)
+	require.Nil(t, err)
+	assertBigInt0(t, balance)
+
+	// Coins cannot be deposited on an instance whose ether was credited
+	otherID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+	otherClient, err := NewClient(bct.cl, bct.signer, otherID)
+	require.Nil(t, err)
+
+	err = otherClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	err = otherClient.Deposit(coinID, 4, a.Address)
+	require.NotNil(t, err)
+	require.Equal(t, uint64(9), bct.getCoins(coinID))
 }
 
-// Helper functions
+// Check the pruning of the EVM state database
+func Test_Prune(t *testing.T) {
+	log.LLvl1("State pruning")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+	_, err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	// Each transaction supersedes some trie nodes
+	for i := 0; i < 5; i++ {
+		_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(1))
+		require.Nil(t, err)
+	}
+
+	bs, _, err := getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	keyCountBefore := bs.KeyCount
+	require.True(t, bs.KeyIndexSize >= keyCountBefore)
+
+	err = bevmClient.Prune()
+	require.Nil(t, err)
+
+	bs, _, err = getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	require.True(t, bs.KeyCount < keyCountBefore)
+	// The key index is compacted
+	require.Equal(t, bs.KeyCount, bs.KeyIndexSize)
+
+	// The state is still complete
+	remainingCandies := big.NewInt(0)
+	err = bevmClient.Call(a, &remainingCandies, candyContract, "getRemainingCandies")
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(95), remainingCandies)
+
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(1))
+	require.Nil(t, err)
+
+	err = bevmClient.Call(a, &remainingCandies, candyContract, "getRemainingCandies")
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(94), remainingCandies)
+
+	// Pruning right after pruning has no effect
+	err = bevmClient.Prune()
+	require.Nil(t, err)
+
+	bs, _, err = getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	keyCountBefore = bs.KeyCount
+
+	err = bevmClient.Prune()
+	require.Nil(t, err)
+
+	bs, _, err = getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	require.Equal(t, keyCountBefore, bs.KeyCount)
+	require.Equal(t, bs.KeyCount, bs.KeyIndexSize)
+}
+
+// Check the removal of BEVM instances
+func Test_Delete(t *testing.T) {
+	log.LLvl1("Instance deletion")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Remove at most one chunk of keys per instruction
+	defer func(n uint64) { deleteMaxIndexChunks = n }(deleteMaxIndexChunks)
+	deleteMaxIndexChunks = 1
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	erc20Contract, err := NewEvmContract(getContractPath(t, "ERC20Token"))
+	require.Nil(t, err)
+	receipt, err := bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract)
+	require.Nil(t, err)
+
+	// Spread the tokens over many accounts, so that the state spans several
+	// key index chunks
+	batch := NewBatch()
+	for i := 0; i < 100; i++ {
+		address := common.BigToAddress(big.NewInt(int64(i + 1)))
+		require.Nil(t, batch.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", address, big.NewInt(1)))
+	}
+	_, err = bevmClient.TransactionBatch(batch)
+	require.Nil(t, err)
+
+	bs, _, err := getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	require.True(t, keyIndexChunks(bs.KeyIndexSize) > 1)
+
+	err = bevmClient.Delete()
+	require.Nil(t, err)
+
+	// The instance and its values are gone
+	_, _, err = getBEvmState(bct.cl, instanceID)
+	require.NotNil(t, err)
+
+	_, err = GetBEvmValue(bct.cl, instanceID, getReceiptKey(receipt.TxHash))
+	require.NotNil(t, err)
+}
+
+// Check the pre-allocation of accounts when spawning an instance
+func Test_GenesisAlloc(t *testing.T) {
+	log.LLvl1("Genesis allocation")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	b, err := NewEvmAccount(testPrivateKeys[1])
+	require.Nil(t, err)
+
+	// Runtime code returning the value of storage slot 0, whatever the method
+	contractAddress := common.HexToAddress("0x1000")
+	contractAbi, err := abi.JSON(strings.NewReader(
+		`[{"constant":true,"inputs":[],"name":"get","outputs":[{"name":"","type":"uint256"}],"type":"function"}]`))
+	require.Nil(t, err)
+	contract := &EvmContract{Abi: contractAbi, Address: contractAddress, name: "Get"}
+
+	allocJSON := `{
+		"` + a.Address.Hex() + `": {"balance": "5000000000000000000", "nonce": "0x3"},
+		"` + b.Address.Hex() + `": {"balance": "0x1000"},
+		"` + contractAddress.Hex() + `": {
+			"balance": "0",
+			"code": "0x60005460005260206000f3",
+			"storage": {"0x0000000000000000000000000000000000000000000000000000000000000000": "0x000000000000000000000000000000000000000000000000000000000000002a"}
+		}
+	}`
+
+	var alloc core.GenesisAlloc
+	require.Nil(t, json.Unmarshal([]byte(allocJSON), &alloc))
+
+	// Spawn a new BEVM instance with pre-allocated accounts
+	instanceID, err := NewBEvmWithAlloc(bct.cl, bct.signer, bct.gDarc, Params{}, alloc)
+	require.Nil(t, err)
+
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	balance, err := bevmClient.GetAccountBalance(a.Address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(5*WeiPerEther), balance)
+
+	balance, err = bevmClient.GetAccountBalance(b.Address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(0x1000), balance)
+
+	value := big.NewInt(0)
+	err = bevmClient.Call(a, &value, contract, "get")
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(42), value)
+
+	// Pre-allocated accounts can transact right away, using their nonce
+	a.Nonce = 3
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+	receipt, err := bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.Equal(t, crypto.CreateAddress(a.Address, 3), receipt.ContractAddress)
+}
+
+// Check the export and import of state snapshots
+func Test_Snapshot(t *testing.T) {
+	log.LLvl1("State snapshot")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	b, err := NewEvmAccount(testPrivateKeys[1])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	erc20Contract, err := NewEvmContract(getContractPath(t, "ERC20Token"))
+	require.Nil(t, err)
+	_, err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract)
+	require.Nil(t, err)
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", b.Address, big.NewInt(100))
+	require.Nil(t, err)
+
+	// Export the state to a file
+	snapshot, err := bevmClient.ExportState()
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), snapshot.Accounts[a.Address].Nonce)
+	require.NotEmpty(t, snapshot.Accounts[erc20Contract.Address].Code)
+	require.NotEmpty(t, snapshot.Accounts[erc20Contract.Address].Storage)
+
+	bs, _, err := getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	require.Equal(t, bs.RootHash, snapshot.Root)
+
+	tmpDir, err := ioutil.TempDir("", "bevm")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	snapshotPath := filepath.Join(tmpDir, "snapshot.json")
+	require.Nil(t, snapshot.Save(snapshotPath))
+	snapshot, err = LoadSnapshot(snapshotPath)
+	require.Nil(t, err)
+
+	// Import the state into a new instance
+	instanceID2, err := NewBEvmFromSnapshot(bct.cl, bct.signer, bct.gDarc, Params{}, snapshot)
+	require.Nil(t, err)
+
+	bevmClient2, err := NewClient(bct.cl, bct.signer, instanceID2)
+	require.Nil(t, err)
+
+	bs2, _, err := getBEvmState(bct.cl, instanceID2)
+	require.Nil(t, err)
+	require.Equal(t, bs.RootHash, bs2.RootHash)
+
+	balance, err := bevmClient2.GetAccountBalance(a.Address)
+	require.Nil(t, err)
+	expectedBalance, err := bevmClient.GetAccountBalance(a.Address)
+	require.Nil(t, err)
+	require.Equal(t, expectedBalance, balance)
+
+	tokens := big.NewInt(0)
+	err = bevmClient2.Call(a, &tokens, erc20Contract, "balanceOf", b.Address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(100), tokens)
+
+	// The imported instance can be used right away
+	_, err = bevmClient2.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, erc20Contract, "transfer", b.Address, big.NewInt(50))
+	require.Nil(t, err)
+
+	err = bevmClient2.Call(a, &tokens, erc20Contract, "balanceOf", b.Address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(150), tokens)
+
+	// A tampered snapshot is rejected
+	account := snapshot.Accounts[b.Address]
+	account.Balance = big.NewInt(WeiPerEther)
+	snapshot.Accounts[b.Address] = account
+
+	_, err = NewBEvmFromSnapshot(bct.cl, bct.signer, bct.gDarc, Params{}, snapshot)
+	require.NotNil(t, err)
+}
+
+// Check the migration of legacy states keeping the list of keys
+func Test_StateMigration(t *testing.T) {
+	log.LLvl1("State migration")
+
+	legacyState := struct {
+		RootHash common.Hash
+		KeyList  []string
+	}{
+		RootHash: common.HexToHash("0x1234"),
+		KeyList:  []string{"key1", "key2", "key3"},
+	}
+
+	legacyData, err := protobuf.Encode(&legacyState)
+	require.Nil(t, err)
+
+	contract, err := contractBEvmFromBytes(legacyData)
+	require.Nil(t, err)
+
+	// The keys are kept until they are moved to the key index
+	bs := contract.(*contractBEvm).State
+	require.Equal(t, legacyState.RootHash, bs.RootHash)
+	require.Equal(t, legacyState.KeyList, bs.KeyList)
+	require.Equal(t, uint64(3), bs.KeyCount)
+	require.Equal(t, uint64(0), bs.KeyIndexSize)
+}
+
+// Check that only EVM transactions signed for the right chain are accepted
+func Test_ChainID(t *testing.T) {
+	log.LLvl1("Chain ID")
+
+	stateDb, err := newEvmMemDb()
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	b, err := NewEvmAccount(testPrivateKeys[1])
+	require.Nil(t, err)
+
+	stateDb.AddBalance(a.Address, big.NewInt(5*WeiPerEther))
+
+	bi := &blockInfo{
+		number:  big.NewInt(1),
+		getHash: func(uint64) common.Hash { return common.Hash{} },
+	}
+	chainID := big.NewInt(42)
+	params := Params{ChainID: chainID.Uint64()}.withDefaults(byzcoin.NewInstanceID(nil))
+	tx := types.NewTransaction(0, b.Address, big.NewInt(WeiPerEther), txParams.GasLimit, txParams.GasPrice, nil)
+
+	// Transactions without replay protection are rejected
+	unprotectedTx, err := types.SignTx(tx, types.HomesteadSigner{}, a.PrivateKey)
+	require.Nil(t, err)
+	_, err = sendTx(unprotectedTx, stateDb, bi, params, newTxBlock(params.GasLimit), nil)
+	require.NotNil(t, err)
+
+	// Transactions signed for another chain are rejected
+	otherChainTx, err := a.signTx(tx, big.NewInt(1))
+	require.Nil(t, err)
+	_, err = sendTx(otherChainTx, stateDb, bi, params, newTxBlock(params.GasLimit), nil)
+	require.NotNil(t, err)
+
+	// Transactions signed for this chain are accepted
+	signedTx, err := a.signTx(tx, chainID)
+	require.Nil(t, err)
+	receipt, err := sendTx(signedTx, stateDb, bi, params, newTxBlock(params.GasLimit), nil)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.Equal(t, big.NewInt(WeiPerEther), stateDb.GetBalance(b.Address))
+}
+
+// Check that the transactions of an instruction share the block gas limit
+func Test_TxBlock(t *testing.T) {
+	log.LLvl1("Transaction block")
+
+	stateDb, err := newEvmMemDb()
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	b, err := NewEvmAccount(testPrivateKeys[1])
+	require.Nil(t, err)
+
+	stateDb.AddBalance(a.Address, big.NewInt(5*WeiPerEther))
+
+	bi := &blockInfo{
+		number:  big.NewInt(1),
+		getHash: func(uint64) common.Hash { return common.Hash{} },
+	}
+	chainID := big.NewInt(42)
+	params := Params{ChainID: chainID.Uint64(), GasLimit: 50000}.withDefaults(byzcoin.NewInstanceID(nil))
+
+	// Plain transfers use 21000 gas each
+	block := newTxBlock(params.GasLimit)
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		tx := types.NewTransaction(nonce, b.Address, big.NewInt(WeiPerEther), 21000, txParams.GasPrice, nil)
+		signedTx, err := a.signTx(tx, chainID)
+		require.Nil(t, err)
+
+		receipt, err := sendTx(signedTx, stateDb, bi, params, block, nil)
+		if nonce == 2 {
+			// The block gas limit is reached
+			require.NotNil(t, err)
+			break
+		}
+		require.Nil(t, err)
+		require.Equal(t, (nonce+1)*21000, receipt.CumulativeGasUsed)
+	}
+
+	require.Equal(t, 2, block.txCount)
+	require.Equal(t, uint64(42000), block.usedGas)
+	require.Equal(t, big.NewInt(2*WeiPerEther), stateDb.GetBalance(b.Address))
+}
+
+// Check the estimation of the gas needed by transactions
+func Test_EstimateGas(t *testing.T) {
+	log.LLvl1("Gas estimation")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+
+	// Deployment with the estimated gas
+	gasLimit, err := bevmClient.EstimateGas(txParams.GasPrice, 0, a, candyContract, "", big.NewInt(100))
+	require.Nil(t, err)
+
+	receipt, err := bevmClient.Deploy(gasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.True(t, receipt.GasUsed <= gasLimit)
+
+	// Transaction with the estimated gas
+	gasLimit, err = bevmClient.EstimateGas(txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+
+	receipt, err = bevmClient.Transaction(gasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+
+	// One gas less is not enough (the gas needed depends on the state)
+	gasLimit, err = bevmClient.EstimateGas(txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+
+	receipt, err = bevmClient.Transaction(gasLimit-1, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+
+	// A transaction always failing cannot be estimated
+	_, err = bevmClient.EstimateGas(txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(1000))
+	require.NotNil(t, err)
+
+	// The estimation is capped by the balance of the sender
+	b, err := NewEvmAccount(testPrivateKeys[1])
+	require.Nil(t, err)
+
+	_, err = bevmClient.EstimateGas(txParams.GasPrice, 0, b, candyContract, "eatCandy", big.NewInt(10))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Insufficient funds")
+
+	// ...unless the gas is free
+	freeGasLimit, err := bevmClient.EstimateGas(big.NewInt(0), 0, b, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+
+	// A balance lower than the gas limit of the instance is enough
+	err = bevmClient.CreditAccount(big.NewInt(1e6), b.Address)
+	require.Nil(t, err)
+	gasLimit, err = bevmClient.EstimateGas(txParams.GasPrice, 0, b, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+	require.Equal(t, freeGasLimit, gasLimit)
+}
+
+// Check the simulation of transactions
+func Test_Simulate(t *testing.T) {
+	log.LLvl1("Transaction simulation")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+	_, err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	// Unsigned transaction
+	tx, err := newMethodTx(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+
+	result, err := bevmClient.Simulate(tx, a.Address)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, result.Receipt.Status)
+	require.Empty(t, result.RevertReason)
+
+	// The sender pays the fees, and the contract storage changes
+	changes := make(map[common.Address]AccountChange)
+	for _, change := range result.Changes {
+		changes[common.BytesToAddress(change.Address)] = change
+	}
+
+	senderChange, ok := changes[a.Address]
+	require.True(t, ok)
+	require.Equal(t, senderChange.NonceBefore+1, senderChange.NonceAfter)
+	require.Equal(t, new(big.Int).SetUint64(result.Receipt.GasUsed),
+		new(big.Int).Sub(new(big.Int).SetBytes(senderChange.BalanceBefore), new(big.Int).SetBytes(senderChange.BalanceAfter)))
+
+	contractChange, ok := changes[candyContract.Address]
+	require.True(t, ok)
+	require.Len(t, contractChange.Storage, 2) // remainingCandies, eatenCandies
+	require.Equal(t, big.NewInt(100), new(big.Int).SetBytes(contractChange.Storage[0].Before))
+	require.Equal(t, big.NewInt(90), new(big.Int).SetBytes(contractChange.Storage[0].After))
+
+	// The state is not modified
+	candies := big.NewInt(0)
+	err = bevmClient.Call(a, &candies, candyContract, "getRemainingCandies")
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(100), candies)
+
+	// Signed transaction, failing
+	tx, err = newMethodTx(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(1000))
+	require.Nil(t, err)
+	chainID, err := bevmClient.ChainID()
+	require.Nil(t, err)
+	signedTx, err := a.signTx(tx, chainID)
+	require.Nil(t, err)
+
+	result, err = bevmClient.Simulate(signedTx, common.Address{})
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, result.Receipt.Status)
+	require.Equal(t, "error", result.RevertReason)
+	require.Equal(t, signedTx.Hash(), result.Receipt.TxHash)
+
+	// Signed transaction with a wrong nonce
+	a.Nonce++
+	tx, err = newMethodTx(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+	signedTx, err = a.signTx(tx, chainID)
+	require.Nil(t, err)
+
+	_, err = bevmClient.Simulate(signedTx, common.Address{})
+	require.NotNil(t, err)
+
+	// Deployments are subject to the maximum code size of the instance
+	err = bevmClient.UpdateParams(Params{MaxCodeSize: 10})
+	require.Nil(t, err)
+	tx, err = newDeployTx(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	_, err = bevmClient.Simulate(tx, a.Address)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "code size")
+}
+
+func Test_Trace(t *testing.T) {
+	log.LLvl1("Transaction tracing")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+	deployReceipt, err := bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+	receipt, err := bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+
+	// Replay of the deployment
+	result, err := bevmClient.TraceTransaction(deployReceipt.TxHash)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, result.Receipt.Status)
+	require.Equal(t, deployReceipt.GasUsed, result.Receipt.GasUsed)
+	require.Len(t, result.Calls, 1)
+	require.Equal(t, "CREATE", result.Calls[0].Type)
+	require.Equal(t, candyContract.Address, common.BytesToAddress(result.Calls[0].To))
+
+	// Replay of the method call, on the state preceding it
+	result, err = bevmClient.TraceTransaction(receipt.TxHash)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, result.Receipt.Status)
+	require.Equal(t, receipt.GasUsed, result.Receipt.GasUsed)
+	require.False(t, result.Truncated)
+	require.False(t, result.Diverged)
+	require.Len(t, result.Calls, 1)
+	require.Equal(t, "CALL", result.Calls[0].Type)
+	require.Equal(t, a.Address, common.BytesToAddress(result.Calls[0].From))
+	require.Equal(t, candyContract.Address, common.BytesToAddress(result.Calls[0].To))
+	require.Empty(t, result.Calls[0].Error)
+
+	require.NotEmpty(t, result.Steps)
+	require.Equal(t, uint64(0), result.Steps[0].PC)
+	sstores := 0
+	for _, step := range result.Steps {
+		require.Equal(t, 1, step.Depth)
+		require.Empty(t, step.Error)
+		if step.Op == "SSTORE" {
+			sstores++
+			// The stored value is the second item of the stack
+			require.True(t, len(step.Stack) >= 2)
+		}
+	}
+	require.Equal(t, 2, sstores) // remainingCandies, eatenCandies
+
+	// Unknown transaction
+	_, err = bevmClient.TraceTransaction(common.HexToHash("0x1234"))
+	require.NotNil(t, err)
+
+	// Simulated transaction, failing
+	tx, err := newMethodTx(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(1000))
+	require.Nil(t, err)
+
+	result, err = bevmClient.Trace(tx, a.Address)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, result.Receipt.Status)
+	require.Equal(t, "error", result.RevertReason)
+	require.Len(t, result.Calls, 1)
+	require.NotEmpty(t, result.Calls[0].Error)
+
+	lastStep := result.Steps[len(result.Steps)-1]
+	require.Equal(t, "REVERT", lastStep.Op)
+	require.NotEmpty(t, lastStep.Error)
+
+	// Transactions are replayed with the chain ID for which they were signed
+	err = bevmClient.ChangeChainID(5678)
+	require.Nil(t, err)
+
+	result, err = bevmClient.TraceTransaction(receipt.TxHash)
+	require.Nil(t, err)
+	require.Equal(t, receipt.GasUsed, result.Receipt.GasUsed)
+	require.False(t, result.Diverged)
+
+	// The records of transactions cannot be replayed once pruned
+	err = bevmClient.PruneTxRecords()
+	require.Nil(t, err)
+
+	_, err = bevmClient.TraceTransaction(receipt.TxHash)
+	require.NotNil(t, err)
+	_, _, err = bevmClient.GetTx(receipt.TxHash)
+	require.NotNil(t, err)
+
+	// The receipts are kept
+	_, err = bevmClient.GetTxReceipt(receipt.TxHash)
+	require.Nil(t, err)
+}
+
+func Test_Nonce(t *testing.T) {
+	log.LLvl1("Nonce synchronization")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+	_, err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	nonce, err := bevmClient.GetNonce(a.Address)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), nonce)
+	require.Equal(t, uint64(1), a.Nonce)
+
+	// The same account used elsewhere, starting from a zero nonce: the
+	// mismatch is detected, and the nonce resynchronized
+	other, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, other, candyContract, "eatCandy", big.NewInt(10))
+	require.NotNil(t, err)
+	mismatch, ok := err.(*NonceMismatchError)
+	require.True(t, ok)
+	require.Equal(t, a.Address, mismatch.Address)
+	require.Equal(t, uint64(0), mismatch.TxNonce)
+	require.Equal(t, uint64(1), mismatch.Expected)
+	require.Equal(t, uint64(1), other.Nonce)
+
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, other, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), other.Nonce)
+
+	// Failures unrelated to the nonce are reported as such (here, a gas limit
+	// lower than the intrinsic gas)
+	_, err = bevmClient.Transaction(1000, txParams.GasPrice, 0, other, candyContract, "eatCandy", big.NewInt(10))
+	require.NotNil(t, err)
+	_, ok = err.(*NonceMismatchError)
+	require.False(t, ok)
+	require.Equal(t, uint64(2), other.Nonce)
+
+	// With automatic nonces, the stale account is filled from the EVM state
+	bevmClient.SetAutoNonce(true)
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), a.Nonce)
+
+	// A reverted EVM transaction still uses its nonce
+	receipt, err := bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(1000))
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+	require.Equal(t, uint64(4), a.Nonce)
+
+	nonce, err = bevmClient.GetNonce(a.Address)
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), nonce)
+
+	// Batches are not filled automatically, but their mismatches are
+	// detected as well
+	batch := NewBatch()
+	err = batch.Transaction(txParams.GasLimit, txParams.GasPrice, 0, other, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+	_, err = bevmClient.TransactionBatch(batch)
+	require.NotNil(t, err)
+	_, ok = err.(*NonceMismatchError)
+	require.True(t, ok)
+	require.Equal(t, uint64(4), other.Nonce)
+
+	// All the mismatching accounts of a batch are resynchronized
+	b, err := NewEvmAccount(testPrivateKeys[1])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), b.Address)
+	require.Nil(t, err)
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, b, candyContract, "eatCandy", big.NewInt(1))
+	require.Nil(t, err)
+
+	staleA, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	staleB, err := NewEvmAccount(testPrivateKeys[1])
+	require.Nil(t, err)
+
+	batch = NewBatch()
+	err = batch.Transaction(txParams.GasLimit, txParams.GasPrice, 0, staleA, candyContract, "eatCandy", big.NewInt(1))
+	require.Nil(t, err)
+	err = batch.Transaction(txParams.GasLimit, txParams.GasPrice, 0, staleB, candyContract, "eatCandy", big.NewInt(1))
+	require.Nil(t, err)
+	_, err = bevmClient.TransactionBatch(batch)
+	require.NotNil(t, err)
+	mismatch, ok = err.(*NonceMismatchError)
+	require.True(t, ok)
+	require.Equal(t, a.Address, mismatch.Address)
+	require.Equal(t, uint64(4), staleA.Nonce)
+	require.Equal(t, uint64(1), staleB.Nonce)
+
+	err = bevmClient.SyncNonce(a)
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), a.Nonce)
+}
+
+// Log emitted by the test contract built by emitterCode()
+type emittedLog struct {
+	topic common.Hash
+	data  []byte
+}
+
+// Build the runtime code of a contract emitting the given logs, whatever the
+// method called
+func emitterCode(logs ...emittedLog) []byte {
+	// Each log is emitted by 48 bytes of code, copying its data from the end
+	// of the code
+	dataOffset := 48*len(logs) + 1
+
+	var code, data []byte
+	for _, l := range logs {
+		offset := dataOffset + len(data)
+		code = append(code,
+			0x61, byte(len(l.data)>>8), byte(len(l.data)), // PUSH2 size
+			0x61, byte(offset>>8), byte(offset), // PUSH2 offset
+			0x60, 0x00, // PUSH1 0
+			0x39) // CODECOPY
+		code = append(code, 0x7f) // PUSH32 topic
+		code = append(code, l.topic.Bytes()...)
+		code = append(code,
+			0x61, byte(len(l.data)>>8), byte(len(l.data)), // PUSH2 size
+			0x60, 0x00, // PUSH1 0
+			0xa1) // LOG1
+		data = append(data, l.data...)
+	}
+	code = append(code, 0x00) // STOP
+
+	return append(code, data...)
+}
+
+// Build the logs requesting a ByzCoin instruction
+func instructionLogs(t *testing.T, instanceID byzcoin.InstanceID, action string, args byzcoin.Arguments) []emittedLog {
+	argumentArgs, err := newArguments("string", "bytes")
+	require.Nil(t, err)
+	instructionArgs, err := newArguments("bytes32", "string")
+	require.Nil(t, err)
+
+	var logs []emittedLog
+	for _, arg := range args {
+		data, err := argumentArgs.Pack(arg.Name, arg.Value)
+		require.Nil(t, err)
+		logs = append(logs, emittedLog{topic: ByzCoinArgumentTopic, data: data})
+	}
+
+	var id [32]byte
+	copy(id[:], instanceID.Slice())
+	data, err := instructionArgs.Pack(id, action)
+	require.Nil(t, err)
+
+	return append(logs, emittedLog{topic: ByzCoinInstructionTopic, data: data})
+}
+
+// Check the ByzCoin instructions emitted by EVM contracts
+func Test_EmittedInstructions(t *testing.T) {
+	log.LLvl1("Emitted ByzCoin instructions")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+
+	sourceID := bct.spawnCoins(100)
+	destinationID := bct.spawnCoins(0)
+
+	coinsBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coinsBuf, 40)
+	transferCode := emitterCode(instructionLogs(t, sourceID, "invoke:coin.transfer", byzcoin.Arguments{
+		{Name: "coins", Value: coinsBuf},
+		{Name: "destination", Value: destinationID.Slice()},
+	})...)
+	// "delete:coin" is not allowed by the darc
+	deleteCode := emitterCode(instructionLogs(t, destinationID, "delete:coin", nil)...)
+	// Darcs cannot be modified through the EVM
+	evolveCode := emitterCode(instructionLogs(t, byzcoin.NewInstanceID(bct.gDarc.GetBaseID()), "invoke:darc.evolve",
+		byzcoin.Arguments{{Name: "darc", Value: []byte{}}})...)
+
+	// Two identical spawn instructions
+	spawnLogs := instructionLogs(t, byzcoin.NewInstanceID(bct.gDarc.GetBaseID()), "spawn:"+contracts.ContractValueID,
+		byzcoin.Arguments{{Name: "value", Value: []byte("value")}})
+	spawnCode := emitterCode(append(append([]emittedLog{}, spawnLogs...), spawnLogs...)...)
+
+	transferAddress := common.HexToAddress("0x2000")
+	deleteAddress := common.HexToAddress("0x3000")
+	evolveAddress := common.HexToAddress("0x4000")
+	otherTransferAddress := common.HexToAddress("0x5000")
+	spawnAddress := common.HexToAddress("0x6000")
+	alloc := core.GenesisAlloc{
+		a.Address:            {Balance: big.NewInt(5 * WeiPerEther)},
+		transferAddress:      {Balance: big.NewInt(0), Code: transferCode},
+		deleteAddress:        {Balance: big.NewInt(0), Code: deleteCode},
+		evolveAddress:        {Balance: big.NewInt(0), Code: evolveCode},
+		otherTransferAddress: {Balance: big.NewInt(0), Code: transferCode},
+		spawnAddress:         {Balance: big.NewInt(0), Code: spawnCode},
+	}
+
+	instanceID, err := NewBEvmWithAlloc(bct.cl, bct.signer, bct.gDarc, Params{}, alloc)
+	require.Nil(t, err)
+
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	contractAbi, err := abi.JSON(strings.NewReader(
+		`[{"constant":false,"inputs":[],"name":"run","outputs":[],"type":"function"}]`))
+	require.Nil(t, err)
+
+	// The darc contains a rule for the transfer, but the BEVM instance does
+	// not satisfy it
+	transferContract := &EvmContract{Abi: contractAbi, Address: transferAddress, name: "Transfer"}
+	tx, err := newMethodTx(txParams.GasLimit, txParams.GasPrice, 0, a, transferContract, "run")
+	require.Nil(t, err)
+	result, err := bevmClient.Simulate(tx, a.Address)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, result.Receipt.Status)
+	require.Equal(t, uint64(1), result.EmittedInstructions)
+	require.NotEmpty(t, result.InstructionsError)
+
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, transferContract, "run")
+	require.NotNil(t, err)
+	require.Equal(t, uint64(100), bct.getCoins(sourceID))
+
+	bct.allowEmitter("invoke:coin.transfer", instanceID, transferAddress)
+
+	result, err = bevmClient.Simulate(tx, a.Address)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), result.EmittedInstructions)
+	require.Empty(t, result.InstructionsError)
+	require.Equal(t, uint64(100), bct.getCoins(sourceID))
+
+	// The transfer is executed along with the EVM transaction
+	receipt, err := bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, transferContract, "run")
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+
+	require.Equal(t, uint64(60), bct.getCoins(sourceID))
+	require.Equal(t, uint64(40), bct.getCoins(destinationID))
+
+	// The authorization is given to a single contract, not to the other
+	// ones emitting the same instruction
+	otherTransferContract := &EvmContract{Abi: contractAbi, Address: otherTransferAddress, name: "OtherTransfer"}
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, otherTransferContract, "run")
+	require.NotNil(t, err)
+	require.Equal(t, uint64(60), bct.getCoins(sourceID))
+
+	// Identical spawn instructions spawn different instances
+	bct.allowEmitter("spawn:"+contracts.ContractValueID, instanceID, spawnAddress)
+	spawnContract := &EvmContract{Abi: contractAbi, Address: spawnAddress, name: "Spawn"}
+	receipt, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, spawnContract, "run")
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+
+	// A forbidden instruction aborts the whole ByzCoin transaction
+	deleteContract := &EvmContract{Abi: contractAbi, Address: deleteAddress, name: "Delete"}
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, deleteContract, "run")
+	require.NotNil(t, err)
+
+	require.Equal(t, uint64(40), bct.getCoins(destinationID))
+
+	// Darc evolutions are refused, even when allowed to the BEVM instance
+	bct.allowEmitter("invoke:darc.evolve", instanceID, evolveAddress)
+	evolveContract := &EvmContract{Abi: contractAbi, Address: evolveAddress, name: "Evolve"}
+	_, err = bevmClient.Transaction(txParams.GasLimit, txParams.GasPrice, 0, a, evolveContract, "run")
+	require.NotNil(t, err)
+}
+
+// Check the retrieval of EVM transactions, blocks and logs, as used by
+// Ethereum tools
+func Test_GetLogs(t *testing.T) {
+	log.LLvl1("EVM blocks and logs")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+
+	topicA := crypto.Keccak256Hash([]byte("A()"))
+	topicB := crypto.Keccak256Hash([]byte("B()"))
+	emitterAddress := common.HexToAddress("0x2000")
+	alloc := core.GenesisAlloc{
+		a.Address: {Balance: big.NewInt(5 * WeiPerEther)},
+		emitterAddress: {Balance: big.NewInt(0), Code: emitterCode(
+			emittedLog{topic: topicA, data: []byte{1}},
+			emittedLog{topic: topicB, data: []byte{2}},
+		)},
+	}
+
+	instanceID, err := NewBEvmWithAlloc(bct.cl, bct.signer, bct.gDarc, Params{}, alloc)
+	require.Nil(t, err)
+
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	// Send an EVM transaction signed beforehand
+	chainID, err := bevmClient.ChainID()
+	require.Nil(t, err)
+	tx := types.NewTransaction(a.Nonce, emitterAddress, big.NewInt(0), txParams.GasLimit, txParams.GasPrice, nil)
+	signedTx, err := a.signTx(tx, chainID)
+	require.Nil(t, err)
+
+	receipt, err := bevmClient.SendSignedTx(signedTx)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.Len(t, receipt.Logs, 2)
+
+	// The transaction belongs to the latest block
+	executedTx, number, err := bevmClient.GetTx(signedTx.Hash())
+	require.Nil(t, err)
+	require.Equal(t, signedTx.Hash(), executedTx.Hash())
+
+	latest, err := bevmClient.BlockNumber()
+	require.Nil(t, err)
+	require.Equal(t, latest, number)
+
+	blockHash, txHashes, err := bevmClient.BlockTransactions(number)
+	require.Nil(t, err)
+	require.Equal(t, []common.Hash{signedTx.Hash()}, txHashes)
+
+	// The block preceding it does not contain any EVM transaction
+	_, txHashes, err = bevmClient.BlockTransactions(number - 1)
+	require.Nil(t, err)
+	require.Empty(t, txHashes)
+
+	// Logs of the latest block
+	logs, err := bevmClient.GetLogs(ethereum.FilterQuery{})
+	require.Nil(t, err)
+	require.Len(t, logs, 2)
+	for i, l := range logs {
+		require.Equal(t, emitterAddress, l.Address)
+		require.Equal(t, number, l.BlockNumber)
+		require.Equal(t, blockHash, l.BlockHash)
+		require.Equal(t, signedTx.Hash(), l.TxHash)
+		require.Equal(t, uint(i), l.Index)
+	}
+	require.Equal(t, []byte{2}, logs[1].Data)
+
+	// Filtered logs
+	logs, err = bevmClient.GetLogs(ethereum.FilterQuery{
+		FromBlock: big.NewInt(0),
+		Addresses: []common.Address{emitterAddress},
+		Topics:    [][]common.Hash{{topicB}},
+	})
+	require.Nil(t, err)
+	require.Len(t, logs, 1)
+	require.Equal(t, topicB, logs[0].Topics[0])
+
+	logs, err = bevmClient.GetLogs(ethereum.FilterQuery{BlockHash: &blockHash, Topics: [][]common.Hash{{topicA, topicB}}})
+	require.Nil(t, err)
+	require.Len(t, logs, 2)
+
+	logs, err = bevmClient.GetLogs(ethereum.FilterQuery{Addresses: []common.Address{a.Address}})
+	require.Nil(t, err)
+	require.Empty(t, logs)
+}
+
+// bcTest is used here to provide some simple test structure for different
+// tests.
+type bcTest struct {
+	t       *testing.T
+	local   *onet.LocalTest
+	signer  darc.Signer
+	servers []*onet.Server
+	roster  *onet.Roster
+	cl      *byzcoin.Client
+	gMsg    *byzcoin.CreateGenesisBlock
+	gDarc   *darc.Darc
+}
+
+func newBCTest(t *testing.T) (out *bcTest) {
+	out = &bcTest{t: t}
+	// First create a local test environment with three nodes.
+	out.local = onet.NewTCPTest(cothority.Suite)
+
+	out.signer = darc.NewSignerEd25519(nil, nil)
+	out.servers, out.roster, _ = out.local.GenTree(3, true)
+
+	// Then create a new ledger with the genesis darc having the right
+	// to create and update keyValue contracts.
+	var err error
+	out.gMsg, err = byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, out.roster,
+		[]string{"spawn:bevm", "invoke:bevm.credit", "invoke:bevm.transaction", "invoke:bevm.transactions", "invoke:bevm.config",
+			"invoke:bevm.prune", "delete:bevm",
+			"invoke:bevm.deposit", "invoke:bevm.withdraw",
+			"spawn:coin", "invoke:coin.mint", "invoke:coin.fetch", "invoke:coin.transfer",
+			"spawn:bevm_value", "invoke:bevm_value.update", "delete:bevm_value"}, out.signer.Identity())
+	require.Nil(t, err)
+	out.gDarc = &out.gMsg.GenesisDarc
+
+	// This BlockInterval is good for testing, but in real world applications this
+	// should be more like 5 seconds.
+	out.gMsg.BlockInterval = time.Second
+
+	out.cl, _, err = byzcoin.NewLedger(out.gMsg, false)
+	require.Nil(t, err)
+
+	return out
+}
+
+func (bct *bcTest) Close() {
+	bct.local.CloseAll()
+}
+
+// Helper functions
+
+// Spawn a new coin instance and mint the given amount of coins on it
+func (bct *bcTest) spawnCoins(amount uint64) byzcoin.InstanceID {
+	counters, err := bct.cl.GetSignerCounters(bct.signer.Identity().String())
+	require.Nil(bct.t, err)
+
+	ctx := byzcoin.ClientTransaction{
+		Instructions: []byzcoin.Instruction{{
+			InstanceID:    byzcoin.NewInstanceID(bct.gDarc.GetBaseID()),
+			SignerCounter: []uint64{counters.Counters[0] + 1},
+			Spawn: &byzcoin.Spawn{
+				ContractID: contracts.ContractCoinID,
+			},
+		}},
+	}
+	coinID := ctx.Instructions[0].DeriveID("")
+
+	coinsBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coinsBuf, amount)
+	ctx.Instructions = append(ctx.Instructions, byzcoin.Instruction{
+		InstanceID:    coinID,
+		SignerCounter: []uint64{counters.Counters[0] + 2},
+		Invoke: &byzcoin.Invoke{
+			ContractID: contracts.ContractCoinID,
+			Command:    "mint",
+			Args:       byzcoin.Arguments{{Name: "coins", Value: coinsBuf}},
+		},
+	})
+
+	require.Nil(bct.t, ctx.FillSignersAndSignWith(bct.signer))
+
+	_, err = bct.cl.AddTransactionAndWait(ctx, 5)
+	require.Nil(bct.t, err)
+
+	return coinID
+}
+
+// Send a single instruction signed by the test signer
+func (bct *bcTest) sendInstruction(instr byzcoin.Instruction) error {
+	counters, err := bct.cl.GetSignerCounters(bct.signer.Identity().String())
+	require.Nil(bct.t, err)
+
+	instr.SignerCounter = []uint64{counters.Counters[0] + 1}
+	ctx := byzcoin.ClientTransaction{
+		Instructions: []byzcoin.Instruction{instr},
+	}
+
+	require.Nil(bct.t, ctx.FillSignersAndSignWith(bct.signer))
+
+	_, err = bct.cl.AddTransactionAndWait(ctx, 5)
+
+	return err
+}
+
+// Evolve the genesis darc so that the ByzCoin instructions performing the
+// given action can be emitted by an EVM contract of a BEVM instance
+func (bct *bcTest) allowEmitter(action string, bevmID byzcoin.InstanceID, contract common.Address) {
+	newDarc := bct.gDarc.Copy()
+	require.Nil(bct.t, newDarc.EvolveFrom(bct.gDarc))
+
+	rule := expression.InitOrExpr(bct.signer.Identity().String(), EmitterIdentity(bevmID, contract))
+	if newDarc.Rules.Contains(darc.Action(action)) {
+		require.Nil(bct.t, newDarc.Rules.UpdateRule(darc.Action(action), rule))
+	} else {
+		require.Nil(bct.t, newDarc.Rules.AddRule(darc.Action(action), rule))
+	}
+
+	darcBuf, err := newDarc.ToProto()
+	require.Nil(bct.t, err)
+
+	err = bct.sendInstruction(byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(bct.gDarc.GetBaseID()),
+		Invoke: &byzcoin.Invoke{
+			ContractID: byzcoin.ContractDarcID,
+			Command:    "evolve",
+			Args:       byzcoin.Arguments{{Name: "darc", Value: darcBuf}},
+		},
+	})
+	require.Nil(bct.t, err)
+
+	bct.gDarc = newDarc
+}
+
+// Retrieve the amount of coins held by a coin instance
+func (bct *bcTest) getCoins(coinID byzcoin.InstanceID) uint64 {
+	proofResponse, err := bct.cl.GetProof(coinID.Slice())
+	require.Nil(bct.t, err)
+
+	_, value, _, _, err := proofResponse.Proof.KeyValue()
+	require.Nil(bct.t, err)
+
+	var coin byzcoin.Coin
+	require.Nil(bct.t, protobuf.Decode(value, &coin))
+
+	return coin.Value
+}
 
 // Sometimes, the result of a call to an Ethereum method s unpacked to a
 // big.Int value of zero which, while correct, confuses require.Equal() when
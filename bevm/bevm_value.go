@@ -0,0 +1,138 @@
+package bevm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+)
+
+// ByzCoin contract for BEVM values.
+//
+// Each entry of the EVM state database of a BEVM instance is stored in a
+// separate BEVM value instance. These instances are only created, updated and
+// removed through the state changes produced by their BEVM instance; any
+// instruction sent directly to them is refused.
+
+var errBEvmValueReadOnly = errors.New("BEVM value instances can only be modified by their BEVM instance")
+
+// KeyNotFoundError is returned when a client reads an entry of the EVM state
+// database which does not exist, as proven by ByzCoin
+type KeyNotFoundError struct {
+	Key []byte
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("No EVM state database entry for key '%x'", e.Key)
+}
+
+// ByzCoin contract state for BEVM values
+type contractBEvmValue struct {
+	byzcoin.BasicContract
+	value []byte
+}
+
+// Deserialize a BEVM value contract state
+func contractBEvmValueFromBytes(in []byte) (byzcoin.Contract, error) {
+	return &contractBEvmValue{value: in}, nil
+}
+
+// VerifyInstruction refuses all instructions
+func (c *contractBEvmValue) VerifyInstruction(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte) error {
+	return errBEvmValueReadOnly
+}
+
+// Spawn refuses to create BEVM value instances
+func (c *contractBEvmValue) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	return nil, nil, errBEvmValueReadOnly
+}
+
+// Invoke refuses to modify BEVM value instances
+func (c *contractBEvmValue) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	return nil, nil, errBEvmValueReadOnly
+}
+
+// Delete refuses to remove BEVM value instances
+func (c *contractBEvmValue) Delete(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	return nil, nil, errBEvmValueReadOnly
+}
+
+// ---------------------------------------------------------------------------
+
+// BEvmValue is an entry of the EVM state database of a BEVM instance, along
+// with the ByzCoin proof of the BEVM value instance holding it
+type BEvmValue struct {
+	BEvmID byzcoin.InstanceID // ID of the BEVM instance
+	Key    []byte             // Key in the EVM state database
+	Value  []byte             // Value in the EVM state database
+	Proof  byzcoin.Proof      // Proof of the BEVM value instance
+}
+
+// GetBEvmValue retrieves an entry of the EVM state database of a BEVM
+// instance, and verifies its proof
+func GetBEvmValue(bcClient *byzcoin.Client, bevmID byzcoin.InstanceID, key []byte) (*BEvmValue, error) {
+	db := ByzDatabase{bevmIID: bevmID}
+
+	proofResponse, err := bcClient.GetProof(db.getValueInstanceID(key).Slice())
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := verifyBEvmValueProof(&proofResponse.Proof, bcClient.ID, bevmID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BEvmValue{
+		BEvmID: bevmID,
+		Key:    key,
+		Value:  value,
+		Proof:  proofResponse.Proof,
+	}, nil
+}
+
+// Verify checks that the proof of a BEVM value is valid for the given ByzCoin
+// ledger, and that it matches the BEVM instance, key and value
+func (bv *BEvmValue) Verify(byzcoinID skipchain.SkipBlockID) error {
+	value, err := verifyBEvmValueProof(&bv.Proof, byzcoinID, bv.BEvmID, bv.Key)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(bv.Value, value) {
+		return errors.New("BEVM value does not match its proof")
+	}
+
+	return nil
+}
+
+// Verify the proof of a BEVM value instance, and return its value
+func verifyBEvmValueProof(proof *byzcoin.Proof, byzcoinID skipchain.SkipBlockID, bevmID byzcoin.InstanceID, key []byte) ([]byte, error) {
+	err := proof.Verify(byzcoinID)
+	if err != nil {
+		return nil, err
+	}
+
+	db := ByzDatabase{bevmIID: bevmID}
+	instID := db.getValueInstanceID(key)
+
+	ok, err := proof.Exists(instID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+
+	_, value, contractID, _, err := proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if contractID != ContractBEvmValueID {
+		return nil, fmt.Errorf("Instance '%s' is not a BEVM value instance (contract '%s')", instID, contractID)
+	}
+
+	return value, nil
+}
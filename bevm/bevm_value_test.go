@@ -0,0 +1,105 @@
+package bevm
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func Test_BEvmValue(t *testing.T) {
+	log.LLvl1("BEVM values")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	// Create a new BEVM client
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+	receipt, err := bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	// The instance only keeps the number of values
+	bs, _, err := getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	require.Nil(t, bs.KeyList)
+	require.NotEqual(t, uint64(0), bs.KeyCount)
+
+	// Values can be read along with their proof
+	bv, err := GetBEvmValue(bct.cl, instanceID, getReceiptKey(receipt.TxHash))
+	require.Nil(t, err)
+	require.Nil(t, bv.Verify(bct.cl.ID))
+
+	storedReceipt, err := decodeReceipt(bv.Value)
+	require.Nil(t, err)
+	require.Equal(t, receipt.GasUsed, storedReceipt.GasUsed)
+
+	// A tampered value does not match its proof
+	bv.Value = append([]byte{}, bv.Value...)
+	bv.Value[0]++
+	require.NotNil(t, bv.Verify(bct.cl.ID))
+
+	// The proof does not match another key
+	bv, err = GetBEvmValue(bct.cl, instanceID, getReceiptKey(receipt.TxHash))
+	require.Nil(t, err)
+	bv.Key = []byte("other key")
+	require.NotNil(t, bv.Verify(bct.cl.ID))
+
+	// Unknown keys are reported
+	_, err = GetBEvmValue(bct.cl, instanceID, []byte("unknown key"))
+	require.NotNil(t, err)
+
+	// BEVM value instances cannot be manipulated directly
+	db := ByzDatabase{bevmIID: instanceID}
+	valueID := db.getValueInstanceID(getReceiptKey(receipt.TxHash))
+
+	err = bct.sendInstruction(byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(bct.gDarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractBEvmValueID,
+		},
+	})
+	require.NotNil(t, err)
+
+	err = bct.sendInstruction(byzcoin.Instruction{
+		InstanceID: valueID,
+		Invoke: &byzcoin.Invoke{
+			ContractID: ContractBEvmValueID,
+			Command:    "update",
+			Args:       byzcoin.Arguments{{Name: "value", Value: []byte("forged")}},
+		},
+	})
+	require.NotNil(t, err)
+
+	err = bct.sendInstruction(byzcoin.Instruction{
+		InstanceID: valueID,
+		Delete: &byzcoin.Delete{
+			ContractID: ContractBEvmValueID,
+		},
+	})
+	require.NotNil(t, err)
+
+	// The value is unchanged
+	bv, err = GetBEvmValue(bct.cl, instanceID, getReceiptKey(receipt.TxHash))
+	require.Nil(t, err)
+	storedReceipt, err = decodeReceipt(bv.Value)
+	require.Nil(t, err)
+	require.Equal(t, receipt.GasUsed, storedReceipt.GasUsed)
+}
@@ -0,0 +1,178 @@
+// Bevmadmin is a command-line tool to administer ByzCoin EVM instances.
+//
+// It relies on the ByzCoin configuration files created by bcadmin:
+//
+//  ./bevmadmin export --bc bc-xxx.cfg --instid <BEVM instance ID> --out snapshot.json
+//  ./bevmadmin import --bc bc-xxx.cfg --snapshot snapshot.json
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/c4dt/cothority-stainless/bevm"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/bcadmin/lib"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/onet/v3/log"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func main() {
+	cliApp := cli.NewApp()
+	cliApp.Name = "bevmadmin"
+	cliApp.Usage = "administer ByzCoin EVM instances"
+
+	bcFlag := cli.StringFlag{
+		Name:   "bc",
+		EnvVar: "BC",
+		Usage:  "the ByzCoin config to use (required)",
+	}
+
+	cliApp.Commands = []cli.Command{
+		{
+			Name:   "export",
+			Usage:  "export the state of a BEVM instance to a snapshot file",
+			Action: export,
+			Flags: []cli.Flag{
+				bcFlag,
+				cli.StringFlag{
+					Name:  "instid",
+					Usage: "the BEVM instance ID (required)",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Usage: "the snapshot file to write (required)",
+				},
+			},
+		},
+		{
+			Name:   "import",
+			Usage:  "spawn a new BEVM instance from a snapshot file",
+			Action: importSnapshot,
+			Flags: []cli.Flag{
+				bcFlag,
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "the snapshot file to read (required)",
+				},
+			},
+		},
+	}
+	cliApp.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+	}
+	cliApp.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.Int("debug"))
+		return nil
+	}
+
+	err := cliApp.Run(os.Args)
+	log.ErrFatal(err)
+}
+
+// Retrieve the value of a required string flag
+func requiredString(c *cli.Context, name string) (string, error) {
+	value := c.String(name)
+	if value == "" {
+		return "", fmt.Errorf("--%s flag is required", name)
+	}
+
+	return value, nil
+}
+
+// Load the ByzCoin configuration and client
+func loadByzCoin(c *cli.Context) (lib.Config, *byzcoin.Client, error) {
+	bcFile, err := requiredString(c, "bc")
+	if err != nil {
+		return lib.Config{}, nil, err
+	}
+
+	return lib.LoadConfig(bcFile)
+}
+
+func export(c *cli.Context) error {
+	_, bcClient, err := loadByzCoin(c)
+	if err != nil {
+		return err
+	}
+
+	instIDStr, err := requiredString(c, "instid")
+	if err != nil {
+		return err
+	}
+	instIDBuf, err := hex.DecodeString(instIDStr)
+	if err != nil {
+		return err
+	}
+	if len(instIDBuf) != 32 {
+		return errors.New("invalid BEVM instance ID")
+	}
+
+	outFile, err := requiredString(c, "out")
+	if err != nil {
+		return err
+	}
+
+	// Read-only access does not need a signer
+	bevmClient, err := bevm.NewClient(bcClient, darc.Signer{}, byzcoin.NewInstanceID(instIDBuf))
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := bevmClient.ExportState()
+	if err != nil {
+		return err
+	}
+
+	err = snapshot.Save(outFile)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Exported %d accounts to %s", len(snapshot.Accounts), outFile)
+
+	return nil
+}
+
+func importSnapshot(c *cli.Context) error {
+	cfg, bcClient, err := loadByzCoin(c)
+	if err != nil {
+		return err
+	}
+
+	snapshotFile, err := requiredString(c, "snapshot")
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := bevm.LoadSnapshot(snapshotFile)
+	if err != nil {
+		return err
+	}
+
+	signer, err := lib.LoadKey(cfg.AdminIdentity)
+	if err != nil {
+		return err
+	}
+
+	gDarc, err := bcClient.GetGenDarc()
+	if err != nil {
+		return err
+	}
+
+	instanceID, err := bevm.NewBEvmFromSnapshot(bcClient, *signer, gDarc, bevm.Params{}, snapshot)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Spawned BEVM instance %x", instanceID.Slice())
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/c4dt/cothority-stainless/bevm"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// ethAPI implements the "eth" namespace of the Ethereum JSON-RPC API on top
+// of a BEVM client. Only the latest state of the BEVM instance is available.
+type ethAPI struct {
+	client *bevm.Client
+	// Transactions are sent one at a time, as they are signed by the same
+	// ByzCoin signer, whose counter must be incremented in sequence
+	sendLock sync.Mutex
+}
+
+func newEthAPI(client *bevm.Client) *ethAPI {
+	return &ethAPI{client: client}
+}
+
+// Arguments of eth_call and eth_estimateGas
+type callArgs struct {
+	From     *common.Address `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      *hexutil.Uint64 `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Data     *hexutil.Bytes  `json:"data"`
+}
+
+// Build the unsigned EVM transaction described by call arguments, as well as
+// its sender
+func (args *callArgs) toTx() (*types.Transaction, common.Address) {
+	var from common.Address
+	if args.From != nil {
+		from = *args.From
+	}
+
+	var gas uint64
+	if args.Gas != nil {
+		gas = uint64(*args.Gas)
+	}
+
+	gasPrice := new(big.Int)
+	if args.GasPrice != nil {
+		gasPrice = args.GasPrice.ToInt()
+	}
+
+	value := new(big.Int)
+	if args.Value != nil {
+		value = args.Value.ToInt()
+	}
+
+	var data []byte
+	if args.Data != nil {
+		data = *args.Data
+	}
+
+	if args.To == nil {
+		return types.NewContractCreation(0, value, gas, gasPrice, data), from
+	}
+
+	return types.NewTransaction(0, *args.To, value, gas, gasPrice, data), from
+}
+
+// Check that a block parameter refers to the latest block, the only one
+// whose state is available
+func checkLatestBlock(blockNr *rpc.BlockNumber) error {
+	if blockNr == nil || *blockNr == rpc.LatestBlockNumber || *blockNr == rpc.PendingBlockNumber {
+		return nil
+	}
+
+	return errors.New("Only the latest block is supported")
+}
+
+// ChainId implements eth_chainId
+func (api *ethAPI) ChainId() (*hexutil.Big, error) {
+	chainID, err := api.client.ChainID()
+	if err != nil {
+		return nil, err
+	}
+
+	return (*hexutil.Big)(chainID), nil
+}
+
+// BlockNumber implements eth_blockNumber
+func (api *ethAPI) BlockNumber() (hexutil.Uint64, error) {
+	number, err := api.client.BlockNumber()
+
+	return hexutil.Uint64(number), err
+}
+
+// GetBalance implements eth_getBalance
+func (api *ethAPI) GetBalance(address common.Address, blockNr *rpc.BlockNumber) (*hexutil.Big, error) {
+	err := checkLatestBlock(blockNr)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := api.client.GetAccountBalance(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return (*hexutil.Big)(balance), nil
+}
+
+// GetTransactionCount implements eth_getTransactionCount
+func (api *ethAPI) GetTransactionCount(address common.Address, blockNr *rpc.BlockNumber) (hexutil.Uint64, error) {
+	err := checkLatestBlock(blockNr)
+	if err != nil {
+		return 0, err
+	}
+
+	nonce, err := api.client.GetNonce(address)
+
+	return hexutil.Uint64(nonce), err
+}
+
+// GetCode implements eth_getCode
+func (api *ethAPI) GetCode(address common.Address, blockNr *rpc.BlockNumber) (hexutil.Bytes, error) {
+	err := checkLatestBlock(blockNr)
+	if err != nil {
+		return nil, err
+	}
+
+	stateDb, err := api.client.GetStateDb()
+	if err != nil {
+		return nil, err
+	}
+
+	return stateDb.GetCode(address), nil
+}
+
+// Call implements eth_call, simulating the transaction
+func (api *ethAPI) Call(args callArgs, blockNr *rpc.BlockNumber) (hexutil.Bytes, error) {
+	err := checkLatestBlock(blockNr)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, from := args.toTx()
+
+	result, err := api.client.Simulate(tx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Receipt.Status == types.ReceiptStatusFailed {
+		if result.RevertReason != "" {
+			return nil, errors.New("execution reverted: " + result.RevertReason)
+		}
+		return nil, errors.New("execution reverted")
+	}
+
+	return result.ReturnData, nil
+}
+
+// EstimateGas implements eth_estimateGas
+func (api *ethAPI) EstimateGas(args callArgs) (hexutil.Uint64, error) {
+	tx, from := args.toTx()
+
+	gasLimit, err := api.client.EstimateTxGas(tx, from)
+
+	return hexutil.Uint64(gasLimit), err
+}
+
+// SendRawTransaction implements eth_sendRawTransaction. The transaction is
+// executed by the time its hash is returned.
+func (api *ethAPI) SendRawTransaction(encodedTx hexutil.Bytes) (common.Hash, error) {
+	tx := new(types.Transaction)
+	err := rlp.DecodeBytes(encodedTx, tx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	api.sendLock.Lock()
+	defer api.sendLock.Unlock()
+
+	receipt, err := api.client.SendSignedTx(tx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	log.Lvlf1("Executed EVM transaction %s: status = %d", tx.Hash().Hex(), receipt.Status)
+
+	return tx.Hash(), nil
+}
+
+// Check whether an error reports a missing entry of the EVM state database
+func isNotFound(err error) bool {
+	_, ok := err.(*bevm.KeyNotFoundError)
+
+	return ok
+}
+
+// GetTransactionReceipt implements eth_getTransactionReceipt, returning nil
+// for unknown transactions
+func (api *ethAPI) GetTransactionReceipt(txHash common.Hash) (map[string]interface{}, error) {
+	receipt, err := api.client.GetTxReceipt(txHash)
+	if isNotFound(err) {
+		log.Lvlf2("No receipt for EVM transaction %s", txHash.Hex())
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{
+		"transactionHash":   txHash,
+		"transactionIndex":  nil,
+		"blockHash":         nil,
+		"blockNumber":       nil,
+		"from":              nil,
+		"to":                nil,
+		"gasUsed":           hexutil.Uint64(receipt.GasUsed),
+		"cumulativeGasUsed": hexutil.Uint64(receipt.CumulativeGasUsed),
+		"contractAddress":   nil,
+		"logs":              receipt.Logs,
+		"logsBloom":         receipt.Bloom,
+		"status":            hexutil.Uint(receipt.Status),
+	}
+	if receipt.Logs == nil {
+		fields["logs"] = []*types.Log{}
+	}
+	if receipt.ContractAddress != (common.Address{}) {
+		fields["contractAddress"] = receipt.ContractAddress
+	}
+
+	// Transactions executed before their records were kept, or whose records
+	// were pruned, cannot be located
+	tx, number, err := api.client.GetTx(txHash)
+	if isNotFound(err) {
+		log.Lvlf2("Cannot locate EVM transaction %s", txHash.Hex())
+		return fields, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The chain ID of the instance may have changed since the execution
+	from, err := types.Sender(types.NewEIP155Signer(tx.ChainId()), tx)
+	if err != nil {
+		return nil, err
+	}
+	fields["from"] = from
+	fields["to"] = tx.To()
+
+	blockHash, txHashes, err := api.client.BlockTransactions(number)
+	if err != nil {
+		return nil, err
+	}
+
+	txIndex := 0
+	for i, hash := range txHashes {
+		if hash == txHash {
+			txIndex = i
+			break
+		}
+	}
+
+	fields["blockHash"] = blockHash
+	fields["blockNumber"] = hexutil.Uint64(number)
+	fields["transactionIndex"] = hexutil.Uint64(txIndex)
+
+	for _, l := range receipt.Logs {
+		l.BlockNumber = number
+		l.BlockHash = blockHash
+		l.TxIndex = uint(txIndex)
+	}
+
+	return fields, nil
+}
+
+// GetLogs implements eth_getLogs
+func (api *ethAPI) GetLogs(crit filters.FilterCriteria) ([]*types.Log, error) {
+	logs, err := api.client.GetLogs(ethereum.FilterQuery(crit))
+	if err != nil {
+		return nil, err
+	}
+
+	if logs == nil {
+		logs = []*types.Log{}
+	}
+
+	return logs, nil
+}
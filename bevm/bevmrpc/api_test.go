@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c4dt/cothority-stainless/bevm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func TestCallArgs(t *testing.T) {
+	log.LLvl1("Call arguments")
+
+	// Missing arguments are zero, and no recipient means a deployment
+	tx, from := (&callArgs{}).toTx()
+	require.Equal(t, common.Address{}, from)
+	require.Nil(t, tx.To())
+	require.Equal(t, uint64(0), tx.Gas())
+	require.Equal(t, 0, tx.GasPrice().Sign())
+	require.Equal(t, 0, tx.Value().Sign())
+	require.Empty(t, tx.Data())
+
+	sender := common.HexToAddress("0x1000")
+	recipient := common.HexToAddress("0x2000")
+	gas := hexutil.Uint64(50000)
+	data := hexutil.Bytes{1, 2, 3}
+	tx, from = (&callArgs{
+		From:     &sender,
+		To:       &recipient,
+		Gas:      &gas,
+		GasPrice: (*hexutil.Big)(big.NewInt(2)),
+		Value:    (*hexutil.Big)(big.NewInt(1000)),
+		Data:     &data,
+	}).toTx()
+	require.Equal(t, sender, from)
+	require.Equal(t, recipient, *tx.To())
+	require.Equal(t, uint64(50000), tx.Gas())
+	require.Equal(t, big.NewInt(2), tx.GasPrice())
+	require.Equal(t, big.NewInt(1000), tx.Value())
+	require.Equal(t, []byte{1, 2, 3}, tx.Data())
+}
+
+func TestEthAPI(t *testing.T) {
+	log.LLvl1("Ethereum JSON-RPC API")
+
+	rt := newRPCTest(t)
+	defer rt.Close()
+
+	a, err := bevm.GenerateEvmAccount()
+	require.Nil(t, err)
+	err = rt.client.CreditAccount(big.NewInt(5*bevm.WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	chainID, err := rt.client.ChainID()
+	require.Nil(t, err)
+
+	recipient := common.HexToAddress("0x2000")
+
+	// The call arguments are decoded from their JSON form
+	var gas hexutil.Uint64
+	err = rt.rpc.Call(&gas, "eth_estimateGas", map[string]interface{}{
+		"from":  a.Address,
+		"to":    recipient,
+		"value": "0x3e8",
+	})
+	require.Nil(t, err)
+	require.Equal(t, hexutil.Uint64(params.TxGas), gas)
+
+	// Transaction encoded in RLP
+	tx, err := types.SignTx(types.NewTransaction(0, recipient, big.NewInt(1000), params.TxGas, big.NewInt(1), nil),
+		types.NewEIP155Signer(chainID), a.PrivateKey)
+	require.Nil(t, err)
+	encodedTx, err := rlp.EncodeToBytes(tx)
+	require.Nil(t, err)
+
+	var txHash common.Hash
+	err = rt.rpc.Call(&txHash, "eth_sendRawTransaction", hexutil.Bytes(encodedTx))
+	require.Nil(t, err)
+	require.Equal(t, tx.Hash(), txHash)
+
+	var balance hexutil.Big
+	err = rt.rpc.Call(&balance, "eth_getBalance", recipient, "latest")
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(1000), balance.ToInt())
+
+	// Invalid encodings are refused
+	err = rt.rpc.Call(&txHash, "eth_sendRawTransaction", hexutil.Bytes{1, 2, 3})
+	require.NotNil(t, err)
+
+	// Receipt, in the form used by Ethereum tools
+	var receipt map[string]interface{}
+	err = rt.rpc.Call(&receipt, "eth_getTransactionReceipt", txHash)
+	require.Nil(t, err)
+	require.NotNil(t, receipt)
+	require.Equal(t, strings.ToLower(txHash.Hex()), receipt["transactionHash"])
+	require.Equal(t, "0x1", receipt["status"])
+	require.Equal(t, hexutil.EncodeUint64(params.TxGas), receipt["gasUsed"])
+	require.Equal(t, strings.ToLower(a.Address.Hex()), receipt["from"])
+	require.Equal(t, strings.ToLower(recipient.Hex()), receipt["to"])
+	require.Equal(t, "0x0", receipt["transactionIndex"])
+	require.NotNil(t, receipt["blockHash"])
+	require.NotNil(t, receipt["blockNumber"])
+	require.Nil(t, receipt["contractAddress"])
+	require.Equal(t, []interface{}{}, receipt["logs"])
+
+	// Unknown transactions have no receipt
+	receipt = nil
+	err = rt.rpc.Call(&receipt, "eth_getTransactionReceipt", common.HexToHash("0x1234"))
+	require.Nil(t, err)
+	require.Nil(t, receipt)
+
+	// Only the latest state is available
+	err = rt.rpc.Call(&balance, "eth_getBalance", recipient, "0x1")
+	require.NotNil(t, err)
+}
+
+// Test environment: a BEVM instance on a new ByzCoin ledger, served by an
+// in-process RPC server
+type rpcTest struct {
+	local  *onet.LocalTest
+	client *bevm.Client
+	rpc    *rpc.Client
+}
+
+func newRPCTest(t *testing.T) *rpcTest {
+	local := onet.NewTCPTest(cothority.Suite)
+	local.Check = onet.CheckNone
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	_, roster, _ := local.GenTree(3, true)
+
+	gMsg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:bevm", "invoke:bevm.credit", "invoke:bevm.transaction"}, signer.Identity())
+	require.Nil(t, err)
+	gMsg.BlockInterval = time.Second
+
+	bcClient, _, err := byzcoin.NewLedger(gMsg, false)
+	require.Nil(t, err)
+
+	instanceID, err := bevm.NewBEvm(bcClient, signer, &gMsg.GenesisDarc)
+	require.Nil(t, err)
+
+	client, err := bevm.NewClient(bcClient, signer, instanceID)
+	require.Nil(t, err)
+
+	server := rpc.NewServer()
+	err = server.RegisterName("eth", newEthAPI(client))
+	require.Nil(t, err)
+
+	return &rpcTest{
+		local:  local,
+		client: client,
+		rpc:    rpc.DialInProc(server),
+	}
+}
+
+func (rt *rpcTest) Close() {
+	rt.rpc.Close()
+	rt.local.CloseAll()
+}
@@ -0,0 +1,148 @@
+// Bevmrpc is an Ethereum JSON-RPC gateway to a ByzCoin EVM instance, allowing
+// Ethereum tools such as web3.js, ethers.js or wallets to interact with it.
+//
+// It relies on the ByzCoin configuration files created by bcadmin, whose
+// admin identity signs the ByzCoin transactions carrying the EVM
+// transactions:
+//
+//  ./bevmrpc --bc bc-xxx.cfg --instid <BEVM instance ID> --listen localhost:8545
+//
+// The following methods are implemented, on the latest state only:
+// eth_chainId, eth_blockNumber, eth_getBalance, eth_getTransactionCount,
+// eth_getCode, eth_call, eth_estimateGas, eth_sendRawTransaction,
+// eth_getTransactionReceipt and eth_getLogs.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/c4dt/cothority-stainless/bevm"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/bcadmin/lib"
+	"go.dedis.ch/onet/v3/log"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func main() {
+	cliApp := cli.NewApp()
+	cliApp.Name = "bevmrpc"
+	cliApp.Usage = "Ethereum JSON-RPC gateway to a ByzCoin EVM instance"
+	cliApp.Action = serve
+	cliApp.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "bc",
+			EnvVar: "BC",
+			Usage:  "the ByzCoin config to use (required)",
+		},
+		cli.StringFlag{
+			Name:  "instid",
+			Usage: "the BEVM instance ID (required)",
+		},
+		cli.StringFlag{
+			Name:  "listen",
+			Value: "localhost:8545",
+			Usage: "the address to listen on for JSON-RPC requests over HTTP",
+		},
+		cli.StringFlag{
+			Name:  "cors",
+			Usage: "comma-separated list of domains from which to accept cross-origin requests",
+		},
+		cli.StringFlag{
+			Name:  "vhosts",
+			Value: "localhost",
+			Usage: "comma-separated list of virtual hostnames from which to accept requests ('*' for any)",
+		},
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+	}
+	cliApp.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.Int("debug"))
+		return nil
+	}
+
+	err := cliApp.Run(os.Args)
+	log.ErrFatal(err)
+}
+
+// Retrieve the value of a required string flag
+func requiredString(c *cli.Context, name string) (string, error) {
+	value := c.String(name)
+	if value == "" {
+		return "", fmt.Errorf("--%s flag is required", name)
+	}
+
+	return value, nil
+}
+
+// Split a comma-separated list flag
+func listFlag(c *cli.Context, name string) []string {
+	var values []string
+	for _, value := range strings.Split(c.String(name), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+func serve(c *cli.Context) error {
+	bcFile, err := requiredString(c, "bc")
+	if err != nil {
+		return err
+	}
+
+	cfg, bcClient, err := lib.LoadConfig(bcFile)
+	if err != nil {
+		return err
+	}
+
+	instIDStr, err := requiredString(c, "instid")
+	if err != nil {
+		return err
+	}
+	instIDBuf, err := hex.DecodeString(instIDStr)
+	if err != nil {
+		return err
+	}
+	if len(instIDBuf) != 32 {
+		return errors.New("invalid BEVM instance ID")
+	}
+
+	signer, err := lib.LoadKey(cfg.AdminIdentity)
+	if err != nil {
+		return err
+	}
+
+	bevmClient, err := bevm.NewClient(bcClient, *signer, byzcoin.NewInstanceID(instIDBuf))
+	if err != nil {
+		return err
+	}
+
+	server := rpc.NewServer()
+	err = server.RegisterName("eth", newEthAPI(bevmClient))
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", c.String("listen"))
+	if err != nil {
+		return err
+	}
+
+	httpServer := rpc.NewHTTPServer(listFlag(c, "cors"), listFlag(c, "vhosts"), rpc.DefaultHTTPTimeouts, server)
+
+	log.Infof("Serving JSON-RPC requests for BEVM instance %x on http://%s", instIDBuf, listener.Addr())
+
+	return httpServer.Serve(listener)
+}
@@ -0,0 +1,126 @@
+package bevm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/types"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+)
+
+// blockInfo contains the ByzCoin block information made available to the EVM.
+//
+// An EVM transaction is executed while the ByzCoin block containing it is
+// being built, so its final timestamp and hash are not known yet. The EVM
+// therefore sees the block following the latest ByzCoin block:
+//   - the block number is the index of the latest ByzCoin block, plus one
+//   - the timestamp is the one of the latest ByzCoin block
+//   - the parent hash is the hash of the latest ByzCoin block
+//
+// The same mapping is used for client-side calls, which thus see the state as
+// a transaction submitted at that time would.
+//
+// The EVM has no way to report the failure of a block hash lookup (BLOCKHASH
+// opcode), which would make it use an empty hash where other nodes use the
+// actual one. The first failed lookup is therefore recorded, and executions
+// which performed it are rejected (see checkHashLookups()).
+type blockInfo struct {
+	number     *big.Int
+	timestamp  uint64 // In seconds
+	parentHash common.Hash
+	getHash    func(uint64) common.Hash // Hash of the ByzCoin block with the given index
+	hashErr    error                    // Error of the first failed block hash lookup
+}
+
+// Function retrieving a ByzCoin block given its index
+type getBlockByIndexFn func(index int) (*skipchain.SkipBlock, error)
+
+// Build the EVM block information from the latest ByzCoin block
+func newBlockInfo(latest *skipchain.SkipBlock, getBlockByIndex getBlockByIndexFn) (*blockInfo, error) {
+	var header byzcoin.DataHeader
+	err := protobuf.Decode(latest.Data, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	bi := &blockInfo{
+		number:     big.NewInt(int64(latest.Index + 1)),
+		timestamp:  uint64(header.Timestamp / 1e9), // ByzCoin timestamps are in nanoseconds
+		parentHash: common.BytesToHash(latest.Hash),
+	}
+
+	bi.getHash = func(index uint64) common.Hash {
+		if index == uint64(latest.Index) {
+			return common.BytesToHash(latest.Hash)
+		}
+		if index > uint64(latest.Index) {
+			return common.Hash{}
+		}
+
+		sb, err := getBlockByIndex(int(index))
+		if err == nil && sb == nil {
+			err = errors.New("block not found")
+		}
+		if err != nil {
+			log.Lvlf2("Error retrieving ByzCoin block #%d: %v", index, err)
+			if bi.hashErr == nil {
+				bi.hashErr = fmt.Errorf("Cannot retrieve the hash of ByzCoin block #%d: %v", index, err)
+			}
+			return common.Hash{}
+		}
+
+		return common.BytesToHash(sb.Hash)
+	}
+
+	return bi, nil
+}
+
+// Check that all the block hashes used by the EVM executions so far were
+// retrieved; if not, the outcome of the executions cannot be trusted.
+func (bi *blockInfo) checkHashLookups() error {
+	return bi.hashErr
+}
+
+// Build an EVM block header from the block information
+func (bi *blockInfo) header() *types.Header {
+	return &types.Header{
+		Number:     bi.number,
+		Difficulty: big.NewInt(0),
+		ParentHash: bi.parentHash,
+		Time:       bi.timestamp,
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+// byzChainContext implements core.ChainContext, allowing the EVM to retrieve
+// the hashes of previous ByzCoin blocks (BLOCKHASH opcode)
+type byzChainContext struct {
+	bi *blockInfo
+}
+
+// Engine implements core.ChainContext.Engine()
+func (cc byzChainContext) Engine() consensus.Engine {
+	// The consensus engine is only used to determine the block author, which
+	// we always provide explicitly.
+	return nil
+}
+
+// GetHeader implements core.ChainContext.GetHeader()
+func (cc byzChainContext) GetHeader(hash common.Hash, number uint64) *types.Header {
+	// Only the parent hash of the header is used by the EVM
+	if number == 0 || number >= cc.bi.number.Uint64() {
+		return nil
+	}
+
+	return &types.Header{
+		Number:     new(big.Int).SetUint64(number),
+		ParentHash: cc.bi.getHash(number - 1),
+	}
+}
@@ -0,0 +1,76 @@
+package bevm
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/protobuf"
+)
+
+// Build a fake chain of ByzCoin blocks
+func newTestBlocks(t *testing.T, n int) []*skipchain.SkipBlock {
+	var blocks []*skipchain.SkipBlock
+
+	for i := 0; i < n; i++ {
+		data, err := protobuf.Encode(&byzcoin.DataHeader{Timestamp: int64(i+1) * 1e9})
+		require.Nil(t, err)
+
+		sb := skipchain.NewSkipBlock()
+		sb.Index = i
+		sb.Data = data
+		sb.Hash = sb.CalculateHash()
+
+		blocks = append(blocks, sb)
+	}
+
+	return blocks
+}
+
+func TestBlockInfo(t *testing.T) {
+	blocks := newTestBlocks(t, 5)
+	latest := blocks[len(blocks)-1]
+
+	bi, err := newBlockInfo(latest, func(index int) (*skipchain.SkipBlock, error) {
+		return blocks[index], nil
+	})
+	require.Nil(t, err)
+
+	// The EVM sees the block following the latest ByzCoin block
+	require.Equal(t, big.NewInt(5), bi.number)
+	require.Equal(t, uint64(5), bi.timestamp)
+	require.Equal(t, common.BytesToHash(latest.Hash), bi.parentHash)
+
+	// Hashes of previous blocks are available through the chain context
+	getHash := core.GetHashFn(bi.header(), byzChainContext{bi: bi})
+	for i, sb := range blocks {
+		require.Equal(t, common.BytesToHash(sb.Hash), getHash(uint64(i)))
+		require.Equal(t, common.BytesToHash(sb.Hash), bi.getHash(uint64(i)))
+	}
+
+	// The current block hash is unknown
+	require.Equal(t, common.Hash{}, bi.getHash(5))
+	require.Nil(t, bi.checkHashLookups())
+
+	// A failed lookup is recorded, so that the execution using it can be
+	// rejected
+	bi, err = newBlockInfo(latest, func(index int) (*skipchain.SkipBlock, error) {
+		if index == 2 {
+			return nil, errors.New("block not available")
+		}
+
+		return blocks[index], nil
+	})
+	require.Nil(t, err)
+
+	require.Equal(t, common.BytesToHash(blocks[1].Hash), bi.getHash(1))
+	require.Nil(t, bi.checkHashLookups())
+	require.Equal(t, common.Hash{}, bi.getHash(2))
+	require.NotNil(t, bi.checkHashLookups())
+	require.Contains(t, bi.checkHashLookups().Error(), "#2")
+}
@@ -0,0 +1,115 @@
+package bevm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/contracts"
+	"go.dedis.ch/protobuf"
+)
+
+// The bridge between ByzCoin coins and EVM ether.
+//
+// Coins deposited into a BEVM instance are kept in its reserve, and the same
+// value is credited in ether to an Ethereum account. Withdrawing ether
+// destroys it and takes the same value out of the reserve, sending it to a
+// ByzCoin coin instance.
+//
+// As ether is fungible, ether minted with the "credit" command could be
+// withdrawn in place of the deposited one. The bridge and the "credit"
+// command are therefore exclusive: ether cannot be credited while coins are
+// in reserve, and coins cannot be deposited once ether was credited.
+
+// WeiPerCoin is the value in wei of a single ByzCoin coin: one coin is worth
+// one ether.
+const WeiPerCoin = WeiPerEther
+
+// WithdrawAddress is the EVM address to which ether must be transferred in
+// order to be withdrawn as ByzCoin coins
+var WithdrawAddress = common.BytesToAddress(crypto.Keccak256([]byte("bevm-withdraw"))[12:])
+
+// Convert an amount of coins into wei
+func coinsToWei(amount uint64) *big.Int {
+	return new(big.Int).Mul(new(big.Int).SetUint64(amount), big.NewInt(WeiPerCoin))
+}
+
+// Helper function that takes the ByzCoin coins provided to an instruction,
+// returning their total amount as well as the remaining coins of other types
+func takeCoins(coins []byzcoin.Coin) (uint64, []byzcoin.Coin, error) {
+	total := byzcoin.Coin{Name: contracts.CoinName}
+	var remaining []byzcoin.Coin
+
+	for _, coin := range coins {
+		if !coin.Name.Equal(contracts.CoinName) {
+			remaining = append(remaining, coin)
+			continue
+		}
+
+		err := total.SafeAdd(coin.Value)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if total.Value == 0 {
+		return 0, nil, errors.New("No coins provided for deposit")
+	}
+
+	return total.Value, remaining, nil
+}
+
+// Helper function that determines the amount of coins withdrawn by an EVM
+// transaction
+func withdrawnCoins(tx *types.Transaction) (uint64, error) {
+	if tx.To() == nil || *tx.To() != WithdrawAddress {
+		return 0, fmt.Errorf("Withdrawal EVM transaction must be sent to '%s'", WithdrawAddress.Hex())
+	}
+
+	amount, remainder := new(big.Int).DivMod(tx.Value(), big.NewInt(WeiPerCoin), new(big.Int))
+	if remainder.Sign() != 0 {
+		return 0, fmt.Errorf("Withdrawn value must be a multiple of %d wei", big.NewInt(WeiPerCoin))
+	}
+	if amount.Sign() == 0 || !amount.IsUint64() {
+		return 0, fmt.Errorf("Invalid withdrawn value: %d wei", tx.Value())
+	}
+
+	return amount.Uint64(), nil
+}
+
+// Helper function that credits coins on a ByzCoin coin instance, returning the
+// corresponding state change
+func creditCoins(rst byzcoin.ReadOnlyStateTrie, coinID byzcoin.InstanceID, amount uint64) (byzcoin.StateChange, error) {
+	value, _, contractID, darcID, err := rst.GetValues(coinID.Slice())
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	if contractID != contracts.ContractCoinID {
+		return byzcoin.StateChange{}, fmt.Errorf("Instance '%s' is not a coin instance", coinID)
+	}
+
+	var coin byzcoin.Coin
+	err = protobuf.Decode(value, &coin)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	if !coin.Name.Equal(contracts.CoinName) {
+		return byzcoin.StateChange{}, fmt.Errorf("Coin instance '%s' does not hold ByzCoin coins", coinID)
+	}
+
+	err = coin.SafeAdd(amount)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+
+	coinData, err := protobuf.Encode(&coin)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+
+	return byzcoin.NewStateChange(byzcoin.Update, coinID, contracts.ContractCoinID, coinData, darcID), nil
+}
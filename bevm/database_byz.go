@@ -1,6 +1,7 @@
 package bevm
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -8,8 +9,11 @@ import (
 	"sync"
 
 	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
 	"go.dedis.ch/onet/v3/log"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 )
 
@@ -38,10 +42,22 @@ func (db *ByzDatabase) Close() {}
 // ---------------------------------------------------------------------------
 
 // ClientByzDatabase is the ByzDatabase version specialized for client
-// (read-only) use, retrieving information using ByzCoin proofs
+// (read-only) use, retrieving information using ByzCoin proofs.
+//
+// A session can be pinned to the EVM state root of a BEVM instance, as proven
+// by a ByzCoin block, so that it sees a consistent state even if new blocks
+// are added meanwhile. The EVM state is read from this root, so that the trie
+// nodes and contract code read are content-addressed (keyed by the hash of
+// their value): they do not depend on the block at which they are read, as
+// long as the state is not pruned. These entries are kept in an optional
+// cache shared among sessions. Other entries (e.g. receipts) can only be read
+// at the pinned block; unpinned sessions read them at the latest block.
 type ClientByzDatabase struct {
 	ByzDatabase
-	client *byzcoin.Client
+	client      *byzcoin.Client
+	pinnedRoot  common.Hash          // EVM state root to which the session is pinned, if any
+	pinnedBlock *skipchain.SkipBlock // ByzCoin block proving the pinned state root
+	cache       *NodeCache           // Cache of content-addressed entries, if any
 }
 
 // NewClientByzDatabase creates a new ByzDatabase for client use
@@ -54,6 +70,20 @@ func NewClientByzDatabase(bevmIID byzcoin.InstanceID, client *byzcoin.Client) (*
 	}, nil
 }
 
+// Pin pins the session to the given EVM state root, proven by the given
+// ByzCoin block. Reading an entry which is not content-addressed fails once
+// the ledger has moved past this block, and reading a content-addressed entry
+// fails once the state root has been pruned.
+func (db *ClientByzDatabase) Pin(root common.Hash, block *skipchain.SkipBlock) {
+	db.pinnedRoot = root
+	db.pinnedBlock = block
+}
+
+// SetCache sets the cache of content-addressed entries
+func (db *ClientByzDatabase) SetCache(cache *NodeCache) {
+	db.cache = cache
+}
+
 // ethdb.Database interface implementation (client version)
 
 // Put implements Putter.Put()
@@ -63,27 +93,39 @@ func (db *ClientByzDatabase) Put(key []byte, value []byte) error {
 
 // Retrieve the value from a BEVM value instance
 func (db *ClientByzDatabase) getBEvmValue(key []byte) ([]byte, error) {
-	instID := db.getValueInstanceID(key)
+	if db.cache != nil {
+		if value, ok := db.cache.get(key); ok {
+			return value, nil
+		}
+	}
 
-	// Retrieve the proof of the ByzCoin instance
-	proofResponse, err := db.client.GetProof(instID[:])
+	bv, err := GetBEvmValue(db.client, db.bevmIID, key)
 	if err != nil {
+		if _, ok := err.(*KeyNotFoundError); ok && db.pinnedBlock != nil {
+			// The entries of the pinned state are only removed by pruning
+			return nil, fmt.Errorf("%v: the EVM state '%s' of block %d may have been pruned since",
+				err, db.pinnedRoot.Hex(), db.pinnedBlock.Index)
+		}
+
 		return nil, err
 	}
 
-	// Validate the proof
-	err = proofResponse.Proof.Verify(db.client.ID)
-	if err != nil {
-		return nil, err
+	if isContentAddressed(key, bv.Value) {
+		if db.cache != nil {
+			db.cache.put(key, bv.Value)
+		}
+
+		return bv.Value, nil
 	}
 
-	// Extract the value from the proof
-	_, value, _, _, err := proofResponse.Proof.KeyValue()
-	if err != nil {
-		return nil, err
+	if db.pinnedBlock != nil && !bytes.Equal(bv.Proof.Latest.Hash, db.pinnedBlock.Hash) {
+		// The proof is more recent than the pinned block; the value is only
+		// valid if it was not modified in between
+		return nil, fmt.Errorf("Key '%x' cannot be read at block %d: the ledger is at block %d",
+			key, db.pinnedBlock.Index, bv.Proof.Latest.Index)
 	}
 
-	return value, nil
+	return bv.Value, nil
 }
 
 // Has implements Has()
@@ -114,93 +156,186 @@ func (db *ClientByzDatabase) NewBatch() ethdb.Batch {
 	return nil
 }
 
-// ---------------------------------------------------------------------------
+// Prefix of the EVM state database keys holding the preimages of the hashed
+// trie keys (defined by go-ethereum)
+var preimageKeyPrefix = []byte("secure-key-")
 
-// ServerByzDatabase is the ByzDatabase version specialized for server
-// (read/write) use, updating ByzCoin via StateChanges
-type ServerByzDatabase struct {
-	ByzDatabase
-	roStateTrie  byzcoin.ReadOnlyStateTrie
-	stateChanges []byzcoin.StateChange // List of state changes to apply
-	keyMap       map[string]bool       // Keeps track of existing value instances (identified by their key)
-	lock         sync.RWMutex          // Protects concurrent access to 'keyMap' and 'stateChanges'
+// Check whether an entry of the EVM state database is keyed by the hash of
+// its value, as trie nodes, contract code and preimages are
+func isContentAddressed(key []byte, value []byte) bool {
+	key = bytes.TrimPrefix(key, preimageKeyPrefix)
+
+	return len(key) == common.HashLength && bytes.Equal(crypto.Keccak256(value), key)
+}
+
+// NodeCache is a bounded cache of content-addressed entries of EVM state
+// databases. As these entries never change, it can be shared among several
+// ClientByzDatabase instances, even of different BEVM instances.
+type NodeCache struct {
+	entries  map[string][]byte
+	order    []string // Keys in insertion order, the oldest first
+	capacity int
+	lock     sync.Mutex
 }
 
-func keyListToMap(keyList []string) map[string]bool {
-	keyMap := make(map[string]bool)
-	for _, key := range keyList {
-		keyMap[key] = true
+// NewNodeCache creates a new cache holding at most the given number of
+// entries
+func NewNodeCache(capacity int) *NodeCache {
+	return &NodeCache{
+		entries:  make(map[string][]byte),
+		capacity: capacity,
 	}
+}
+
+func (cache *NodeCache) get(key []byte) ([]byte, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 
-	return keyMap
+	value, ok := cache.entries[string(key)]
+
+	return value, ok
 }
 
-func keyMapToList(keyMap map[string]bool) []string {
-	var keyList []string
+func (cache *NodeCache) put(key []byte, value []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if _, ok := cache.entries[string(key)]; ok || cache.capacity <= 0 {
+		return
+	}
 
-	for key := range keyMap {
-		keyList = append(keyList, key)
+	// Evict the oldest entries
+	for len(cache.order) >= cache.capacity {
+		delete(cache.entries, cache.order[0])
+		cache.order = cache.order[1:]
 	}
-	// The list must be sorted as Go maps traversal order is inherently non-deterministic
-	sort.Strings(keyList)
 
-	return keyList
+	cache.entries[string(key)] = common.CopyBytes(value)
+	cache.order = append(cache.order, string(key))
+}
+
+// ---------------------------------------------------------------------------
+
+// ServerByzDatabase is the ByzDatabase version specialized for server
+// (read/write) use, updating ByzCoin via StateChanges.
+//
+// The existence of a key is determined by the existence of the corresponding
+// value instance in the ByzCoin state trie, so that the BEVM instance does not
+// need to keep track of its keys. Modifications are kept in memory until they
+// are dumped as StateChanges.
+type ServerByzDatabase struct {
+	ByzDatabase
+	roStateTrie  byzcoin.ReadOnlyStateTrie
+	keyCount     uint64                   // Number of keys before the modifications
+	keyIndexSize uint64                   // Number of entries in the key index
+	unindexed    [][]byte                 // Existing keys missing from the key index
+	pending      map[string]*pendingValue // Modifications to apply, identified by their key
+	lock         sync.RWMutex             // Protects concurrent access to 'pending' and the key index
 }
 
-// NewServerByzDatabase creates a new ByzDatabase for server use
-func NewServerByzDatabase(bevmIID byzcoin.InstanceID, keyList []string, roStateTrie byzcoin.ReadOnlyStateTrie) (*ServerByzDatabase, error) {
+// Modification of a key in the EVM state database
+type pendingValue struct {
+	value   []byte
+	deleted bool
+}
+
+// NewServerByzDatabase creates a new ByzDatabase for server use. keyCount is
+// the number of keys currently contained in the database, and keyIndexSize
+// the number of entries in its key index.
+func NewServerByzDatabase(bevmIID byzcoin.InstanceID, keyCount uint64, keyIndexSize uint64, roStateTrie byzcoin.ReadOnlyStateTrie) (*ServerByzDatabase, error) {
 	return &ServerByzDatabase{
 		ByzDatabase: ByzDatabase{
 			bevmIID: bevmIID,
 		},
-		keyMap:      keyListToMap(keyList),
-		roStateTrie: roStateTrie,
+		roStateTrie:  roStateTrie,
+		keyCount:     keyCount,
+		keyIndexSize: keyIndexSize,
+		pending:      make(map[string]*pendingValue),
 	}, nil
 }
 
-// Dump returns the list of StateChanges to apply to ByzCoin as well the list
-// of keys in the Ethereum state database, representing the modifications that
-// the EVM performed on its state database
-func (db *ServerByzDatabase) Dump() ([]byzcoin.StateChange, []string, error) {
-	// The changes produced by the EVM are apparently not ordered deterministically.
-	// Their order should, however, not be relevant, because each key is only affected by one change.
-	// We can tehrefore sort them as we please, as long as the sort order is deterministic to make ByzCoin happy.
-
-	// We check the hypothesis of unique keys before going further though...
-	keyMap := make(map[string]bool)
-	for _, s := range db.stateChanges {
-		k := string(s.Key())
-		if _, ok := keyMap[k]; ok {
-			return nil, nil, errors.New("Internal error: the set of changes produced by the EVM is not unique on keys")
+// Check whether a value instance exists in the ByzCoin state trie
+func (db *ServerByzDatabase) existsInTrie(key []byte) bool {
+	instID := db.getValueInstanceID(key)
+
+	_, _, _, _, err := db.roStateTrie.GetValues(instID[:])
+
+	return err == nil
+}
+
+// Dump returns the list of StateChanges to apply to ByzCoin as well the
+// resulting number of keys in the Ethereum state database and of entries in
+// its key index, representing the modifications that the EVM performed on its
+// state database
+func (db *ServerByzDatabase) Dump() ([]byzcoin.StateChange, uint64, uint64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// Record the newly created keys in the key index, in a deterministic order
+	var newKeys []string
+	for key, pv := range db.pending {
+		if !pv.deleted && !isKeyIndexKey([]byte(key)) && !db.existsInTrie([]byte(key)) {
+			newKeys = append(newKeys, key)
 		}
-		keyMap[k] = true
 	}
+	sort.Strings(newKeys)
 
-	// All good, let's sort by keys
-	sort.SliceStable(db.stateChanges, func(i, j int) bool {
-		return string(db.stateChanges[i].Key()) < string(db.stateChanges[j].Key())
-	})
+	keys := db.unindexed
+	for _, key := range newKeys {
+		keys = append(keys, []byte(key))
+	}
 
-	keyList := keyMapToList(db.keyMap)
+	err := db.appendToKeyIndex(keys)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	db.unindexed = nil
 
-	// Compute some statistics for information purposes
+	var stateChanges []byzcoin.StateChange
+	keyCount := db.keyCount
 	nbCreate, nbUpdate, nbRemove := 0, 0, 0
-	for _, s := range db.stateChanges {
-		switch s.StateAction {
-		case byzcoin.Create:
-			nbCreate++
-		case byzcoin.Update:
-			nbUpdate++
-		case byzcoin.Remove:
+
+	// Only the last modification of each key is relevant
+	for key, pv := range db.pending {
+		instanceID := db.getValueInstanceID([]byte(key))
+		exists := db.existsInTrie([]byte(key))
+		// The key index is not part of the EVM state database
+		counted := !isKeyIndexKey([]byte(key))
+
+		switch {
+		case pv.deleted && exists:
+			stateChanges = append(stateChanges, byzcoin.NewStateChange(byzcoin.Remove, instanceID,
+				ContractBEvmValueID, nil, nil))
+			if counted {
+				keyCount--
+			}
 			nbRemove++
+		case pv.deleted:
+			// Created and deleted again, nothing to do
+		case exists:
+			stateChanges = append(stateChanges, byzcoin.NewStateChange(byzcoin.Update, instanceID,
+				ContractBEvmValueID, pv.value, nil))
+			nbUpdate++
 		default:
-			return nil, nil, fmt.Errorf("Unknown StateChange action: %d", s.StateAction)
+			stateChanges = append(stateChanges, byzcoin.NewStateChange(byzcoin.Create, instanceID,
+				ContractBEvmValueID, pv.value, nil))
+			if counted {
+				keyCount++
+			}
+			nbCreate++
 		}
 	}
+
+	// Go maps traversal order is inherently non-deterministic, but the order
+	// of the changes must be deterministic to make ByzCoin happy
+	sort.SliceStable(stateChanges, func(i, j int) bool {
+		return string(stateChanges[i].Key()) < string(stateChanges[j].Key())
+	})
+
 	log.Lvlf2("%d state changes (%d Create, %d Update, %d Remove), %d entries in store",
-		len(db.stateChanges), nbCreate, nbUpdate, nbRemove, len(keyList))
+		len(stateChanges), nbCreate, nbUpdate, nbRemove, keyCount)
 
-	return db.stateChanges, keyList, nil
+	return stateChanges, keyCount, db.keyIndexSize, nil
 }
 
 // ethdb.Database interface implementation (server version)
@@ -215,19 +350,7 @@ func (db *ServerByzDatabase) Put(key []byte, value []byte) error {
 
 // Implements lowLevelDb.put()
 func (db *ServerByzDatabase) put(key []byte, value []byte) error {
-	instanceID := db.getValueInstanceID(key)
-	var sc byzcoin.StateChange
-
-	if _, ok := db.keyMap[string(key)]; ok {
-		sc = byzcoin.NewStateChange(byzcoin.Update, instanceID,
-			ContractBEvmValueID, value, nil)
-	} else {
-		sc = byzcoin.NewStateChange(byzcoin.Create, instanceID,
-			ContractBEvmValueID, value, nil)
-	}
-	db.keyMap[string(key)] = true
-
-	db.stateChanges = append(db.stateChanges, sc)
+	db.pending[string(key)] = &pendingValue{value: common.CopyBytes(value)}
 
 	return nil
 }
@@ -237,9 +360,15 @@ func (db *ServerByzDatabase) Has(key []byte) (bool, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	_, ok := db.keyMap[string(key)]
+	return db.has(key), nil
+}
+
+func (db *ServerByzDatabase) has(key []byte) bool {
+	if pv, ok := db.pending[string(key)]; ok {
+		return !pv.deleted
+	}
 
-	return ok, nil
+	return db.existsInTrie(key)
 }
 
 // Get implements Get()
@@ -247,6 +376,18 @@ func (db *ServerByzDatabase) Get(key []byte) ([]byte, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
+	return db.get(key)
+}
+
+func (db *ServerByzDatabase) get(key []byte) ([]byte, error) {
+	if pv, ok := db.pending[string(key)]; ok {
+		if pv.deleted {
+			return nil, fmt.Errorf("Key '%x' not found", key)
+		}
+
+		return pv.value, nil
+	}
+
 	instID := db.getValueInstanceID(key)
 
 	value, _, _, _, err := db.roStateTrie.GetValues(instID[:])
@@ -267,14 +408,7 @@ func (db *ServerByzDatabase) Delete(key []byte) error {
 
 // Implements lowLevelDb.delete()
 func (db *ServerByzDatabase) delete(key []byte) error {
-	instanceID := db.getValueInstanceID(key)
-
-	sc := byzcoin.NewStateChange(byzcoin.Remove, instanceID,
-		ContractBEvmValueID, nil, nil)
-
-	db.stateChanges = append(db.stateChanges, sc)
-
-	delete(db.keyMap, string(key))
+	db.pending[string(key)] = &pendingValue{deleted: true}
 
 	return nil
 }
@@ -0,0 +1,143 @@
+package bevm
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestNodeCache(t *testing.T) {
+	log.LLvl1("Node cache")
+
+	cache := NewNodeCache(2)
+
+	cache.put([]byte("a"), []byte("value a"))
+	cache.put([]byte("b"), []byte("value b"))
+
+	value, ok := cache.get([]byte("a"))
+	require.True(t, ok)
+	require.Equal(t, []byte("value a"), value)
+
+	// The oldest entry is evicted
+	cache.put([]byte("c"), []byte("value c"))
+
+	_, ok = cache.get([]byte("a"))
+	require.False(t, ok)
+	value, ok = cache.get([]byte("c"))
+	require.True(t, ok)
+	require.Equal(t, []byte("value c"), value)
+
+	// Entries cannot be modified
+	cache.put([]byte("c"), []byte("other value"))
+	value, ok = cache.get([]byte("c"))
+	require.True(t, ok)
+	require.Equal(t, []byte("value c"), value)
+}
+
+func TestContentAddressed(t *testing.T) {
+	log.LLvl1("Content-addressed entries")
+
+	value := []byte("trie node")
+	hash := crypto.Keccak256(value)
+
+	require.True(t, isContentAddressed(hash, value))
+	require.True(t, isContentAddressed(append(append([]byte{}, preimageKeyPrefix...), hash...), value))
+
+	require.False(t, isContentAddressed(hash, []byte("other value")))
+	require.False(t, isContentAddressed(getReceiptKey(crypto.Keccak256Hash(value)), value))
+	require.False(t, isContentAddressed(getKeyIndexKey(0), value))
+}
+
+func TestClientByzDatabase(t *testing.T) {
+	log.LLvl1("Client reads across blocks")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+	receipt, err := bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	cache := NewNodeCache(nodeCacheCapacity)
+	stateDb, _, _, err := getEvmDb(bct.cl, instanceID, cache)
+	require.Nil(t, err)
+
+	// A new block is added during the session
+	err = bevmClient.CreditAccount(big.NewInt(1*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	// The session still sees the state of its root
+	balance := stateDb.GetBalance(a.Address)
+	require.True(t, balance.Cmp(big.NewInt(5*WeiPerEther)) < 0)
+	require.NotEmpty(t, cache.entries)
+
+	stateDb, _, _, err = getEvmDb(bct.cl, instanceID, cache)
+	require.Nil(t, err)
+	require.Equal(t, new(big.Int).Add(balance, big.NewInt(1*WeiPerEther)), stateDb.GetBalance(a.Address))
+
+	// Entries which are not content-addressed are read at the latest block
+	byzDb, err := NewClientByzDatabase(instanceID, bct.cl)
+	require.Nil(t, err)
+	byzDb.SetCache(cache)
+
+	value, err := byzDb.Get(getReceiptKey(receipt.TxHash))
+	require.Nil(t, err)
+	require.NotEmpty(t, value)
+
+	// ...and are not cached
+	_, ok := cache.get(getReceiptKey(receipt.TxHash))
+	require.False(t, ok)
+
+	// A pinned session only reads them at its block
+	bs, proof, err := getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	byzDb, err = NewClientByzDatabase(instanceID, bct.cl)
+	require.Nil(t, err)
+	byzDb.Pin(bs.RootHash, &proof.Latest)
+
+	_, err = byzDb.Get(getReceiptKey(receipt.TxHash))
+	require.Nil(t, err)
+
+	err = bevmClient.CreditAccount(big.NewInt(1*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	_, err = byzDb.Get(getReceiptKey(receipt.TxHash))
+	require.NotNil(t, err)
+
+	// Pruning the state of a session makes its reads fail explicitly
+	bs, proof, err = getBEvmState(bct.cl, instanceID)
+	require.Nil(t, err)
+	byzDb, err = NewClientByzDatabase(instanceID, bct.cl)
+	require.Nil(t, err)
+	byzDb.Pin(bs.RootHash, &proof.Latest)
+
+	_, err = byzDb.Get(bs.RootHash.Bytes())
+	require.Nil(t, err)
+
+	err = bevmClient.CreditAccount(big.NewInt(1*WeiPerEther), a.Address)
+	require.Nil(t, err)
+	err = bevmClient.Prune()
+	require.Nil(t, err)
+
+	_, err = byzDb.Get(bs.RootHash.Bytes())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "pruned")
+}
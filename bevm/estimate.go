@@ -0,0 +1,184 @@
+package bevm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// Gas estimation of EVM transactions.
+//
+// As in go-ethereum's eth_estimateGas, the gas needed by a transaction is
+// determined by a binary search, executing the transaction with different gas
+// limits, each time on a throwaway copy of the EVM state. The gas limit is
+// capped by the query gas cap of the service, and by what the sender can pay,
+// given its balance and the gas price (at least the minimum gas price of the
+// instance). The search is aborted once its deadline has passed.
+
+// Execute an EVM message on a throwaway copy of the EVM state, and return
+// whether it succeeded. The precompiled contracts read the ByzCoin instances
+// using readInstance. The execution is aborted at the given deadline, and the
+// outcome of a successful execution is subject to the same checks as actual
+// transactions.
+func executeMessage(newStateDb func() (*state.StateDB, error), readInstance instanceReader, bi *blockInfo, p Params,
+	msg types.Message, deadline time.Time) (bool, error) {
+	stateDb, err := newStateDb()
+	if err != nil {
+		return false, err
+	}
+
+	// The nonce used for contract creation is the current one of the sender
+	nonce := stateDb.GetNonce(msg.From())
+
+	header := bi.header()
+	header.GasLimit = p.GasLimit
+
+	ctx := core.NewEVMContext(msg, header, byzChainContext{bi: bi}, &nilAddress)
+	evm := vm.NewEVM(ctx, stateDb, getChainConfig(p), getVMConfig())
+	gp := new(core.GasPool).AddGas(p.GasLimit)
+
+	unbind := bindPrecompileContext(readInstance)
+	checkAborted := abortAtDeadline(evm, deadline)
+	_, _, failed, err := core.ApplyMessage(evm, msg, gp)
+	abortErr := checkAborted()
+	unbind()
+	if abortErr != nil {
+		return false, abortErr
+	}
+	if hashErr := bi.checkHashLookups(); hashErr != nil {
+		return false, hashErr
+	}
+	if err != nil {
+		// Errors such as insufficient intrinsic gas or balance
+		log.Lvlf3("Gas estimation: %d gas: %v", msg.Gas(), err)
+		return false, nil
+	}
+	if failed {
+		return false, nil
+	}
+
+	// A transaction refused whatever its gas cannot be estimated
+	receipt := &types.Receipt{}
+	if msg.To() == nil {
+		receipt.ContractAddress = crypto.CreateAddress(msg.From(), nonce)
+	}
+	err = checkTxOutcome(stateDb, p, receipt, msg.To() == nil)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Compute the maximum amount of gas that the sender of a transaction can pay
+// for, once the value transferred is deducted from its balance
+func gasAllowance(stateDb *state.StateDB, from common.Address, value *big.Int, gasPrice *big.Int) (*big.Int, error) {
+	available := new(big.Int).Set(stateDb.GetBalance(from))
+	if value != nil {
+		if value.Cmp(available) > 0 {
+			return nil, errors.New("Insufficient funds for transfer")
+		}
+		available.Sub(available, value)
+	}
+
+	return available.Div(available, gasPrice), nil
+}
+
+// Estimate the gas needed by an EVM transaction (a contract deployment if
+// 'to' is nil), without exceeding the gas limit of the BEVM instance, the
+// query gas cap nor the allowance of the sender. A zero gas price stands for
+// the minimum gas price of the instance. The estimation fails once the
+// deadline has passed.
+func estimateGas(newStateDb func() (*state.StateDB, error), readInstance instanceReader, bi *blockInfo, p Params,
+	from common.Address, to *common.Address, value *big.Int, gasPrice *big.Int, data []byte,
+	deadline time.Time) (uint64, error) {
+	minGasPrice := new(big.Int).SetUint64(p.MinGasPrice)
+	if gasPrice == nil || gasPrice.Sign() == 0 {
+		gasPrice = minGasPrice
+	}
+	if gasPrice.Cmp(minGasPrice) < 0 {
+		return 0, fmt.Errorf("Gas price (%s) is lower than the minimum (%d)", gasPrice, p.MinGasPrice)
+	}
+
+	executable := func(gas uint64) (bool, error) {
+		msg := types.NewMessage(from, to, 0, value, gas, gasPrice, data, false)
+
+		return executeMessage(newStateDb, readInstance, bi, p, msg, deadline)
+	}
+
+	lo := params.TxGas - 1
+	hi := p.GasLimit
+	if hi > queryGasCap {
+		hi = queryGasCap
+	}
+	if hi <= lo {
+		return 0, errors.New("Gas limit of the BEVM instance is too low")
+	}
+
+	capped := false
+	if gasPrice.Sign() != 0 {
+		stateDb, err := newStateDb()
+		if err != nil {
+			return 0, err
+		}
+
+		allowance, err := gasAllowance(stateDb, from, value, gasPrice)
+		if err != nil {
+			return 0, err
+		}
+
+		if allowance.IsUint64() && allowance.Uint64() < hi {
+			hi = allowance.Uint64()
+			capped = true
+		}
+		if hi <= lo {
+			return 0, fmt.Errorf("Insufficient funds for gas * price + value: the sender can pay for %d gas", hi)
+		}
+	}
+	maxGas := hi
+
+	for lo+1 < hi {
+		mid := (lo + hi) / 2
+
+		ok, err := executable(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	// The transaction may fail whatever its gas
+	if hi == maxGas {
+		ok, err := executable(hi)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			if capped {
+				return 0, fmt.Errorf("Gas required exceeds the allowance of the sender (%d), "+
+					"or the transaction always fails", maxGas)
+			}
+
+			return 0, fmt.Errorf("Gas required exceeds the gas limit (%d), or the transaction always fails", maxGas)
+		}
+	}
+
+	log.Lvlf2("Estimated gas: %d", hi)
+
+	return hi, nil
+}
@@ -0,0 +1,83 @@
+package bevm
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestEstimateGas_Limits(t *testing.T) {
+	log.LLvl1("Gas estimation limits")
+
+	from := common.HexToAddress("0x1000")
+	loop := common.HexToAddress("0x2000")
+	gasHungry := common.HexToAddress("0x3000")
+
+	// GAS PUSH4 <cap> LT PUSH1 11 JUMPI INVALID JUMPDEST STOP: succeeds only
+	// with more gas than the query gas cap
+	gasHungryCode := []byte{0x5a, 0x63, 0, 0, 0, 0, 0x10, 0x60, 0x0b, 0x57, 0xfe, 0x5b, 0x00}
+	binary.BigEndian.PutUint32(gasHungryCode[2:6], uint32(queryGasCap))
+
+	stateDb, err := newEvmMemDb()
+	require.Nil(t, err)
+	stateDb.AddBalance(from, big.NewInt(1e9))
+	// JUMPDEST PUSH1 0 JUMP: endless loop
+	stateDb.SetCode(loop, []byte{0x5b, 0x60, 0x00, 0x56})
+	stateDb.SetCode(gasHungry, gasHungryCode)
+	root, err := stateDb.Commit(true)
+	require.Nil(t, err)
+
+	newStateDb := func() (*state.StateDB, error) {
+		return state.New(root, stateDb.Database())
+	}
+
+	bi := &blockInfo{
+		number:  big.NewInt(1),
+		getHash: func(uint64) common.Hash { return common.Hash{} },
+	}
+	p := Params{MinGasPrice: 2, MaxCodeSize: 10}.withDefaults(byzcoin.NewInstanceID(nil))
+
+	estimate := func(to *common.Address, gasPrice *big.Int, data []byte, deadline time.Time) (uint64, error) {
+		return estimateGas(newStateDb, nil, bi, p, from, to, big.NewInt(0), gasPrice, data, deadline)
+	}
+
+	// The gas searched does not exceed the query gas cap, although the gas
+	// limit of the instance is higher
+	_, err = estimate(&gasHungry, nil, nil, time.Time{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "exceeds the gas limit")
+
+	// The executions are aborted once the deadline has passed
+	_, err = estimate(&loop, nil, nil, time.Now())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "aborted")
+
+	// The minimum gas price of the instance is enforced, and used when no
+	// gas price is given
+	_, err = estimate(&from, big.NewInt(1), nil, time.Time{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "lower than the minimum")
+
+	gas, err := estimate(&from, nil, nil, time.Time{})
+	require.Nil(t, err)
+	require.Equal(t, uint64(21000), gas)
+
+	p.MinGasPrice = 1e6
+	_, err = estimate(&from, nil, nil, time.Time{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Insufficient funds")
+	p.MinGasPrice = 2
+
+	// The deployed code is subject to the maximum code size:
+	// PUSH1 100 PUSH1 0 RETURN
+	_, err = estimate(nil, nil, []byte{0x60, 0x64, 0x60, 0x00, 0xf3}, time.Time{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "code size")
+}
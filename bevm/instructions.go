@@ -0,0 +1,312 @@
+package bevm
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// ByzCoin instructions emitted by EVM contracts.
+//
+// A contract requests a ByzCoin instruction by emitting reserved events: one
+// ByzCoinArgument event per argument, followed by a ByzCoinInstruction event
+// giving the target instance and the action, in the darc format (e.g.
+// "invoke:coin.transfer"):
+//
+//   event ByzCoinArgument(string name, bytes value);
+//   event ByzCoinInstruction(bytes32 instanceID, string action);
+//
+// As events are discarded when the call emitting them is reverted, only the
+// instructions of the calls which succeed are executed, after the EVM
+// transaction.
+//
+// The instructions carry no signature: the authority to emit them is
+// delegated by the darc of the BEVM instance to individual EVM contracts. The
+// target instance must be governed by the same darc, whose rule for the
+// action must be satisfied by the identity of the emitting contract alone
+// (see EmitterIdentity()). Any EVM account can make the contract emit the
+// instruction: allowing a contract amounts to trusting its code to restrict
+// the instructions to the intended callers, as with the funds it holds.
+// Instructions on darcs and on the ByzCoin configuration cannot be emitted.
+//
+// The instances spawned by ByzCoin contracts get IDs derived from the
+// content of the instruction, which would be the same for identical
+// instructions. Each emitted spawn instruction therefore gets an additional
+// argument (EmitterArgument), identifying the EVM transaction, the emitting
+// contract and the position of the event.
+
+// ByzCoinArgumentTopic is the topic of the event providing an argument of a
+// ByzCoin instruction
+var ByzCoinArgumentTopic = crypto.Keccak256Hash([]byte("ByzCoinArgument(string,bytes)"))
+
+// ByzCoinInstructionTopic is the topic of the event requesting a ByzCoin
+// instruction
+var ByzCoinInstructionTopic = crypto.Keccak256Hash([]byte("ByzCoinInstruction(bytes32,string)"))
+
+// EmitterArgument is the name of the argument added to the spawn
+// instructions emitted by EVM contracts: the hash of the EVM transaction,
+// followed by the address of the emitting contract and the 8-byte position of
+// the event among the logs of the transaction (big-endian).
+const EmitterArgument = "bevmEmitter"
+
+// EmitterIdentity returns the darc identity of an EVM contract of a BEVM
+// instance, which the rules of the darc of the instance must contain to allow
+// the ByzCoin instructions emitted by this contract (e.g.
+// "invoke:coin.transfer" -> "bevm:<instance ID><contract address>").
+// This identity cannot sign ByzCoin transactions.
+func EmitterIdentity(bevmID byzcoin.InstanceID, contract common.Address) string {
+	return "bevm:" + hex.EncodeToString(bevmID.Slice()) + hex.EncodeToString(contract.Bytes())
+}
+
+// ByzCoin instruction emitted by an EVM contract
+type emittedInstruction struct {
+	byzcoin.Instruction
+	emitter common.Address // Address of the emitting contract
+}
+
+// Extract the ByzCoin instructions emitted by a successful EVM transaction
+func emittedInstructions(receipt *types.Receipt) ([]emittedInstruction, error) {
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return nil, nil
+	}
+
+	argumentArgs, err := newArguments("string", "bytes")
+	if err != nil {
+		return nil, err
+	}
+	instructionArgs, err := newArguments("bytes32", "string")
+	if err != nil {
+		return nil, err
+	}
+
+	// Arguments are collected separately for each emitting contract
+	pendingArgs := make(map[common.Address]byzcoin.Arguments)
+	var instrs []emittedInstruction
+
+	for i, l := range receipt.Logs {
+		if len(l.Topics) == 0 {
+			continue
+		}
+
+		switch l.Topics[0] {
+		case ByzCoinArgumentTopic:
+			values, err := argumentArgs.UnpackValues(l.Data)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ByzCoin argument event: %v", err)
+			}
+
+			pendingArgs[l.Address] = append(pendingArgs[l.Address], byzcoin.Argument{
+				Name:  values[0].(string),
+				Value: values[1].([]byte),
+			})
+
+		case ByzCoinInstructionTopic:
+			values, err := instructionArgs.UnpackValues(l.Data)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ByzCoin instruction event: %v", err)
+			}
+
+			instanceID := values[0].([32]byte)
+			instr, err := newEmittedInstruction(byzcoin.NewInstanceID(instanceID[:]),
+				values[1].(string), pendingArgs[l.Address])
+			if err != nil {
+				return nil, err
+			}
+			delete(pendingArgs, l.Address)
+
+			if instr.Spawn != nil {
+				if instr.Spawn.Args.Search(EmitterArgument) != nil {
+					return nil, fmt.Errorf("Reserved ByzCoin argument: '%s'", EmitterArgument)
+				}
+
+				origin := append(receipt.TxHash.Bytes(), l.Address.Bytes()...)
+				origin = append(origin, make([]byte, 8)...)
+				binary.BigEndian.PutUint64(origin[len(origin)-8:], uint64(i))
+				instr.Spawn.Args = append(instr.Spawn.Args, byzcoin.Argument{Name: EmitterArgument, Value: origin})
+			}
+
+			instrs = append(instrs, emittedInstruction{Instruction: instr, emitter: l.Address})
+		}
+	}
+
+	return instrs, nil
+}
+
+// Build a ByzCoin instruction from its action in the darc format
+func newEmittedInstruction(instanceID byzcoin.InstanceID, action string, args byzcoin.Arguments) (byzcoin.Instruction, error) {
+	instr := byzcoin.Instruction{InstanceID: instanceID}
+
+	parts := strings.SplitN(action, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return instr, fmt.Errorf("Invalid ByzCoin instruction action: '%s'", action)
+	}
+
+	switch parts[0] {
+	case "spawn":
+		instr.Spawn = &byzcoin.Spawn{ContractID: parts[1], Args: args}
+	case "invoke":
+		invoke := strings.SplitN(parts[1], ".", 2)
+		if len(invoke) != 2 || invoke[1] == "" {
+			return instr, fmt.Errorf("Invalid ByzCoin instruction action: '%s'", action)
+		}
+		instr.Invoke = &byzcoin.Invoke{ContractID: invoke[0], Command: invoke[1], Args: args}
+	case "delete":
+		instr.Delete = &byzcoin.Delete{ContractID: parts[1]}
+	default:
+		return instr, fmt.Errorf("Invalid ByzCoin instruction action: '%s'", action)
+	}
+
+	return instr, nil
+}
+
+// Return the contract ID of an instruction
+func instructionContractID(instr byzcoin.Instruction) string {
+	switch {
+	case instr.Spawn != nil:
+		return instr.Spawn.ContractID
+	case instr.Invoke != nil:
+		return instr.Invoke.ContractID
+	case instr.Delete != nil:
+		return instr.Delete.ContractID
+	default:
+		return ""
+	}
+}
+
+// Retrieve darcs from a ByzCoin state trie, given their identity string, to
+// evaluate darc expressions referring to other darcs
+func trieDarcGetter(rst byzcoin.ReadOnlyStateTrie) darc.GetDarc {
+	return func(id string, latest bool) *darc.Darc {
+		if !strings.HasPrefix(id, "darc:") {
+			return nil
+		}
+
+		darcID, err := hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+		if err != nil {
+			return nil
+		}
+
+		d, err := byzcoin.LoadDarcFromTrie(rst, darcID)
+		if err != nil {
+			return nil
+		}
+
+		return d
+	}
+}
+
+// Execute the ByzCoin instructions emitted by the EVM on behalf of a BEVM
+// instance, and return the resulting state changes and coins. Each
+// instruction sees the state changes of the previous ones.
+func (c *contractBEvm) executeEmittedInstructions(rst byzcoin.ReadOnlyStateTrie, bevmID byzcoin.InstanceID, darcID darc.ID,
+	instrs []emittedInstruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	if len(instrs) == 0 {
+		return nil, coins, nil
+	}
+
+	if c.service == nil {
+		return nil, nil, errors.New("Internal error: ByzCoin instructions cannot be executed without the service")
+	}
+
+	d, err := byzcoin.LoadDarcFromTrie(rst, darcID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stateChanges []byzcoin.StateChange
+
+	for i, instr := range instrs {
+		sc, cout, err := c.executeEmittedInstruction(rst, bevmID, d, instr, coins)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Emitted ByzCoin instruction #%d: %v", i, err)
+		}
+
+		rst, err = rst.StoreAllToReplica(sc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stateChanges = append(stateChanges, sc...)
+		coins = cout
+	}
+
+	return stateChanges, coins, nil
+}
+
+// Check and execute a single ByzCoin instruction emitted by the EVM
+func (c *contractBEvm) executeEmittedInstruction(rst byzcoin.ReadOnlyStateTrie, bevmID byzcoin.InstanceID, d *darc.Darc,
+	emitted emittedInstruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	instr := emitted.Instruction
+	contractID := instructionContractID(instr)
+
+	switch contractID {
+	case ContractBEvmID, ContractBEvmValueID:
+		// The EVM state must only be modified through the EVM
+		return nil, nil, fmt.Errorf("Instructions on '%s' instances cannot be emitted", contractID)
+	case byzcoin.ContractDarcID, byzcoin.ContractConfigID:
+		// The access control and the ledger configuration are out of reach
+		return nil, nil, fmt.Errorf("Instructions on '%s' instances cannot be emitted", contractID)
+	}
+
+	value, _, instContractID, instDarcID, err := rst.GetValues(instr.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !instDarcID.Equal(d.GetBaseID()) {
+		return nil, nil, fmt.Errorf("Instance '%s' is not governed by the darc of the BEVM instance", instr.InstanceID)
+	}
+
+	// The instruction carries no signature: the rule of the action is
+	// evaluated for the identity of the emitting contract, in place of the
+	// verification of the signers done by ByzCoin
+	action := instr.Action()
+	expr := d.Rules.Get(darc.Action(action))
+	if expr == nil {
+		return nil, nil, fmt.Errorf("Action '%s' is not allowed by the darc of the BEVM instance", action)
+	}
+
+	err = darc.EvalExpr(expr, trieDarcGetter(rst), EmitterIdentity(bevmID, emitted.emitter))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Action '%s' is not allowed to contract '%s' by the darc of the BEVM instance: %v",
+			action, emitted.emitter.Hex(), err)
+	}
+
+	if instr.Spawn != nil {
+		// Instances are spawned on a darc, whose content is not relevant
+		value = nil
+	} else if instContractID != contractID {
+		return nil, nil, fmt.Errorf("Instance '%s' is a '%s' instance, not a '%s' one",
+			instr.InstanceID, instContractID, contractID)
+	}
+
+	contractFn, exists := c.service.byzcoinService().GetContractConstructor(contractID)
+	if !exists {
+		return nil, nil, fmt.Errorf("Unknown contract '%s'", contractID)
+	}
+
+	contract, err := contractFn(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Lvlf2("Executing emitted ByzCoin instruction '%s' on instance '%s'", action, instr.InstanceID)
+
+	switch {
+	case instr.Spawn != nil:
+		return contract.Spawn(rst, instr, coins)
+	case instr.Invoke != nil:
+		return contract.Invoke(rst, instr, coins)
+	default:
+		return contract.Delete(rst, instr, coins)
+	}
+}
@@ -0,0 +1,194 @@
+package bevm
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"go.dedis.ch/protobuf"
+)
+
+// The key index keeps track of the keys contained in the EVM state database
+// of a BEVM instance, so that they can be enumerated (e.g. to prune obsolete
+// trie nodes) without the BEVM instance having to maintain their list.
+//
+// The index is an append-only list of keys, split into chunks of bounded size
+// stored in the EVM state database itself (and therefore in BEVM value
+// instances). Keys are appended when they are created; entries of keys that
+// have since been deleted are only dropped when the index is compacted.
+
+// Prefix of the EVM state database keys holding the key index chunks
+var keyIndexPrefix = []byte("bevm-key-index-")
+
+// Maximum number of keys in a key index chunk
+const keyIndexChunkSize = 256
+
+// Chunk of the key index
+type keyIndexChunk struct {
+	Keys [][]byte
+}
+
+// Compute the key of a key index chunk in the EVM state database
+func getKeyIndexKey(chunk uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, chunk)
+
+	return append(append([]byte{}, keyIndexPrefix...), buf...)
+}
+
+// Check whether a key of the EVM state database holds a key index chunk
+func isKeyIndexKey(key []byte) bool {
+	return bytes.HasPrefix(key, keyIndexPrefix)
+}
+
+// Return the number of key index chunks needed for the given number of entries
+func keyIndexChunks(size uint64) uint64 {
+	return (size + keyIndexChunkSize - 1) / keyIndexChunkSize
+}
+
+// Add existing keys which are missing from the key index, such as the keys of
+// legacy instances. They are indexed upon the next dump.
+func (db *ServerByzDatabase) addUnindexedKeys(keys [][]byte) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.unindexed = append(db.unindexed, keys...)
+}
+
+// Retrieve a key index chunk
+func (db *ServerByzDatabase) getKeyIndexChunk(chunk uint64) (*keyIndexChunk, error) {
+	data, err := db.get(getKeyIndexKey(chunk))
+	if err != nil {
+		return nil, err
+	}
+
+	var kic keyIndexChunk
+	err = protobuf.Decode(data, &kic)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kic, nil
+}
+
+// Store a key index chunk
+func (db *ServerByzDatabase) putKeyIndexChunk(chunk uint64, kic *keyIndexChunk) error {
+	data, err := protobuf.Encode(kic)
+	if err != nil {
+		return err
+	}
+
+	return db.put(getKeyIndexKey(chunk), data)
+}
+
+// Append keys to the key index. Only the last chunk of the index is read.
+func (db *ServerByzDatabase) appendToKeyIndex(keys [][]byte) error {
+	for len(keys) > 0 {
+		chunk := db.keyIndexSize / keyIndexChunkSize
+
+		kic := &keyIndexChunk{}
+		if db.keyIndexSize%keyIndexChunkSize != 0 {
+			var err error
+			kic, err = db.getKeyIndexChunk(chunk)
+			if err != nil {
+				return err
+			}
+		}
+
+		n := keyIndexChunkSize - len(kic.Keys)
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		kic.Keys = append(kic.Keys, keys[:n]...)
+		err := db.putKeyIndexChunk(chunk, kic)
+		if err != nil {
+			return err
+		}
+
+		db.keyIndexSize += uint64(n)
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+// Retrieve the entries of a range of chunks of the key index
+func (db *ServerByzDatabase) readKeyIndex(fromChunk, toChunk uint64) ([][]byte, error) {
+	var keys [][]byte
+
+	for chunk := fromChunk; chunk < toChunk; chunk++ {
+		kic, err := db.getKeyIndexChunk(chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, kic.Keys...)
+	}
+
+	return keys, nil
+}
+
+// Replace the whole content of the key index
+func (db *ServerByzDatabase) rewriteKeyIndex(keys [][]byte) error {
+	oldChunks := keyIndexChunks(db.keyIndexSize)
+
+	db.keyIndexSize = 0
+	err := db.appendToKeyIndex(keys)
+	if err != nil {
+		return err
+	}
+
+	// Remove the chunks which are not used anymore
+	for chunk := keyIndexChunks(db.keyIndexSize); chunk < oldChunks; chunk++ {
+		err = db.delete(getKeyIndexKey(chunk))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove the keys recorded in the last chunks of the key index, along with
+// these chunks, and return whether the key index is now empty
+func (db *ServerByzDatabase) deleteIndexedKeys(maxChunks uint64) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	err := db.appendToKeyIndex(db.unindexed)
+	if err != nil {
+		return false, err
+	}
+	db.unindexed = nil
+
+	nbChunks := keyIndexChunks(db.keyIndexSize)
+	fromChunk := uint64(0)
+	if nbChunks > maxChunks {
+		fromChunk = nbChunks - maxChunks
+	}
+
+	keys, err := db.readKeyIndex(fromChunk, nbChunks)
+	if err != nil {
+		return false, err
+	}
+
+	for _, key := range keys {
+		if db.has(key) {
+			err = db.delete(key)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	for chunk := fromChunk; chunk < nbChunks; chunk++ {
+		err = db.delete(getKeyIndexKey(chunk))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	db.keyIndexSize = fromChunk * keyIndexChunkSize
+
+	return fromChunk == 0, nil
+}
@@ -0,0 +1,415 @@
+package bevm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+)
+
+// EVM blocks and logs, as seen by Ethereum tools.
+//
+// The EVM transactions executed by the instructions of a ByzCoin block form
+// the EVM block whose number is the index of the ByzCoin block, and whose
+// hash is the hash of the ByzCoin block. As the EVM logs are only stored
+// within the receipts, the receipts are indexed by EVM block when they are
+// stored, whatever executed the transaction (an instruction of the BEVM
+// instance, or another contract through the Go API of the service). The BEVM
+// service retrieves the receipts of a range of EVM blocks in a single
+// request. The ByzCoin blocks preceding the index are instead scanned for the
+// transactions of the instance.
+
+// Maximum number of blocks covered by a single log query
+const maxLogQueryBlocks = 1000
+
+// Prefix of the EVM state database keys holding the index of the receipts of
+// an EVM block
+var blockIndexKeyPrefix = []byte("bevm-block-")
+
+// Index of the receipts of an EVM block: the hashes of its transactions, in
+// the order of their execution
+type blockTxIndex struct {
+	TxHashes [][]byte
+}
+
+// Compute the key of the index of the receipts of an EVM block in the EVM
+// state database
+func getBlockIndexKey(number uint64) []byte {
+	key := make([]byte, len(blockIndexKeyPrefix)+8)
+	copy(key, blockIndexKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(blockIndexKeyPrefix):], number)
+
+	return key
+}
+
+// Load the index of the receipts of an EVM block, or nil if there is none
+func loadBlockIndex(stateDb *state.StateDB, number uint64) (*blockTxIndex, error) {
+	db := stateDb.Database().TrieDB().DiskDB()
+	key := getBlockIndexKey(number)
+
+	found, err := db.Has(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	indexData, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var index blockTxIndex
+	err = protobuf.Decode(indexData, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+// Add a transaction to the index of the receipts of an EVM block
+func indexReceipt(stateDb *state.StateDB, number uint64, txHash common.Hash) error {
+	index, err := loadBlockIndex(stateDb, number)
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		index = &blockTxIndex{}
+	}
+
+	index.TxHashes = append(index.TxHashes, txHash.Bytes())
+
+	indexData, err := protobuf.Encode(index)
+	if err != nil {
+		return err
+	}
+
+	db, ok := stateDb.Database().TrieDB().DiskDB().(ethdb.Putter)
+	if !ok {
+		return errors.New("Internal error: EVM State DB is not writable")
+	}
+
+	return db.Put(getBlockIndexKey(number), indexData)
+}
+
+// Retrieve the hashes of the EVM transactions of the EVM block formed by a
+// ByzCoin block, in the order of their execution
+func blockTxHashes(stateDb *state.StateDB, sb *skipchain.SkipBlock, instanceID byzcoin.InstanceID) ([]common.Hash, error) {
+	index, err := loadBlockIndex(stateDb, uint64(sb.Index))
+	if err != nil {
+		return nil, err
+	}
+
+	if index == nil {
+		// Blocks preceding the index
+		return payloadTxHashes(sb, instanceID)
+	}
+
+	var txHashes []common.Hash
+	for _, txHash := range index.TxHashes {
+		txHashes = append(txHashes, common.BytesToHash(txHash))
+	}
+
+	return txHashes, nil
+}
+
+// Retrieve the hashes of the EVM transactions executed by the instructions of
+// a BEVM instance in the accepted ByzCoin transactions of a block
+func payloadTxHashes(sb *skipchain.SkipBlock, instanceID byzcoin.InstanceID) ([]common.Hash, error) {
+	var body byzcoin.DataBody
+	err := protobuf.Decode(sb.Payload, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	var txHashes []common.Hash
+
+	for _, txResult := range body.TxResults {
+		if !txResult.Accepted {
+			continue
+		}
+
+		for _, instr := range txResult.ClientTransaction.Instructions {
+			if !instr.InstanceID.Equal(instanceID) || instr.Invoke == nil ||
+				instr.Invoke.ContractID != ContractBEvmID {
+				continue
+			}
+
+			switch instr.Invoke.Command {
+			case "transaction", "transactions", "withdraw":
+			default:
+				continue
+			}
+
+			for _, arg := range instr.Invoke.Args {
+				if arg.Name != "tx" {
+					continue
+				}
+
+				var tx types.Transaction
+				err = tx.UnmarshalJSON(arg.Value)
+				if err != nil {
+					return nil, err
+				}
+
+				txHashes = append(txHashes, tx.Hash())
+			}
+		}
+	}
+
+	return txHashes, nil
+}
+
+// BlockReceipts returns the receipts of the EVM transactions of a range of
+// EVM blocks of a BEVM instance
+func (s *Service) BlockReceipts(req *BlockReceiptsRequest) (*BlockReceiptsResponse, error) {
+	if req.ToBlock < req.FromBlock || req.ToBlock-req.FromBlock >= maxLogQueryBlocks {
+		return nil, fmt.Errorf("Invalid range of blocks [%d, %d], which cannot span more than %d blocks",
+			req.FromBlock, req.ToBlock, maxLogQueryBlocks)
+	}
+
+	bs, proof, rst, err := s.getBEvmStateWithProof(req.ByzCoinID, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ToBlock > uint64(rst.GetIndex()) {
+		return nil, fmt.Errorf("Block %d follows the latest block (%d)", req.ToBlock, rst.GetIndex())
+	}
+
+	stateDb, err := NewEvmDb(bs, rst, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+	db := stateDb.Database().TrieDB().DiskDB()
+
+	resp := &BlockReceiptsResponse{Proof: *proof}
+
+	for number := req.FromBlock; number <= req.ToBlock; number++ {
+		sb, err := s.getBlockByIndex(req.ByzCoinID, int(number))
+		if err != nil {
+			return nil, err
+		}
+
+		txHashes, err := blockTxHashes(stateDb, sb, req.BEvmID)
+		if err != nil {
+			return nil, err
+		}
+
+		block := BlockReceipts{Hash: sb.Hash}
+		for _, txHash := range txHashes {
+			receiptData, err := db.Get(getReceiptKey(txHash))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot retrieve the receipt of EVM transaction '%s': %v", txHash.Hex(), err)
+			}
+
+			block.Receipts = append(block.Receipts, receiptData)
+		}
+
+		resp.Blocks = append(resp.Blocks, block)
+	}
+
+	return resp, nil
+}
+
+// EVM block, with the receipts of its transactions
+type evmBlock struct {
+	number   uint64
+	hash     common.Hash
+	receipts []*types.Receipt
+}
+
+// Retrieve the EVM blocks in the given range, with their receipts, from the
+// BEVM service of a conode
+func (client *Client) getBlocks(from uint64, to uint64) ([]evmBlock, error) {
+	var resp BlockReceiptsResponse
+	err := client.sendRequest(&BlockReceiptsRequest{
+		ByzCoinID: client.bcClient.ID,
+		BEvmID:    client.instanceID,
+		FromBlock: from,
+		ToBlock:   to,
+	}, &resp, &resp.Proof, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(resp.Blocks)) != to-from+1 {
+		return nil, fmt.Errorf("Expected %d blocks, got %d", to-from+1, len(resp.Blocks))
+	}
+
+	var blocks []evmBlock
+
+	for i, blockReceipts := range resp.Blocks {
+		block := evmBlock{
+			number: from + uint64(i),
+			hash:   common.BytesToHash(blockReceipts.Hash),
+		}
+
+		for _, receiptData := range blockReceipts.Receipts {
+			receipt, err := decodeReceipt(receiptData)
+			if err != nil {
+				return nil, err
+			}
+
+			block.receipts = append(block.receipts, receipt)
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// BlockNumber returns the number of the latest EVM block, i.e. the index of
+// the latest ByzCoin block
+func (client *Client) BlockNumber() (uint64, error) {
+	_, proof, err := getBEvmState(client.bcClient, client.instanceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(proof.Latest.Index), nil
+}
+
+// BlockTransactions returns the hash of the EVM block with the given number,
+// along with the hashes of the EVM transactions it contains, in the order of
+// their execution
+func (client *Client) BlockTransactions(number uint64) (common.Hash, []common.Hash, error) {
+	blocks, err := client.getBlocks(number, number)
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+
+	var txHashes []common.Hash
+	for _, receipt := range blocks[0].receipts {
+		txHashes = append(txHashes, receipt.TxHash)
+	}
+
+	return blocks[0].hash, txHashes, nil
+}
+
+// GetLogs returns the logs of the EVM transactions matching the given query.
+// As for Ethereum, a missing (or negative) block number stands for the latest
+// block.
+func (client *Client) GetLogs(query ethereum.FilterQuery) ([]*types.Log, error) {
+	var from, to uint64
+
+	if query.BlockHash != nil {
+		sb, err := skipchain.NewClient().GetSingleBlock(&client.bcClient.Roster, query.BlockHash.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if !sb.SkipChainID().Equal(client.bcClient.ID) {
+			return nil, fmt.Errorf("Block '%s' is not part of the ledger", query.BlockHash.Hex())
+		}
+
+		from, to = uint64(sb.Index), uint64(sb.Index)
+	} else {
+		latest, err := client.BlockNumber()
+		if err != nil {
+			return nil, err
+		}
+
+		from, to = latest, latest
+		if query.FromBlock != nil && query.FromBlock.Sign() >= 0 {
+			from = query.FromBlock.Uint64()
+		}
+		if query.ToBlock != nil && query.ToBlock.Sign() >= 0 {
+			to = query.ToBlock.Uint64()
+		}
+		if to > latest {
+			to = latest
+		}
+		if from > to {
+			return nil, nil
+		}
+		if to-from >= maxLogQueryBlocks {
+			return nil, fmt.Errorf("Log queries cannot span more than %d blocks", maxLogQueryBlocks)
+		}
+	}
+
+	blocks, err := client.getBlocks(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.BlockHash != nil && blocks[0].hash != *query.BlockHash {
+		return nil, fmt.Errorf("Block %d is not '%s'", from, query.BlockHash.Hex())
+	}
+
+	var logs []*types.Log
+
+	for _, block := range blocks {
+		logIndex := uint(0)
+		for txIndex, receipt := range block.receipts {
+			for _, l := range receipt.Logs {
+				l.BlockNumber = block.number
+				l.BlockHash = block.hash
+				l.TxHash = receipt.TxHash
+				l.TxIndex = uint(txIndex)
+				l.Index = logIndex
+				logIndex++
+
+				if matchLog(l, query.Addresses, query.Topics) {
+					logs = append(logs, l)
+				}
+			}
+		}
+	}
+
+	log.Lvlf2("Found %d logs in %d blocks", len(logs), len(blocks))
+
+	return logs, nil
+}
+
+// Check whether a log matches the given addresses and topics, following the
+// Ethereum filter rules: an empty list matches anything, and each position of
+// the topics lists the alternatives accepted
+func matchLog(l *types.Log, addresses []common.Address, topics [][]common.Hash) bool {
+	if len(addresses) > 0 {
+		found := false
+		for _, address := range addresses {
+			if l.Address == address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(topics) > len(l.Topics) {
+		return false
+	}
+
+	for i, alternatives := range topics {
+		if len(alternatives) == 0 {
+			continue
+		}
+
+		found := false
+		for _, topic := range alternatives {
+			if l.Topics[i] == topic {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
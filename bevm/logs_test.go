@@ -0,0 +1,26 @@
+package bevm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchLog(t *testing.T) {
+	address := common.HexToAddress("0x1000")
+	topicA := common.HexToHash("0xa")
+	topicB := common.HexToHash("0xb")
+	l := &types.Log{Address: address, Topics: []common.Hash{topicA, topicB}}
+
+	require.True(t, matchLog(l, nil, nil))
+	require.True(t, matchLog(l, []common.Address{common.HexToAddress("0x2000"), address}, nil))
+	require.False(t, matchLog(l, []common.Address{common.HexToAddress("0x2000")}, nil))
+
+	// Topics are matched by position, an empty position matching anything
+	require.True(t, matchLog(l, nil, [][]common.Hash{{topicA}}))
+	require.True(t, matchLog(l, nil, [][]common.Hash{nil, {topicA, topicB}}))
+	require.False(t, matchLog(l, nil, [][]common.Hash{{topicB}}))
+	require.False(t, matchLog(l, nil, [][]common.Hash{nil, nil, nil}))
+}
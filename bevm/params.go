@@ -1,26 +1,274 @@
 package bevm
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/params"
+	"go.dedis.ch/cothority/v3/byzcoin"
 )
 
-func getChainConfig() *params.ChainConfig {
+// Params contains the configurable parameters of a BEVM instance.
+// A zero value denotes the default value of the parameter at spawn time, and
+// leaves the parameter unchanged when updating it.
+type Params struct {
+	ChainID     uint64   // EIP-155 chain ID of the EVM, protecting against transaction replay
+	Forks       []string // Names of the enabled Ethereum forks
+	GasLimit    uint64   // Block gas limit, i.e. maximum gas available to a single instruction
+	MinGasPrice uint64   // Minimum gas price of accepted EVM transactions
+	MaxCodeSize uint64   // Maximum code size of deployed EVM contracts
+
+	FeePolicy    string         // What happens to gas fees: "burn", "treasury" or "roster"
+	FeeTreasury  common.Address // Recipient of gas fees with the "treasury" policy
+	FeeAddresses []FeeAddress   // Recipients of the gas fees of the conodes with the "roster" policy
+}
+
+// FeeAddress designates the EVM address receiving the share of the gas fees
+// of a conode with the "roster" policy, whose owner can spend them
+type FeeAddress struct {
+	Conode  string         // Public key of the conode, as given by its ServerIdentity
+	Address common.Address // Address controlled by the conode operator
+}
+
+// Gas fee policies
+const (
+	// FeePolicyBurn destroys the gas fees
+	FeePolicyBurn = "burn"
+	// FeePolicyTreasury sends the gas fees to a treasury EVM address
+	FeePolicyTreasury = "treasury"
+	// FeePolicyRoster splits the gas fees among the conodes of the current
+	// ByzCoin roster, sending them to the fee addresses of the conodes
+	FeePolicyRoster = "roster"
+)
+
+// Names of the Ethereum forks that can be enabled on a BEVM instance
+var forkNames = []string{
+	"homestead",
+	"eip150",
+	"eip155",
+	"eip158",
+	"byzantium",
+	"constantinople",
+	"petersburg",
+}
+
+// Ethereum forks enabled by default
+var defaultForks = []string{"homestead", "eip155", "eip158", "byzantium", "constantinople"}
+
+// Default block gas limit
+const defaultGasLimit = uint64(1e18)
+
+// Range of the default EVM chain IDs, [2^30, 2^31): never 0, above the chain
+// IDs of the public Ethereum networks, and within the ones supported by
+// Ethereum tools
+const (
+	defaultChainIDBase = uint64(1) << 30
+	defaultChainIDMask = defaultChainIDBase - 1
+)
+
+// Compute the default EVM chain ID of a BEVM instance
+func defaultChainID(instanceID byzcoin.InstanceID) uint64 {
+	// Derived from the instance ID, so that each instance gets its own chain
+	// ID, and mapped into the range reserved to BEVM instances.
+	return defaultChainIDBase | uint64(binary.BigEndian.Uint32(instanceID[:4]))&defaultChainIDMask
+}
+
+// Return the parameters with the default values filled in
+func (p Params) withDefaults(instanceID byzcoin.InstanceID) Params {
+	if p.ChainID == 0 {
+		p.ChainID = defaultChainID(instanceID)
+	}
+	if len(p.Forks) == 0 {
+		p.Forks = defaultForks
+	}
+	if p.GasLimit == 0 {
+		p.GasLimit = defaultGasLimit
+	}
+	if p.MaxCodeSize == 0 {
+		p.MaxCodeSize = params.MaxCodeSize
+	}
+	if p.FeePolicy == "" {
+		p.FeePolicy = FeePolicyBurn
+	}
+
+	return p
+}
+
+// Check the consistency of the parameters
+func (p Params) validate() error {
+	if p.ChainID == 0 {
+		return errors.New("Invalid chain ID: 0")
+	}
+
+	for _, fork := range p.Forks {
+		if !contains(forkNames, fork) {
+			return fmt.Errorf("Unknown fork: '%s'", fork)
+		}
+	}
+	// Replay protection relies on EIP-155
+	if !p.hasFork("eip155") {
+		return errors.New("The 'eip155' fork cannot be disabled")
+	}
+
+	if p.GasLimit == 0 {
+		return errors.New("Invalid gas limit: 0")
+	}
+
+	// The EVM enforces the EIP-170 limit on its own
+	if p.MaxCodeSize > params.MaxCodeSize {
+		return fmt.Errorf("Maximum code size cannot exceed %d", params.MaxCodeSize)
+	}
+
+	for _, feeAddress := range p.FeeAddresses {
+		if feeAddress.Conode == "" || feeAddress.Address == (common.Address{}) {
+			return errors.New("Fee addresses require a conode and an address")
+		}
+	}
+
+	switch p.FeePolicy {
+	case FeePolicyBurn:
+	case FeePolicyTreasury:
+		if p.FeeTreasury == (common.Address{}) {
+			return errors.New("The 'treasury' fee policy requires a treasury address")
+		}
+	case FeePolicyRoster:
+		if len(p.FeeAddresses) == 0 {
+			return errors.New("The 'roster' fee policy requires the fee addresses of the conodes")
+		}
+	default:
+		return fmt.Errorf("Unknown fee policy: '%s'", p.FeePolicy)
+	}
+
+	return nil
+}
+
+// Retrieve the fee address of a conode, given its public key
+func (p Params) feeAddress(conode string) (common.Address, bool) {
+	for _, feeAddress := range p.FeeAddresses {
+		if feeAddress.Conode == conode {
+			return feeAddress.Address, true
+		}
+	}
+
+	return common.Address{}, false
+}
+
+// Check whether a fork is enabled
+func (p Params) hasFork(name string) bool {
+	return contains(p.Forks, name)
+}
+
+func contains(list []string, name string) bool {
+	for _, elem := range list {
+		if elem == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Update the parameters from the instruction arguments. Parameters for which
+// no argument is provided are left unchanged.
+func (p Params) updateFromArgs(args byzcoin.Arguments) (Params, error) {
+	getUint64 := func(name string, value *uint64) {
+		if arg := args.Search(name); arg != nil {
+			*value = new(big.Int).SetBytes(arg).Uint64()
+		}
+	}
+
+	getUint64("chainID", &p.ChainID)
+	getUint64("gasLimit", &p.GasLimit)
+	getUint64("minGasPrice", &p.MinGasPrice)
+	getUint64("maxCodeSize", &p.MaxCodeSize)
+
+	if arg := args.Search("forks"); arg != nil {
+		p.Forks = strings.Split(string(arg), ",")
+	}
+	if arg := args.Search("feePolicy"); arg != nil {
+		p.FeePolicy = string(arg)
+	}
+	if arg := args.Search("feeTreasury"); arg != nil {
+		p.FeeTreasury = common.BytesToAddress(arg)
+	}
+	if arg := args.Search("feeAddresses"); arg != nil {
+		var feeAddresses []FeeAddress
+		err := json.Unmarshal(arg, &feeAddresses)
+		if err != nil {
+			return p, errors.New("Invalid fee addresses: " + err.Error())
+		}
+		p.FeeAddresses = feeAddresses
+	}
+
+	return p, nil
+}
+
+// ToArguments encodes the parameters into instruction arguments. Only the
+// parameters set (non-zero) are encoded, so that the other ones keep their
+// current (or default) value.
+func (p Params) ToArguments() byzcoin.Arguments {
+	var args byzcoin.Arguments
+
+	addUint64 := func(name string, value uint64) {
+		if value != 0 {
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, value)
+			args = append(args, byzcoin.Argument{Name: name, Value: buf})
+		}
+	}
+
+	addUint64("chainID", p.ChainID)
+	addUint64("gasLimit", p.GasLimit)
+	addUint64("minGasPrice", p.MinGasPrice)
+	addUint64("maxCodeSize", p.MaxCodeSize)
+
+	if len(p.Forks) != 0 {
+		args = append(args, byzcoin.Argument{Name: "forks", Value: []byte(strings.Join(p.Forks, ","))})
+	}
+	if p.FeePolicy != "" {
+		args = append(args, byzcoin.Argument{Name: "feePolicy", Value: []byte(p.FeePolicy)})
+	}
+	if p.FeeTreasury != (common.Address{}) {
+		args = append(args, byzcoin.Argument{Name: "feeTreasury", Value: p.FeeTreasury.Bytes()})
+	}
+	if len(p.FeeAddresses) != 0 {
+		// Cannot fail, as the fields are strings and addresses
+		feeAddresses, _ := json.Marshal(p.FeeAddresses)
+		args = append(args, byzcoin.Argument{Name: "feeAddresses", Value: feeAddresses})
+	}
+
+	return args
+}
+
+func getChainConfig(p Params) *params.ChainConfig {
+	// Returns block 0 if the fork is enabled, nil otherwise
+	forkBlock := func(name string) *big.Int {
+		if p.hasFork(name) {
+			return big.NewInt(0)
+		}
+
+		return nil
+	}
+
 	///ChainConfig (adapted from Rinkeby test net)
 	chainconfig := &params.ChainConfig{
-		ChainID:             big.NewInt(1),
-		HomesteadBlock:      big.NewInt(0),
+		ChainID:             new(big.Int).SetUint64(p.ChainID), // EIP-155 chain ID of the BEVM instance
+		HomesteadBlock:      forkBlock("homestead"),
 		DAOForkBlock:        nil,
 		DAOForkSupport:      false,
-		EIP150Block:         nil,
+		EIP150Block:         forkBlock("eip150"),
 		EIP150Hash:          common.HexToHash("0x0000000000000000000000000000000000000000"),
-		EIP155Block:         big.NewInt(0),
-		EIP158Block:         big.NewInt(0),
-		ByzantiumBlock:      big.NewInt(0),
-		ConstantinopleBlock: big.NewInt(0), // Enable new Constantinople instructions
+		EIP155Block:         forkBlock("eip155"),
+		EIP158Block:         forkBlock("eip158"),
+		ByzantiumBlock:      forkBlock("byzantium"),
+		ConstantinopleBlock: forkBlock("constantinople"), // Enable new Constantinople instructions
+		PetersburgBlock:     forkBlock("petersburg"),
 		Clique: &params.CliqueConfig{
 			Period: 15,
 			Epoch:  30000,
@@ -54,18 +302,18 @@ func getVMConfig() vm.Config {
 	return *vmconfig
 }
 
-func getContext() vm.Context {
+func getContext(bi *blockInfo, p Params) vm.Context {
 	placeHolder := common.HexToAddress("0")
 	return vm.Context{
 		CanTransfer: func(vm.StateDB, common.Address, *big.Int) bool { return true },
 		Transfer:    func(vm.StateDB, common.Address, common.Address, *big.Int) {},
-		GetHash:     func(uint64) common.Hash { return common.HexToHash("0") },
+		GetHash:     bi.getHash,
 		Origin:      placeHolder,
 		GasPrice:    big.NewInt(0),
 		Coinbase:    placeHolder,
-		GasLimit:    10000000000,
-		BlockNumber: big.NewInt(0),
-		Time:        big.NewInt(1),
+		GasLimit:    p.GasLimit,
+		BlockNumber: bi.number,
+		Time:        new(big.Int).SetUint64(bi.timestamp),
 		Difficulty:  big.NewInt(1),
 	}
 
@@ -9,6 +9,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"go.dedis.ch/cothority/v3/byzcoin"
 	"go.dedis.ch/onet/v3/log"
 )
 
@@ -77,7 +78,7 @@ func TestTokenContract(t *testing.T) {
 	ctx := vm.Context{CanTransfer: canTransfer, Transfer: transfer, GetHash: getHash, Origin: addressA, GasPrice: big.NewInt(1), Coinbase: addressA, GasLimit: 10000000000, BlockNumber: big.NewInt(0), Time: big.NewInt(1), Difficulty: big.NewInt(1)}
 
 	// Set up the Byzcoin Virtual Machine, a copy of EVM with our parameters
-	bevm := vm.NewEVM(ctx, sdb, getChainConfig(), getVMConfig())
+	bevm := vm.NewEVM(ctx, sdb, getChainConfig(Params{ChainID: 1, Forks: defaultForks}), getVMConfig())
 
 	// Contract deployment
 	_, addrContract, leftOverGas, err := bevm.Create(accountRef, contract.Bytecode, 100000000, big.NewInt(0))
@@ -139,3 +140,47 @@ func TestTokenContract(t *testing.T) {
 	log.Lvl2(addressB.Hex(), "address, token balance :", balance)
 	require.Equal(t, balance, uint64(2))
 }
+
+func TestDefaultChainID(t *testing.T) {
+	// The default chain ID is in the reserved range, whatever the instance ID
+	for _, prefix := range [][]byte{{0, 0, 0, 0}, {0, 0, 0, 1}, {0x40, 0, 0, 0}, {0xff, 0xff, 0xff, 0xff}} {
+		var instanceID byzcoin.InstanceID
+		copy(instanceID[:], prefix)
+
+		chainID := defaultChainID(instanceID)
+		require.True(t, chainID >= 1<<30 && chainID < 1<<31, "chain ID %d", chainID)
+		require.Nil(t, Params{}.withDefaults(instanceID).validate())
+	}
+
+	// Different instances get different chain IDs
+	require.NotEqual(t, defaultChainID(byzcoin.NewInstanceID([]byte{0, 0, 0, 1})),
+		defaultChainID(byzcoin.NewInstanceID([]byte{0, 0, 0, 2})))
+}
+
+func TestParams_ToArguments(t *testing.T) {
+	current := Params{ChainID: 1234, GasLimit: 1e9, MinGasPrice: 2, FeePolicy: FeePolicyBurn}
+
+	// Only the parameters set are encoded, the other ones are unchanged
+	args := Params{MinGasPrice: 1}.ToArguments()
+	require.Len(t, args, 1)
+
+	updated, err := current.updateFromArgs(args)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1234), updated.ChainID)
+	require.Equal(t, uint64(1e9), updated.GasLimit)
+	require.Equal(t, uint64(1), updated.MinGasPrice)
+	require.Equal(t, FeePolicyBurn, updated.FeePolicy)
+
+	// Setting all the parameters replaces them
+	all := Params{ChainID: 5678, Forks: defaultForks, GasLimit: 1e6, MinGasPrice: 3, MaxCodeSize: 1000,
+		FeePolicy: FeePolicyTreasury, FeeTreasury: common.HexToAddress("0x1234"),
+		FeeAddresses: []FeeAddress{{Conode: "conode", Address: common.HexToAddress("0x5678")}}}
+	updated, err = current.updateFromArgs(all.ToArguments())
+	require.Nil(t, err)
+	require.Equal(t, all, updated)
+
+	// The roster fee policy requires fee addresses
+	require.NotNil(t, Params{ChainID: 1, Forks: defaultForks, GasLimit: 1, FeePolicy: FeePolicyRoster}.validate())
+	require.Nil(t, Params{ChainID: 1, Forks: defaultForks, GasLimit: 1, FeePolicy: FeePolicyRoster,
+		FeeAddresses: all.FeeAddresses}.validate())
+}
@@ -0,0 +1,283 @@
+package bevm
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/group/edwards25519"
+	"go.dedis.ch/kyber/v3/pairing"
+	"go.dedis.ch/kyber/v3/sign/bls"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// Precompiled contracts specific to the BEVM.
+//
+// In the version of go-ethereum we use, precompiled contracts are looked up
+// in global tables and do not have access to the context of the EVM executing
+// them. They are therefore registered globally (which also affects any other
+// EVM running in the same process), and the ByzCoin information they need is
+// bound for the whole duration of each EVM execution. As a precompiled
+// contract cannot tell which EVM runs it, a single execution is bound at a
+// time: the EVM executions using the BEVM precompiled contracts (ByzCoin
+// instructions as well as client queries) are serialized.
+
+// ByzCoinReaderAddress is the address of the precompiled contract reading
+// ByzCoin instances.
+//
+// Input: the 32-byte ID of a ByzCoin instance.
+// Output: the ABI encoding of (bool exists, bytes value, string contractID,
+// bytes32 darcID).
+var ByzCoinReaderAddress = common.HexToAddress("0x0000000000000000000000000000000000000100")
+
+// Gas costs of the ByzCoin instance reader
+const (
+	byzcoinReaderBaseGas    = 2000
+	byzcoinReaderPerWordGas = 3
+)
+
+// Ed25519VerifyAddress is the address of the precompiled contract verifying
+// Ed25519 signatures, as used by ByzCoin darc identities.
+//
+// Input: the 32-byte public key, followed by the 64-byte signature, followed
+// by the signed message.
+// Output: a 32-byte word equal to 1 if the signature is valid, 0 otherwise.
+var Ed25519VerifyAddress = common.HexToAddress("0x0000000000000000000000000000000000000101")
+
+// BlsVerifyAddress is the address of the precompiled contract verifying BLS
+// signatures on the bn256 curve, as used by conodes.
+//
+// Input: the 128-byte public key (G2 point), followed by the 64-byte
+// signature (G1 point), followed by the signed message.
+// Output: a 32-byte word equal to 1 if the signature is valid, 0 otherwise.
+var BlsVerifyAddress = common.HexToAddress("0x0000000000000000000000000000000000000102")
+
+// Gas costs of the signature verification, in line with the ones of
+// 'ecrecover' and of the bn256 pairing check of two points
+const (
+	ed25519VerifyGas = 3000
+	blsVerifyGas     = 260000
+)
+
+func init() {
+	registerPrecompile(ByzCoinReaderAddress, &byzcoinReader{})
+	registerPrecompile(Ed25519VerifyAddress, &ed25519Verify{})
+	registerPrecompile(BlsVerifyAddress, &blsVerify{})
+}
+
+// Register a precompiled contract for all the Ethereum forks
+func registerPrecompile(address common.Address, p vm.PrecompiledContract) {
+	vm.PrecompiledContractsHomestead[address] = p
+	vm.PrecompiledContractsByzantium[address] = p
+}
+
+// instanceReader retrieves the value, contract ID and darc ID of a ByzCoin
+// instance. It returns an error if the instance does not exist.
+type instanceReader func(id byzcoin.InstanceID) ([]byte, string, darc.ID, error)
+
+// Return an instanceReader using a ByzCoin state trie
+func rstInstanceReader(rst byzcoin.ReadOnlyStateTrie) instanceReader {
+	return func(id byzcoin.InstanceID) ([]byte, string, darc.ID, error) {
+		value, _, contractID, darcID, err := rst.GetValues(id.Slice())
+
+		return value, contractID, darcID, err
+	}
+}
+
+// ByzCoin information made available to the precompiled contracts during the
+// bound EVM execution
+var precompileContext struct {
+	execution    sync.Mutex // Held for the whole bound execution
+	sync.RWMutex            // Protects readInstance
+	readInstance instanceReader
+}
+
+// Bind the ByzCoin information used by the precompiled contracts during an
+// EVM execution, until the returned function is called. This waits for the
+// end of the execution currently bound, if any; the returned function must
+// therefore be called as soon as the execution is over, and executions must
+// not be nested.
+func bindPrecompileContext(readInstance instanceReader) func() {
+	precompileContext.execution.Lock()
+
+	precompileContext.Lock()
+	precompileContext.readInstance = readInstance
+	precompileContext.Unlock()
+
+	return func() {
+		precompileContext.Lock()
+		precompileContext.readInstance = nil
+		precompileContext.Unlock()
+
+		precompileContext.execution.Unlock()
+	}
+}
+
+// Retrieve the instanceReader bound to the current EVM execution, if any
+func boundInstanceReader() instanceReader {
+	precompileContext.RLock()
+	defer precompileContext.RUnlock()
+
+	return precompileContext.readInstance
+}
+
+// ---------------------------------------------------------------------------
+
+// Precompiled contract reading ByzCoin instances
+type byzcoinReader struct{}
+
+// Read the instance whose ID is given as input
+func (r *byzcoinReader) read(input []byte) (bool, []byte, string, darc.ID, error) {
+	if len(input) != 32 {
+		return false, nil, "", nil, errors.New("Invalid ByzCoin instance ID")
+	}
+
+	readInstance := boundInstanceReader()
+	if readInstance == nil {
+		return false, nil, "", nil, errors.New("ByzCoin instances are not available")
+	}
+
+	value, contractID, darcID, err := readInstance(byzcoin.NewInstanceID(input))
+	if err != nil {
+		// Missing instance
+		log.Lvlf3("Cannot read ByzCoin instance %x: %v", input, err)
+		return false, nil, "", nil, nil
+	}
+
+	return true, value, contractID, darcID, nil
+}
+
+// RequiredGas implements vm.PrecompiledContract.RequiredGas()
+func (r *byzcoinReader) RequiredGas(input []byte) uint64 {
+	_, value, _, _, err := r.read(input)
+	if err != nil {
+		return byzcoinReaderBaseGas
+	}
+
+	return byzcoinReaderBaseGas + byzcoinReaderPerWordGas*uint64((len(value)+31)/32)
+}
+
+// Run implements vm.PrecompiledContract.Run()
+func (r *byzcoinReader) Run(input []byte) ([]byte, error) {
+	exists, value, contractID, darcID, err := r.read(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var darcIDBytes [32]byte
+	copy(darcIDBytes[:], darcID)
+
+	return packArguments([]string{"bool", "bytes", "string", "bytes32"},
+		exists, value, contractID, darcIDBytes)
+}
+
+// Build ABI arguments of the given types
+func newArguments(types ...string) (abi.Arguments, error) {
+	var args abi.Arguments
+	for _, t := range types {
+		abiType, err := abi.NewType(t)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, abi.Argument{Type: abiType})
+	}
+
+	return args, nil
+}
+
+// ABI-encode values of the given types
+func packArguments(types []string, values ...interface{}) ([]byte, error) {
+	args, err := newArguments(types...)
+	if err != nil {
+		return nil, err
+	}
+
+	return args.Pack(values...)
+}
+
+// Encode the result of a signature verification
+func verificationResult(valid bool) []byte {
+	if valid {
+		return common.LeftPadBytes([]byte{1}, 32)
+	}
+
+	return make([]byte, 32)
+}
+
+// Split the input of a signature verification precompiled contract, and
+// unmarshal the public key
+func splitVerifyInput(input []byte, public kyber.Point, sigLen int) ([]byte, []byte, error) {
+	pubLen := public.MarshalSize()
+	if len(input) < pubLen+sigLen {
+		return nil, nil, errors.New("Signature verification input too short")
+	}
+
+	err := public.UnmarshalBinary(input[:pubLen])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return input[pubLen : pubLen+sigLen], input[pubLen+sigLen:], nil
+}
+
+// ---------------------------------------------------------------------------
+
+// Precompiled contract verifying Ed25519 signatures
+type ed25519Verify struct{}
+
+// Suite used by the Ed25519 darc identities
+var ed25519Suite = edwards25519.NewBlakeSHA256Ed25519()
+
+// RequiredGas implements vm.PrecompiledContract.RequiredGas()
+func (v *ed25519Verify) RequiredGas(input []byte) uint64 {
+	return ed25519VerifyGas
+}
+
+// Run implements vm.PrecompiledContract.Run()
+func (v *ed25519Verify) Run(input []byte) ([]byte, error) {
+	public := ed25519Suite.Point()
+
+	sig, msg, err := splitVerifyInput(input, public, 64)
+	if err != nil {
+		log.Lvlf3("Invalid Ed25519 verification input: %v", err)
+		return verificationResult(false), nil
+	}
+
+	err = schnorr.Verify(ed25519Suite, public, msg, sig)
+
+	return verificationResult(err == nil), nil
+}
+
+// ---------------------------------------------------------------------------
+
+// Precompiled contract verifying BLS signatures
+type blsVerify struct{}
+
+// Suite used by the conodes for BLS signatures
+var blsSuite = pairing.NewSuiteBn256()
+
+// RequiredGas implements vm.PrecompiledContract.RequiredGas()
+func (v *blsVerify) RequiredGas(input []byte) uint64 {
+	return blsVerifyGas
+}
+
+// Run implements vm.PrecompiledContract.Run()
+func (v *blsVerify) Run(input []byte) ([]byte, error) {
+	public := blsSuite.G2().Point()
+
+	sig, msg, err := splitVerifyInput(input, public, blsSuite.G1().PointLen())
+	if err != nil {
+		log.Lvlf3("Invalid BLS verification input: %v", err)
+		return verificationResult(false), nil
+	}
+
+	err = bls.Verify(blsSuite, public, msg, sig)
+
+	return verificationResult(err == nil), nil
+}
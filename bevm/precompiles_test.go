@@ -0,0 +1,197 @@
+package bevm
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/kyber/v3/sign/bls"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/kyber/v3/util/key"
+	"go.dedis.ch/kyber/v3/util/random"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// Call a precompiled contract through the EVM
+func callPrecompile(t *testing.T, address common.Address, input []byte) ([]byte, error) {
+	stateDb, err := newEvmMemDb()
+	require.Nil(t, err)
+
+	bi := &blockInfo{
+		number:  big.NewInt(1),
+		getHash: func(uint64) common.Hash { return common.Hash{} },
+	}
+	params := Params{}.withDefaults(byzcoin.NewInstanceID(nil))
+	evm := vm.NewEVM(getContext(bi, params), stateDb, getChainConfig(params), getVMConfig())
+
+	ret, _, err := evm.Call(vm.AccountRef(common.HexToAddress("0x1234")), address, input, 1e6, big.NewInt(0))
+
+	return ret, err
+}
+
+func TestByzCoinReader(t *testing.T) {
+	log.LLvl1("ByzCoin instance reader")
+
+	existingID := byzcoin.NewInstanceID([]byte("existing instance"))
+	darcID := darc.ID(make([]byte, 32))
+	darcID[0] = 0x42
+
+	unbind := bindPrecompileContext(func(id byzcoin.InstanceID) ([]byte, string, darc.ID, error) {
+		if id.Equal(existingID) {
+			return []byte("some value"), "value", darcID, nil
+		}
+
+		return nil, "", nil, errors.New("key not set")
+	})
+
+	outputArgs, err := newArguments("bool", "bytes", "string", "bytes32")
+	require.Nil(t, err)
+
+	// Existing instance
+	ret, err := callPrecompile(t, ByzCoinReaderAddress, existingID.Slice())
+	require.Nil(t, err)
+
+	values, err := outputArgs.UnpackValues(ret)
+	require.Nil(t, err)
+	require.Equal(t, true, values[0])
+	require.Equal(t, []byte("some value"), values[1])
+	require.Equal(t, "value", values[2])
+	var expectedDarcID [32]byte
+	copy(expectedDarcID[:], darcID)
+	require.Equal(t, expectedDarcID, values[3])
+
+	// Missing instance
+	ret, err = callPrecompile(t, ByzCoinReaderAddress, byzcoin.NewInstanceID([]byte("other")).Slice())
+	require.Nil(t, err)
+
+	values, err = outputArgs.UnpackValues(ret)
+	require.Nil(t, err)
+	require.Equal(t, false, values[0])
+
+	// Invalid instance ID
+	_, err = callPrecompile(t, ByzCoinReaderAddress, []byte("short"))
+	require.NotNil(t, err)
+
+	// Executions are serialized: another binding waits for the end of this
+	// execution, and then uses its own information
+	bound := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		unbindOther := bindPrecompileContext(func(id byzcoin.InstanceID) ([]byte, string, darc.ID, error) {
+			return nil, "", nil, errors.New("key not set")
+		})
+		close(bound)
+
+		err := func() error {
+			stateDb, err := newEvmMemDb()
+			if err != nil {
+				return err
+			}
+
+			params := Params{}.withDefaults(byzcoin.NewInstanceID(nil))
+			bi := &blockInfo{number: big.NewInt(1), getHash: func(uint64) common.Hash { return common.Hash{} }}
+			evm := vm.NewEVM(getContext(bi, params), stateDb, getChainConfig(params), getVMConfig())
+
+			ret, _, err := evm.Call(vm.AccountRef(common.HexToAddress("0x1234")), ByzCoinReaderAddress,
+				existingID.Slice(), 1e6, big.NewInt(0))
+			if err != nil {
+				return err
+			}
+
+			values, err := outputArgs.UnpackValues(ret)
+			if err != nil {
+				return err
+			}
+			if values[0] != false {
+				return errors.New("instance read through the binding of another execution")
+			}
+
+			return nil
+		}()
+		unbindOther()
+
+		done <- err
+	}()
+
+	select {
+	case <-bound:
+		require.Fail(t, "Concurrent binding of the precompiled contracts")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ret, err = callPrecompile(t, ByzCoinReaderAddress, existingID.Slice())
+	require.Nil(t, err)
+	values, err = outputArgs.UnpackValues(ret)
+	require.Nil(t, err)
+	require.Equal(t, true, values[0])
+
+	unbind()
+	require.Nil(t, <-done)
+
+	// ByzCoin is not available outside of a BEVM execution
+	_, err = callPrecompile(t, ByzCoinReaderAddress, existingID.Slice())
+	require.NotNil(t, err)
+}
+
+// Call a signature verification precompiled contract and return whether the
+// signature is valid
+func verifySignature(t *testing.T, address common.Address, public []byte, sig []byte, msg []byte) bool {
+	input := append(append(append([]byte{}, public...), sig...), msg...)
+
+	ret, err := callPrecompile(t, address, input)
+	require.Nil(t, err)
+	require.Len(t, ret, 32)
+
+	return new(big.Int).SetBytes(ret).Uint64() == 1
+}
+
+func TestEd25519Verify(t *testing.T) {
+	log.LLvl1("Ed25519 signature verification")
+
+	kp := key.NewKeyPair(ed25519Suite)
+	public, err := kp.Public.MarshalBinary()
+	require.Nil(t, err)
+
+	msg := []byte("message to sign")
+	sig, err := schnorr.Sign(ed25519Suite, kp.Private, msg)
+	require.Nil(t, err)
+
+	require.True(t, verifySignature(t, Ed25519VerifyAddress, public, sig, msg))
+	require.False(t, verifySignature(t, Ed25519VerifyAddress, public, sig, []byte("other message")))
+
+	other, err := key.NewKeyPair(ed25519Suite).Public.MarshalBinary()
+	require.Nil(t, err)
+	require.False(t, verifySignature(t, Ed25519VerifyAddress, other, sig, msg))
+
+	// Truncated input
+	require.False(t, verifySignature(t, Ed25519VerifyAddress, public, sig[:10], nil))
+}
+
+func TestBlsVerify(t *testing.T) {
+	log.LLvl1("BLS signature verification")
+
+	private, publicPoint := bls.NewKeyPair(blsSuite, random.New())
+	public, err := publicPoint.MarshalBinary()
+	require.Nil(t, err)
+
+	msg := []byte("message to sign")
+	sig, err := bls.Sign(blsSuite, private, msg)
+	require.Nil(t, err)
+
+	require.True(t, verifySignature(t, BlsVerifyAddress, public, sig, msg))
+	require.False(t, verifySignature(t, BlsVerifyAddress, public, sig, []byte("other message")))
+
+	_, otherPoint := bls.NewKeyPair(blsSuite, random.New())
+	other, err := otherPoint.MarshalBinary()
+	require.Nil(t, err)
+	require.False(t, verifySignature(t, BlsVerifyAddress, other, sig, msg))
+
+	// Truncated input
+	require.False(t, verifySignature(t, BlsVerifyAddress, public, sig[:10], nil))
+}
@@ -0,0 +1,214 @@
+package bevm
+
+import (
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/onet/v3/network"
+)
+
+// Messages of the BEVM service API.
+//
+// The responses contain the ByzCoin proof of the BEVM instance whose state
+// was used, so that clients can check the EVM state root against the
+// ledger.
+
+func init() {
+	network.RegisterMessages(&ViewCallRequest{}, &ViewCallResponse{},
+		&BalanceRequest{}, &BalanceResponse{},
+		&NonceRequest{}, &NonceResponse{},
+		&EstimateGasRequest{}, &EstimateGasResponse{},
+		&SimulateRequest{}, &SimulateResponse{},
+		&TraceRequest{}, &TraceResponse{},
+		&BlockReceiptsRequest{}, &BlockReceiptsResponse{})
+}
+
+// ViewCallRequest asks for an EVM view call (without state change) on a BEVM
+// instance
+type ViewCallRequest struct {
+	ByzCoinID skipchain.SkipBlockID
+	BEvmID    byzcoin.InstanceID
+	From      []byte // Address of the caller
+	To        []byte // Address of the called contract
+	CallData  []byte
+}
+
+// ViewCallResponse contains the result of an EVM view call
+type ViewCallResponse struct {
+	Result []byte
+	Proof  byzcoin.Proof // Proof of the BEVM instance used
+}
+
+// BalanceRequest asks for the balance of an Ethereum account of a BEVM
+// instance
+type BalanceRequest struct {
+	ByzCoinID skipchain.SkipBlockID
+	BEvmID    byzcoin.InstanceID
+	Address   []byte
+}
+
+// BalanceResponse contains the balance of an Ethereum account
+type BalanceResponse struct {
+	Balance      []byte        // Big-endian amount of wei
+	AccountProof [][]byte      // Merkle proof of the account in the EVM state trie
+	Proof        byzcoin.Proof // Proof of the BEVM instance used
+}
+
+// NonceRequest asks for the nonce of an Ethereum account of a BEVM instance
+type NonceRequest struct {
+	ByzCoinID skipchain.SkipBlockID
+	BEvmID    byzcoin.InstanceID
+	Address   []byte
+}
+
+// NonceResponse contains the nonce of an Ethereum account, i.e. the nonce of
+// its next transaction
+type NonceResponse struct {
+	Nonce        uint64
+	AccountProof [][]byte      // Merkle proof of the account in the EVM state trie
+	Proof        byzcoin.Proof // Proof of the BEVM instance used
+}
+
+// EstimateGasRequest asks for the gas needed by an EVM transaction on a BEVM
+// instance
+type EstimateGasRequest struct {
+	ByzCoinID skipchain.SkipBlockID
+	BEvmID    byzcoin.InstanceID
+	From      []byte // Address of the sender
+	To        []byte // Address of the called contract, empty for a deployment
+	Value     []byte // Big-endian amount of wei transferred
+	GasPrice  []byte // Big-endian gas price
+	Data      []byte
+}
+
+// EstimateGasResponse contains the gas needed by an EVM transaction
+type EstimateGasResponse struct {
+	GasLimit uint64
+	Proof    byzcoin.Proof // Proof of the BEVM instance used
+}
+
+// SimulateRequest asks for the simulation of an EVM transaction on a BEVM
+// instance, without submitting it to ByzCoin
+type SimulateRequest struct {
+	ByzCoinID skipchain.SkipBlockID
+	BEvmID    byzcoin.InstanceID
+	Tx        []byte // JSON-encoded signed transaction; if empty, the following fields describe an unsigned one
+	From      []byte // Address of the sender
+	To        []byte // Address of the called contract, empty for a deployment
+	Value     []byte // Big-endian amount of wei transferred
+	GasLimit  uint64 // Gas limit, the one of the BEVM instance if zero, capped by the service
+	GasPrice  []byte // Big-endian gas price
+	Data      []byte
+}
+
+// SimulateResponse contains the outcome of a simulated EVM transaction
+type SimulateResponse struct {
+	Receipt      []byte // Transaction receipt, in its storage encoding
+	ReturnData   []byte
+	RevertReason string // Reason given by a failed transaction, if any
+	Changes      []AccountChange
+	// Number of ByzCoin instructions emitted by the transaction
+	EmittedInstructions uint64
+	// Reason for which the emitted instructions would be refused, failing
+	// the whole transaction, if any
+	InstructionsError string
+	Proof             byzcoin.Proof // Proof of the BEVM instance used
+}
+
+// AccountChange describes the modification of an Ethereum account by a
+// simulated transaction
+type AccountChange struct {
+	Address       []byte
+	BalanceBefore []byte // Big-endian amount of wei
+	BalanceAfter  []byte // Big-endian amount of wei
+	NonceBefore   uint64
+	NonceAfter    uint64
+	CodeChanged   bool
+	CodeAfter     []byte // New code, if changed
+	Storage       []StorageChange
+}
+
+// StorageChange describes the modification of a storage slot by a simulated
+// transaction
+type StorageChange struct {
+	Key    []byte
+	Before []byte
+	After  []byte
+}
+
+// TraceRequest asks for the trace of an EVM transaction on a BEVM instance:
+// either an executed transaction, which is replayed, or a new one, which is
+// simulated
+type TraceRequest struct {
+	ByzCoinID skipchain.SkipBlockID
+	BEvmID    byzcoin.InstanceID
+	TxHash    []byte // Hash of the executed transaction to replay; if empty, the following fields describe a new one
+	Tx        []byte // JSON-encoded signed transaction; if empty, the following fields describe an unsigned one
+	From      []byte // Address of the sender
+	To        []byte // Address of the called contract, empty for a deployment
+	Value     []byte // Big-endian amount of wei transferred
+	GasLimit  uint64 // Gas limit, the one of the BEVM instance if zero, capped by the service
+	GasPrice  []byte // Big-endian gas price
+	Data      []byte
+}
+
+// TraceResponse contains the trace of an EVM transaction
+type TraceResponse struct {
+	Receipt      []byte // Transaction receipt, in its storage encoding
+	ReturnData   []byte
+	RevertReason string // Reason given by a failed transaction, if any
+	Steps        []TraceStep
+	Calls        []TraceCall
+	Truncated    bool          // Set if the maximum number of steps was reached
+	Diverged     bool          // Set if the replay of an executed transaction does not match its receipt
+	Proof        byzcoin.Proof // Proof of the BEVM instance used
+}
+
+// TraceStep describes the execution of an EVM opcode
+type TraceStep struct {
+	PC         uint64
+	Op         string
+	Gas        uint64 // Gas left before the opcode
+	GasCost    uint64
+	Depth      int      // Call depth, 1 for the top-level call
+	Stack      [][]byte // Topmost stack items, starting from the top
+	MemorySize uint64
+	Memory     []byte // Leading bytes of the memory
+	Error      string
+}
+
+// TraceCall describes a call (or contract creation) made during the
+// execution of an EVM transaction
+type TraceCall struct {
+	Type    string // Opcode of the call, such as CALL or CREATE
+	From    []byte
+	To      []byte // Address of the called or created contract
+	Value   []byte // Big-endian amount of wei transferred
+	Gas     uint64
+	GasUsed uint64
+	Input   []byte
+	Output  []byte
+	Error   string
+	Depth   int // Call depth, 1 for the top-level call
+	Parent  int // Index of the calling call, -1 for the top-level call
+}
+
+// BlockReceiptsRequest asks for the receipts of the EVM transactions of a
+// range of EVM blocks of a BEVM instance
+type BlockReceiptsRequest struct {
+	ByzCoinID skipchain.SkipBlockID
+	BEvmID    byzcoin.InstanceID
+	FromBlock uint64 // Number of the first EVM block, i.e. index of its ByzCoin block
+	ToBlock   uint64 // Number of the last EVM block (included)
+}
+
+// BlockReceiptsResponse contains the receipts of a range of EVM blocks
+type BlockReceiptsResponse struct {
+	Blocks []BlockReceipts
+	Proof  byzcoin.Proof // Proof of the BEVM instance used
+}
+
+// BlockReceipts contains the receipts of the EVM transactions of an EVM block
+type BlockReceipts struct {
+	Hash     []byte   // Hash of the ByzCoin block
+	Receipts [][]byte // Transaction receipts in the order of their execution, in their storage encoding
+}
@@ -0,0 +1,129 @@
+package bevm
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+)
+
+// Pruning of the EVM state database.
+//
+// Each commit of the EVM state database writes new trie nodes, but the nodes
+// it supersedes are kept. Pruning removes the trie nodes and contract code
+// that are no longer reachable from the current root. As trie nodes and
+// contract code are identified by their hash, they can be shared among
+// several accounts, so reachability is determined from the whole state
+// (mark and sweep), which makes pruning proportional to the state size.
+//
+// Only keys known to the key index are considered; other entries of the EVM
+// state database (receipts and their block index, preimages, key index) are
+// never pruned. The records of executed transactions can optionally be pruned
+// too, once the EVM state preceding them is not available anymore (they
+// cannot be replayed, and only provide the transactions themselves).
+
+// Remove the entries of the EVM state database which are not reachable from
+// its current root, as well as the records of executed transactions which
+// cannot be replayed anymore if requested, and return their number
+func pruneEvmDb(stateDb *state.StateDB, withTxRecords bool) (int, error) {
+	byzDb, ok := stateDb.Database().TrieDB().DiskDB().(*ServerByzDatabase)
+	if !ok {
+		return 0, errors.New("Internal error: EVM State DB is not of expected type")
+	}
+
+	// Mark the trie nodes and contract code reachable from the root
+	reachable := make(map[common.Hash]bool)
+
+	it := state.NewNodeIterator(stateDb)
+	for it.Next() {
+		// Entries without hash are embedded in their parent node
+		if it.Hash != (common.Hash{}) {
+			reachable[it.Hash] = true
+		}
+	}
+	if it.Error != nil {
+		return 0, it.Error
+	}
+
+	// Sweep the others
+	removed, err := byzDb.prune(func(key []byte) bool {
+		if withTxRecords && bytes.HasPrefix(key, txRecordKeyPrefix) {
+			return !byzDb.isReplayable(key, reachable)
+		}
+
+		return len(key) == common.HashLength && !reachable[common.BytesToHash(key)]
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Lvlf2("Pruned %d entries (%d reachable)", removed, len(reachable))
+
+	return removed, nil
+}
+
+// Check whether the transaction record of the given key can still be
+// replayed, i.e. whether the EVM state preceding it is reachable. Must be
+// called with the lock held.
+func (db *ServerByzDatabase) isReplayable(key []byte, reachable map[common.Hash]bool) bool {
+	recordData, err := db.get(key)
+	if err != nil {
+		return false
+	}
+
+	var record txRecord
+	err = protobuf.Decode(recordData, &record)
+	if err != nil {
+		// Keep what cannot be interpreted
+		return true
+	}
+
+	return reachable[common.BytesToHash(record.Root)]
+}
+
+// Remove the keys of the key index selected by the given function, and
+// compact the key index
+func (db *ServerByzDatabase) prune(obsolete func(key []byte) bool) (int, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	keys, err := db.readKeyIndex(0, keyIndexChunks(db.keyIndexSize))
+	if err != nil {
+		return 0, err
+	}
+	keys = append(keys, db.unindexed...)
+	db.unindexed = nil
+
+	var kept [][]byte
+	seen := make(map[string]bool)
+	removed := 0
+
+	for _, key := range keys {
+		// Drop duplicate entries, as well as entries of deleted keys
+		if seen[string(key)] || !db.has(key) {
+			continue
+		}
+		seen[string(key)] = true
+
+		if obsolete(key) {
+			err = db.delete(key)
+			if err != nil {
+				return 0, err
+			}
+			removed++
+			continue
+		}
+
+		kept = append(kept, key)
+	}
+
+	err = db.rewriteKeyIndex(kept)
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, nil
+}
@@ -1,36 +1,616 @@
 package bevm
 
 import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
 	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/cothority/v3/skipchain"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+)
+
+// This service registers our contracts to the ByzCoin service, and provides
+// an API to other ByzCoin contracts running EVM code.
+
+// ServiceName is the name of the BEVM service, which other services can use
+// to retrieve it
+const ServiceName = "BEvm_Contract"
+
+// Limits of the EVM executions performed to answer client requests (view
+// calls, gas estimations, simulations and traces), which are neither
+// authenticated nor paid for. As with the RPC gas cap of geth, the gas of an
+// execution never exceeds queryGasCap, whatever the gas limit of the instance
+// or the one requested; the executions of a request are aborted once it has
+// been running for queryTimeout.
+const (
+	queryGasCap  = uint64(50000000)
+	queryTimeout = 5 * time.Second
 )
 
-// This service is only used because we need to register our contracts to
-// the ByzCoin service. So we create this stub and add contracts to it
-// from the `contracts` directory.
+// Error of the EVM executions aborted at the deadline of their request
+var errQueryTimeout = fmt.Errorf("EVM execution aborted: the request exceeded %v", queryTimeout)
+
+// Cap the gas of an EVM execution performed for a client request
+func capQueryGas(gas uint64) uint64 {
+	if gas == 0 || gas > queryGasCap {
+		return queryGasCap
+	}
+
+	return gas
+}
+
+// Abort an EVM execution once the given deadline has passed, if any. The
+// returned function must be called once the execution is over: as an aborted
+// execution is reported as successful by the EVM, it returns an error if the
+// execution was aborted.
+func abortAtDeadline(evm *vm.EVM, deadline time.Time) func() error {
+	if deadline.IsZero() {
+		return func() error { return nil }
+	}
+
+	var aborted int32
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		atomic.StoreInt32(&aborted, 1)
+		evm.Cancel()
+	})
+
+	return func() error {
+		timer.Stop()
+		if atomic.LoadInt32(&aborted) != 0 {
+			return errQueryTimeout
+		}
+
+		return nil
+	}
+}
 
 func init() {
-	_, err := onet.RegisterNewService("BEvm_Contract", newService)
+	_, err := onet.RegisterNewService(ServiceName, newService)
 	log.ErrFatal(err)
 }
 
-// Service is only used to being able to store our contracts
+// Service stores our contracts and provides access to BEVM instances
 type Service struct {
 	// We need to embed the ServiceProcessor, so that incoming messages
 	// are correctly handled.
 	*onet.ServiceProcessor
+
+	byzcoinIDs     map[string]skipchain.SkipBlockID // ByzCoin ledger IDs, indexed by the nonce of their state trie
+	byzcoinIDsLock sync.Mutex
 }
 
 func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
+		byzcoinIDs:       make(map[string]skipchain.SkipBlockID),
 	}
 
-	err := byzcoin.RegisterContract(c, ContractBEvmID, contractBEvmFromBytes)
+	err := s.RegisterHandlers(s.ViewCall, s.GetBalance, s.GetNonce, s.EstimateGas, s.Simulate, s.Trace,
+		s.BlockReceipts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = byzcoin.RegisterContract(c, ContractBEvmID, s.contractBEvmFromBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = byzcoin.RegisterContract(c, ContractBEvmValueID, contractBEvmValueFromBytes)
 	if err != nil {
 		return nil, err
 	}
 
 	return s, nil
 }
+
+// Deserialize a BEVM contract state, providing it with access to the service
+func (s *Service) contractBEvmFromBytes(in []byte) (byzcoin.Contract, error) {
+	contract, err := contractBEvmFromBytes(in)
+	if err != nil {
+		return nil, err
+	}
+
+	contract.(*contractBEvm).service = s
+
+	return contract, nil
+}
+
+func (s *Service) byzcoinService() *byzcoin.Service {
+	return s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+}
+
+func (s *Service) skipchainService() *skipchain.Service {
+	return s.Service(skipchain.ServiceName).(*skipchain.Service)
+}
+
+// Retrieve the ID of the ByzCoin ledger to which a state trie belongs
+func (s *Service) getByzCoinID(rst byzcoin.ReadOnlyStateTrie) (skipchain.SkipBlockID, error) {
+	// The nonce of a state trie is unique to its ledger
+	nonce, err := rst.GetNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	s.byzcoinIDsLock.Lock()
+	defer s.byzcoinIDsLock.Unlock()
+
+	id, ok := s.byzcoinIDs[string(nonce)]
+	if ok {
+		return id, nil
+	}
+
+	// Unknown nonce: the ledgers not seen yet are looked up, and remembered
+	resp, err := s.byzcoinService().GetAllByzCoinIDs(&byzcoin.GetAllByzCoinIDsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, id := range s.byzcoinIDs {
+		known[string(id)] = true
+	}
+
+	var lookupErr error
+	for _, id := range resp.IDs {
+		if known[string(id)] {
+			continue
+		}
+
+		st, err := s.byzcoinService().GetReadOnlyStateTrie(id)
+		if err != nil {
+			lookupErr = fmt.Errorf("Cannot read the state trie of ledger %x: %v", id, err)
+			continue
+		}
+
+		stNonce, err := st.GetNonce()
+		if err != nil {
+			lookupErr = fmt.Errorf("Cannot read the nonce of ledger %x: %v", id, err)
+			continue
+		}
+
+		s.byzcoinIDs[string(stNonce)] = id
+	}
+
+	id, ok = s.byzcoinIDs[string(nonce)]
+	if ok {
+		return id, nil
+	}
+
+	if lookupErr != nil {
+		return nil, fmt.Errorf("Cannot find the ByzCoin ledger of the state trie: %v", lookupErr)
+	}
+
+	return nil, errors.New("Internal error: cannot find the ByzCoin ledger of the state trie")
+}
+
+// Retrieve a ByzCoin block given its index
+func (s *Service) getBlockByIndex(byzcoinID skipchain.SkipBlockID, index int) (*skipchain.SkipBlock, error) {
+	reply, err := s.skipchainService().GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+		Genesis: byzcoinID,
+		Index:   index,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.SkipBlock, nil
+}
+
+// Retrieve the EVM block information corresponding to a state trie
+func (s *Service) getBlockInfo(rst byzcoin.ReadOnlyStateTrie) (*blockInfo, error) {
+	byzcoinID, err := s.getByzCoinID(rst)
+	if err != nil {
+		return nil, err
+	}
+
+	// The index of the state trie is the one of the latest block applied to it
+	return s.getBlockInfoAt(byzcoinID, rst.GetIndex())
+}
+
+// Build the EVM block information following the ByzCoin block with the given
+// index
+func (s *Service) getBlockInfoAt(byzcoinID skipchain.SkipBlockID, index int) (*blockInfo, error) {
+	latest, err := s.getBlockByIndex(byzcoinID, index)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBlockInfo(latest, func(index int) (*skipchain.SkipBlock, error) {
+		return s.getBlockByIndex(byzcoinID, index)
+	})
+}
+
+// ---------------------------------------------------------------------------
+// API for other ByzCoin contracts
+//
+// Contracts implemented in Go can run EVM code of a BEVM instance within
+// their own instructions, using the BEVM service retrieved through their own
+// service (e.g. s.Service(bevm.ServiceName).(*bevm.Service)). Authorizing
+// these operations is up to the calling contract.
+
+// Retrieve a BEVM instance from a ByzCoin state trie
+func (s *Service) loadBEvm(rst byzcoin.ReadOnlyStateTrie, bevmID byzcoin.InstanceID) (*contractBEvm, darc.ID, error) {
+	value, _, contractID, darcID, err := rst.GetValues(bevmID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	if contractID != ContractBEvmID {
+		return nil, nil, fmt.Errorf("Instance '%s' is not a BEVM instance", bevmID)
+	}
+
+	contract, err := s.contractBEvmFromBytes(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := contract.(*contractBEvm)
+	if c.Deleting {
+		return nil, nil, errors.New("BEVM instance is being deleted")
+	}
+
+	return c, darcID, nil
+}
+
+// Call performs an EVM view call (without state change) on a BEVM instance,
+// as seen by the given ByzCoin state trie, and returns its result
+func (s *Service) Call(rst byzcoin.ReadOnlyStateTrie, bevmID byzcoin.InstanceID, from common.Address, to common.Address, callData []byte) ([]byte, error) {
+	c, _, err := s.loadBEvm(rst, bevmID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.call(rst, &c.State, bevmID, from, to, callData, c.GetParams(bevmID).GasLimit, time.Time{})
+}
+
+// Perform an EVM view call on the given state of a BEVM instance, with the
+// given gas and aborted at the given deadline (if any)
+func (s *Service) call(rst byzcoin.ReadOnlyStateTrie, bs *State, bevmID byzcoin.InstanceID, from common.Address, to common.Address, callData []byte,
+	gas uint64, deadline time.Time) ([]byte, error) {
+	stateDb, err := NewEvmDb(bs, rst, bevmID)
+	if err != nil {
+		return nil, err
+	}
+
+	bi, err := s.getBlockInfo(rst)
+	if err != nil {
+		return nil, err
+	}
+
+	params := bs.GetParams(bevmID)
+	evm := vm.NewEVM(getContext(bi, params), stateDb, getChainConfig(params), getVMConfig())
+
+	unbind := bindPrecompileContext(rstInstanceReader(rst))
+	checkAborted := abortAtDeadline(evm, deadline)
+	ret, _, err := evm.Call(vm.AccountRef(from), to, callData, gas, big.NewInt(0))
+	abortErr := checkAborted()
+	unbind()
+	if abortErr != nil {
+		return nil, abortErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Transaction executes a signed EVM transaction on a BEVM instance, as seen
+// by the given ByzCoin state trie, in the same way as the "transaction"
+// command. It returns the transaction receipt along with the state changes to
+// merge into the ones of the calling contract: the update of the BEVM
+// instance, the changes of its EVM state database and the ones of the
+// ByzCoin instructions emitted by the EVM. Further operations within the same
+// instruction must use a state trie including these state changes.
+// The emitted instructions are subject to the same authorization as with the
+// "transaction" command: they are executed only if the darc of the BEVM
+// instance allows them to the identity of the emitting EVM contract (see
+// EmitterIdentity()), regardless of the authorization of the calling
+// contract.
+func (s *Service) Transaction(rst byzcoin.ReadOnlyStateTrie, bevmID byzcoin.InstanceID, tx *types.Transaction) (*types.Receipt, []byzcoin.StateChange, error) {
+	c, darcID, err := s.loadBEvm(rst, bevmID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stateDb, err := NewEvmDb(&c.State, rst, bevmID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bi, err := s.getBlockInfo(rst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	txReceipt, err := c.executeTx(rst, stateDb, bi, tx, bevmID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stateChanges, err := c.executionStateChanges(rst, stateDb, bevmID, darcID, txReceipt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return txReceipt, stateChanges, nil
+}
+
+// Execute executes an unsigned EVM message on a BEVM instance, as seen by the
+// given ByzCoin state trie: a contract deployment if 'to' is nil, or a call
+// otherwise, transferring the given value from 'from'. As the message is not
+// signed, any account can be used as sender: authorizing the operation is up
+// to the calling contract. The message is free of gas fees, and can use all
+// the gas of the EVM block of the instruction. Its receipt is stored like the
+// ones of the transactions, under a hash identifying the message, but it
+// cannot be replayed by TraceTransaction(): the transactions executed after
+// it within the same instruction are replayed without it, and may therefore
+// be flagged as diverging.
+// It returns the receipt of the message, the data returned by the execution
+// (the revert data if it failed), and the state changes to merge into the
+// ones of the calling contract, as Transaction() does.
+func (s *Service) Execute(rst byzcoin.ReadOnlyStateTrie, bevmID byzcoin.InstanceID, from common.Address,
+	to *common.Address, value *big.Int, data []byte) (*types.Receipt, []byte, []byzcoin.StateChange, error) {
+	c, darcID, err := s.loadBEvm(rst, bevmID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stateDb, err := NewEvmDb(&c.State, rst, bevmID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	bi, err := s.getBlockInfo(rst)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	receipt, ret, err := c.executeMessage(rst, stateDb, bi, from, to, value, data, bevmID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stateChanges, err := c.executionStateChanges(rst, stateDb, bevmID, darcID, receipt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return receipt, ret, stateChanges, nil
+}
+
+// Execute the ByzCoin instructions emitted by an EVM execution, and return
+// the resulting state changes: the update of the BEVM instance, the changes
+// of its EVM state database and the ones of the emitted instructions
+func (c *contractBEvm) executionStateChanges(rst byzcoin.ReadOnlyStateTrie, stateDb *state.StateDB,
+	bevmID byzcoin.InstanceID, darcID darc.ID, receipt *types.Receipt) ([]byzcoin.StateChange, error) {
+	instrs, err := emittedInstructions(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	contractState, stateChanges, err := c.newContractState(stateDb, bevmID)
+	if err != nil {
+		return nil, err
+	}
+
+	contractData, err := protobuf.Encode(contractState)
+	if err != nil {
+		return nil, err
+	}
+
+	emittedChanges, _, err := c.executeEmittedInstructions(rst, bevmID, darcID, instrs, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := append([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Update, bevmID, ContractBEvmID, contractData, darcID),
+	}, stateChanges...)
+
+	return append(sc, emittedChanges...), nil
+}
+
+// ---------------------------------------------------------------------------
+// API for clients
+//
+// View calls and balance queries run against the local state trie of the
+// conode, instead of retrieving each EVM state trie node separately.
+
+// Number of attempts to build the proof of a BEVM instance from a state trie
+// while new blocks are added
+const proofAttempts = 3
+
+// Retrieve the state of a BEVM instance along with its ByzCoin proof, and a
+// state trie to read the EVM state database from. The proof is built from the
+// state trie, so that both reflect the same ByzCoin block, which is also the
+// one from which the EVM block information is derived (see getBlockInfo()).
+func (s *Service) getBEvmStateWithProof(byzcoinID skipchain.SkipBlockID, bevmID byzcoin.InstanceID) (*State, *byzcoin.Proof, byzcoin.ReadOnlyStateTrie, error) {
+	var rst byzcoin.ReadOnlyStateTrie
+	var proof *byzcoin.Proof
+
+	for attempt := 0; ; attempt++ {
+		var err error
+		rst, err = s.byzcoinService().GetReadOnlyStateTrie(byzcoinID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		proof, err = byzcoin.NewProof(rst, s.skipchainService().GetDB(), byzcoinID, bevmID.Slice())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// The latest block of the proof is the one of the state trie,
+		// unless a block was added in between
+		if proof.Latest.Index == rst.GetIndex() {
+			break
+		}
+		if attempt+1 == proofAttempts {
+			return nil, nil, nil, errors.New("Cannot build a proof of the BEVM instance: the ledger is changing")
+		}
+	}
+
+	exists, err := proof.Exists(bevmID.Slice())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !exists {
+		return nil, nil, nil, fmt.Errorf("BEVM instance '%s' does not exist", bevmID)
+	}
+
+	_, value, contractID, _, err := proof.KeyValue()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if contractID != ContractBEvmID {
+		return nil, nil, nil, fmt.Errorf("Instance '%s' is not a BEVM instance", bevmID)
+	}
+
+	contract, err := s.contractBEvmFromBytes(value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	bs := &contract.(*contractBEvm).State
+	if bs.Deleting {
+		return nil, nil, nil, errors.New("BEVM instance is being deleted")
+	}
+
+	return bs, proof, rst, nil
+}
+
+// ViewCall performs an EVM view call on a BEVM instance
+func (s *Service) ViewCall(req *ViewCallRequest) (*ViewCallResponse, error) {
+	bs, proof, rst, err := s.getBEvmStateWithProof(req.ByzCoinID, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := s.call(rst, bs, req.BEvmID, common.BytesToAddress(req.From),
+		common.BytesToAddress(req.To), req.CallData, capQueryGas(bs.GetParams(req.BEvmID).GasLimit),
+		time.Now().Add(queryTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ViewCallResponse{Result: ret, Proof: *proof}, nil
+}
+
+// GetBalance returns the balance of an Ethereum account of a BEVM instance
+func (s *Service) GetBalance(req *BalanceRequest) (*BalanceResponse, error) {
+	bs, proof, rst, err := s.getBEvmStateWithProof(req.ByzCoinID, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	stateDb, err := NewEvmDb(bs, rst, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	address := common.BytesToAddress(req.Address)
+	balance := stateDb.GetBalance(address)
+
+	accountProof, err := stateDb.GetProof(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BalanceResponse{Balance: balance.Bytes(), AccountProof: accountProof, Proof: *proof}, nil
+}
+
+// GetNonce returns the nonce of an Ethereum account of a BEVM instance
+func (s *Service) GetNonce(req *NonceRequest) (*NonceResponse, error) {
+	bs, proof, rst, err := s.getBEvmStateWithProof(req.ByzCoinID, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	stateDb, err := NewEvmDb(bs, rst, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	address := common.BytesToAddress(req.Address)
+	nonce := stateDb.GetNonce(address)
+
+	accountProof, err := stateDb.GetProof(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NonceResponse{Nonce: nonce, AccountProof: accountProof, Proof: *proof}, nil
+}
+
+// EstimateGas returns the gas needed by an EVM transaction on a BEVM instance
+func (s *Service) EstimateGas(req *EstimateGasRequest) (*EstimateGasResponse, error) {
+	bs, proof, rst, err := s.getBEvmStateWithProof(req.ByzCoinID, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	bi, err := s.getBlockInfo(rst)
+	if err != nil {
+		return nil, err
+	}
+
+	var to *common.Address
+	if len(req.To) != 0 {
+		address := common.BytesToAddress(req.To)
+		to = &address
+	}
+
+	// Each execution uses a fresh EVM state database, whose modifications are
+	// discarded
+	newStateDb := func() (*state.StateDB, error) {
+		return NewEvmDb(bs, rst, req.BEvmID)
+	}
+
+	gasLimit, err := estimateGas(newStateDb, rstInstanceReader(rst), bi, bs.GetParams(req.BEvmID),
+		common.BytesToAddress(req.From), to, new(big.Int).SetBytes(req.Value), new(big.Int).SetBytes(req.GasPrice), req.Data,
+		time.Now().Add(queryTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	return &EstimateGasResponse{GasLimit: gasLimit, Proof: *proof}, nil
+}
+
+// Simulate executes an EVM transaction on a throwaway copy of the state of a
+// BEVM instance, and returns its outcome
+func (s *Service) Simulate(req *SimulateRequest) (*SimulateResponse, error) {
+	bs, proof, rst, err := s.getBEvmStateWithProof(req.ByzCoinID, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	bi, err := s.getBlockInfo(rst)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, txHash, err := simulatedMessage(req, bs, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.simulateMessage(rst, bs, req.BEvmID, bi, msg, txHash, time.Now().Add(queryTimeout))
+	if err != nil {
+		return nil, err
+	}
+	resp.Proof = *proof
+
+	return resp, nil
+}
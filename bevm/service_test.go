@@ -1,11 +1,269 @@
 package bevm
 
 import (
+	"encoding/binary"
+	"math/big"
+	"strings"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
 )
 
 func TestMain(m *testing.M) {
 	log.MainTest(m)
 }
+
+func TestService_API(t *testing.T) {
+	log.LLvl1("Service API for other contracts")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	// Spawn a new BEVM instance
+	instanceID, err := NewBEvm(bct.cl, bct.signer, bct.gDarc)
+	require.Nil(t, err)
+
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(5*WeiPerEther), a.Address)
+	require.Nil(t, err)
+
+	candyContract, err := NewEvmContract(getContractPath(t, "Candy"))
+	require.Nil(t, err)
+	_, err = bevmClient.Deploy(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, big.NewInt(100))
+	require.Nil(t, err)
+
+	service := bct.servers[0].Service(ServiceName).(*Service)
+	rst, err := service.byzcoinService().GetReadOnlyStateTrie(bct.cl.ID)
+	require.Nil(t, err)
+
+	// View call
+	callData, err := candyContract.packMethod("getRemainingCandies")
+	require.Nil(t, err)
+
+	ret, err := service.Call(rst, instanceID, a.Address, candyContract.Address, callData)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(100), new(big.Int).SetBytes(ret))
+
+	// Transaction
+	tx, err := newMethodTx(txParams.GasLimit, txParams.GasPrice, 0, a, candyContract, "eatCandy", big.NewInt(10))
+	require.Nil(t, err)
+	chainID, err := bevmClient.ChainID()
+	require.Nil(t, err)
+	signedTx, err := a.signTx(tx, chainID)
+	require.Nil(t, err)
+
+	receipt, stateChanges, err := service.Transaction(rst, instanceID, signedTx)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.NotEmpty(t, stateChanges)
+	require.Equal(t, instanceID.Slice(), stateChanges[0].InstanceID)
+
+	// The transaction is visible once its state changes are applied
+	rst, err = rst.StoreAllToReplica(stateChanges)
+	require.Nil(t, err)
+
+	ret, err = service.Call(rst, instanceID, a.Address, candyContract.Address, callData)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(90), new(big.Int).SetBytes(ret))
+
+	// Unsigned message, from an account without balance, returning data
+	sender := common.HexToAddress("0x1234")
+	receipt, ret, stateChanges, err = service.Execute(rst, instanceID, sender, &candyContract.Address, nil, callData)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.Equal(t, big.NewInt(90), new(big.Int).SetBytes(ret))
+	firstHash := receipt.TxHash
+
+	eatData, err := candyContract.packMethod("eatCandy", big.NewInt(5))
+	require.Nil(t, err)
+	rst, err = rst.StoreAllToReplica(stateChanges)
+	require.Nil(t, err)
+	receipt, _, stateChanges, err = service.Execute(rst, instanceID, sender, &candyContract.Address, nil, eatData)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.NotEqual(t, firstHash, receipt.TxHash)
+
+	rst, err = rst.StoreAllToReplica(stateChanges)
+	require.Nil(t, err)
+	ret, err = service.Call(rst, instanceID, a.Address, candyContract.Address, callData)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(85), new(big.Int).SetBytes(ret))
+
+	// The receipts are indexed under the EVM block being built, so that their
+	// logs can be found
+	c, _, err := service.loadBEvm(rst, instanceID)
+	require.Nil(t, err)
+	stateDb, err := NewEvmDb(&c.State, rst, instanceID)
+	require.Nil(t, err)
+	index, err := loadBlockIndex(stateDb, uint64(rst.GetIndex())+1)
+	require.Nil(t, err)
+	require.NotNil(t, index)
+	require.Equal(t, [][]byte{signedTx.Hash().Bytes(), firstHash.Bytes(), receipt.TxHash.Bytes()}, index.TxHashes)
+
+	// A failed message is reported by its receipt
+	eatData, err = candyContract.packMethod("eatCandy", big.NewInt(1000))
+	require.Nil(t, err)
+	receipt, _, _, err = service.Execute(rst, instanceID, sender, &candyContract.Address, nil, eatData)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+
+	// The value transferred must be available
+	_, _, _, err = service.Execute(rst, instanceID, sender, &candyContract.Address, big.NewInt(1), callData)
+	require.NotNil(t, err)
+
+	// The ledger itself is not modified
+	candies := big.NewInt(0)
+	err = bevmClient.Call(a, &candies, candyContract, "getRemainingCandies")
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(100), candies)
+
+	// Only BEVM instances are accepted
+	_, err = service.Call(rst, byzcoin.NewInstanceID(bct.gDarc.GetBaseID()), a.Address, candyContract.Address, callData)
+	require.NotNil(t, err)
+}
+
+func TestService_AccountProof(t *testing.T) {
+	log.LLvl1("Proofs of EVM accounts")
+
+	stateDb, err := newEvmMemDb()
+	require.Nil(t, err)
+
+	address := common.HexToAddress("0x1234")
+	stateDb.AddBalance(address, big.NewInt(1000))
+	stateDb.SetNonce(address, 5)
+	root, err := stateDb.Commit(true)
+	require.Nil(t, err)
+
+	stateDb, err = state.New(root, stateDb.Database())
+	require.Nil(t, err)
+
+	// Existing account
+	proof, err := stateDb.GetProof(address)
+	require.Nil(t, err)
+	account, err := verifyAccountProof(root, address, proof)
+	require.Nil(t, err)
+	require.NotNil(t, account)
+	require.Equal(t, big.NewInt(1000), account.Balance)
+	require.Equal(t, uint64(5), account.Nonce)
+
+	// Missing account
+	other := common.HexToAddress("0x5678")
+	otherProof, err := stateDb.GetProof(other)
+	require.Nil(t, err)
+	account, err = verifyAccountProof(root, other, otherProof)
+	require.Nil(t, err)
+	require.Nil(t, account)
+
+	// Incomplete proofs, and proofs for another state, are refused
+	_, err = verifyAccountProof(root, other, proof[:len(proof)-1])
+	require.NotNil(t, err)
+	_, err = verifyAccountProof(common.HexToHash("0x42"), address, proof)
+	require.NotNil(t, err)
+}
+
+func TestService_ByzCoinID(t *testing.T) {
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	service := bct.servers[0].Service(ServiceName).(*Service)
+	rst, err := service.byzcoinService().GetReadOnlyStateTrie(bct.cl.ID)
+	require.Nil(t, err)
+
+	id, err := service.getByzCoinID(rst)
+	require.Nil(t, err)
+	require.True(t, id.Equal(bct.cl.ID))
+
+	// The ledger is remembered
+	require.Len(t, service.byzcoinIDs, 1)
+
+	id, err = service.getByzCoinID(rst)
+	require.Nil(t, err)
+	require.True(t, id.Equal(bct.cl.ID))
+}
+
+func TestService_EmittedInstructions(t *testing.T) {
+	log.LLvl1("Emitted ByzCoin instructions through the service API")
+
+	// Create a new ledger and prepare for proper closing
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	a, err := NewEvmAccount(testPrivateKeys[0])
+	require.Nil(t, err)
+
+	sourceID := bct.spawnCoins(100)
+	destinationID := bct.spawnCoins(0)
+
+	coinsBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coinsBuf, 40)
+	transferAddress := common.HexToAddress("0x2000")
+	alloc := core.GenesisAlloc{
+		a.Address: {Balance: big.NewInt(5 * WeiPerEther)},
+		transferAddress: {Balance: big.NewInt(0), Code: emitterCode(instructionLogs(t, sourceID, "invoke:coin.transfer",
+			byzcoin.Arguments{
+				{Name: "coins", Value: coinsBuf},
+				{Name: "destination", Value: destinationID.Slice()},
+			})...)},
+	}
+
+	instanceID, err := NewBEvmWithAlloc(bct.cl, bct.signer, bct.gDarc, Params{}, alloc)
+	require.Nil(t, err)
+
+	bevmClient, err := NewClient(bct.cl, bct.signer, instanceID)
+	require.Nil(t, err)
+
+	contractAbi, err := abi.JSON(strings.NewReader(
+		`[{"constant":false,"inputs":[],"name":"run","outputs":[],"type":"function"}]`))
+	require.Nil(t, err)
+	transferContract := &EvmContract{Abi: contractAbi, Address: transferAddress, name: "Transfer"}
+
+	tx, err := newMethodTx(txParams.GasLimit, txParams.GasPrice, 0, a, transferContract, "run")
+	require.Nil(t, err)
+	chainID, err := bevmClient.ChainID()
+	require.Nil(t, err)
+	signedTx, err := a.signTx(tx, chainID)
+	require.Nil(t, err)
+
+	service := bct.servers[0].Service(ServiceName).(*Service)
+
+	// The calling contract does not lend its authorization to the BEVM
+	// instance
+	rst, err := service.byzcoinService().GetReadOnlyStateTrie(bct.cl.ID)
+	require.Nil(t, err)
+	_, _, err = service.Transaction(rst, instanceID, signedTx)
+	require.NotNil(t, err)
+
+	bct.allowEmitter("invoke:coin.transfer", instanceID, transferAddress)
+
+	rst, err = service.byzcoinService().GetReadOnlyStateTrie(bct.cl.ID)
+	require.Nil(t, err)
+	receipt, stateChanges, err := service.Transaction(rst, instanceID, signedTx)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+
+	// The state changes include the transfer
+	rst, err = rst.StoreAllToReplica(stateChanges)
+	require.Nil(t, err)
+	value, _, _, _, err := rst.GetValues(destinationID.Slice())
+	require.Nil(t, err)
+	var coin byzcoin.Coin
+	require.Nil(t, protobuf.Decode(value, &coin))
+	require.Equal(t, uint64(40), coin.Value)
+}
@@ -0,0 +1,373 @@
+package bevm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// Simulation of EVM transactions.
+//
+// A transaction is executed on a throwaway copy of the EVM state, in the same
+// way as it would be by the "transaction" command, and the accounts and
+// storage slots it modifies are reported. The accounts possibly modified are
+// tracked during the execution using an EVM tracer, and the modifications are
+// then determined by comparing their state before and after the execution.
+// The ByzCoin instructions emitted by the transaction are executed on a
+// replica of the ByzCoin state trie, and their outcome is reported.
+// As simulations are neither authenticated nor paid for, their gas is capped
+// by the query gas cap of the service, and they are aborted after the query
+// timeout.
+
+// Selector of the Error(string) function, used to encode revert reasons
+var revertReasonSelector = crypto.Keccak256([]byte("Error(string)"))[:4]
+
+// Decode the revert reason returned by a failed EVM execution, if any
+func decodeRevertReason(ret []byte) string {
+	if len(ret) < 4 || !bytes.Equal(ret[:4], revertReasonSelector) {
+		return ""
+	}
+
+	args, err := newArguments("string")
+	if err != nil {
+		return ""
+	}
+
+	values, err := args.UnpackValues(ret[4:])
+	if err != nil {
+		log.Lvlf3("Cannot decode revert reason: %v", err)
+		return ""
+	}
+
+	return values[0].(string)
+}
+
+// changeTracker is an EVM tracer recording the accounts and storage slots
+// possibly modified by an execution
+type changeTracker struct {
+	accounts map[common.Address]map[common.Hash]bool
+}
+
+func newChangeTracker() *changeTracker {
+	return &changeTracker{accounts: make(map[common.Address]map[common.Hash]bool)}
+}
+
+// Record an account as possibly modified
+func (ct *changeTracker) touch(address common.Address) map[common.Hash]bool {
+	slots, ok := ct.accounts[address]
+	if !ok {
+		slots = make(map[common.Hash]bool)
+		ct.accounts[address] = slots
+	}
+
+	return slots
+}
+
+// CaptureStart implements vm.Tracer.CaptureStart()
+func (ct *changeTracker) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	ct.touch(from)
+	ct.touch(to)
+
+	return nil
+}
+
+// CaptureState implements vm.Tracer.CaptureState()
+func (ct *changeTracker) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	// Contracts executing code, including created ones
+	slots := ct.touch(contract.Address())
+	stackSize := len(stack.Data())
+
+	switch op {
+	case vm.SSTORE:
+		if stackSize >= 1 {
+			slots[common.BigToHash(stack.Back(0))] = true
+		}
+	case vm.CALL, vm.CALLCODE:
+		// Value transfers
+		if stackSize >= 2 {
+			ct.touch(common.BigToAddress(stack.Back(1)))
+		}
+	case vm.SELFDESTRUCT:
+		if stackSize >= 1 {
+			ct.touch(common.BigToAddress(stack.Back(0)))
+		}
+	}
+
+	return nil
+}
+
+// CaptureFault implements vm.Tracer.CaptureFault()
+func (ct *changeTracker) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd implements vm.Tracer.CaptureEnd()
+func (ct *changeTracker) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
+	return nil
+}
+
+// Compare the state of the tracked accounts before and after an execution
+func (ct *changeTracker) changes(before *state.StateDB, after *state.StateDB) []AccountChange {
+	var changes []AccountChange
+
+	for address, slots := range ct.accounts {
+		change := AccountChange{
+			Address:       address.Bytes(),
+			BalanceBefore: before.GetBalance(address).Bytes(),
+			BalanceAfter:  after.GetBalance(address).Bytes(),
+			NonceBefore:   before.GetNonce(address),
+			NonceAfter:    after.GetNonce(address),
+		}
+
+		modified := !bytes.Equal(change.BalanceBefore, change.BalanceAfter) ||
+			change.NonceBefore != change.NonceAfter
+
+		if before.GetCodeHash(address) != after.GetCodeHash(address) {
+			change.CodeAfter = after.GetCode(address)
+			change.CodeChanged = true
+			modified = true
+		}
+
+		for slot := range slots {
+			valueBefore := before.GetState(address, slot)
+			valueAfter := after.GetState(address, slot)
+			if valueBefore != valueAfter {
+				change.Storage = append(change.Storage, StorageChange{
+					Key:    slot.Bytes(),
+					Before: valueBefore.Bytes(),
+					After:  valueAfter.Bytes(),
+				})
+			}
+		}
+		sort.Slice(change.Storage, func(i, j int) bool {
+			return bytes.Compare(change.Storage[i].Key, change.Storage[j].Key) < 0
+		})
+
+		if modified || len(change.Storage) > 0 {
+			changes = append(changes, change)
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return bytes.Compare(changes[i].Address, changes[j].Address) < 0
+	})
+
+	return changes
+}
+
+// Apply an EVM message with the given hash to an EVM state database as the
+// "transaction" command would, gas fees included (but without storing the
+// receipt), optionally tracing its execution, and aborting it at the given
+// deadline (if any). Return the receipt, the data returned by the execution
+// and the recipients of the gas fees.
+func applyEvmMessage(rst byzcoin.ReadOnlyStateTrie, stateDb *state.StateDB, bi *blockInfo, params Params,
+	msg types.Message, txHash common.Hash, tracer vm.Tracer, deadline time.Time) (*types.Receipt, []byte, []common.Address, error) {
+	vmConfig := getVMConfig()
+	if tracer != nil {
+		vmConfig.Debug = true
+		vmConfig.Tracer = tracer
+	}
+
+	header := bi.header()
+	header.GasLimit = params.GasLimit
+
+	// The nonce used for contract creation is the current one of the sender
+	nonce := stateDb.GetNonce(msg.From())
+
+	stateDb.Prepare(txHash, common.Hash{}, 0)
+
+	ctx := core.NewEVMContext(msg, header, byzChainContext{bi: bi}, &nilAddress)
+	evm := vm.NewEVM(ctx, stateDb, getChainConfig(params), vmConfig)
+	gp := new(core.GasPool).AddGas(params.GasLimit)
+
+	unbind := bindPrecompileContext(rstInstanceReader(rst))
+	checkAborted := abortAtDeadline(evm, deadline)
+	ret, gasUsed, failed, err := core.ApplyMessage(evm, msg, gp)
+	abortErr := checkAborted()
+	unbind()
+	if abortErr != nil {
+		return nil, nil, nil, abortErr
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = bi.checkHashLookups()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stateDb.Finalise(true)
+
+	feeRecipients, err := getFeeRecipients(rst, params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	distributeFees(stateDb, new(big.Int).Mul(new(big.Int).SetUint64(gasUsed), msg.GasPrice()), feeRecipients)
+
+	receipt := types.NewReceipt(nil, failed, gasUsed)
+	receipt.TxHash = txHash
+	receipt.GasUsed = gasUsed
+	if msg.To() == nil {
+		receipt.ContractAddress = crypto.CreateAddress(msg.From(), nonce)
+	}
+	receipt.Logs = stateDb.GetLogs(txHash)
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+
+	err = checkTxOutcome(stateDb, params, receipt, msg.To() == nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return receipt, ret, feeRecipients, nil
+}
+
+// Execute the ByzCoin instructions emitted by a simulated EVM transaction on
+// a replica of the state trie, as the "transaction" command would, and return
+// their number along with the reason for which they would be refused, if any
+func (s *Service) simulateEmittedInstructions(rst byzcoin.ReadOnlyStateTrie, bevmID byzcoin.InstanceID,
+	receipt *types.Receipt) (int, string, error) {
+	instrs, err := emittedInstructions(receipt)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if len(instrs) == 0 {
+		return 0, "", nil
+	}
+
+	c, darcID, err := s.loadBEvm(rst, bevmID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// The state changes are discarded
+	_, _, err = c.executeEmittedInstructions(rst, bevmID, darcID, instrs, nil)
+	if err != nil {
+		log.Lvlf2("Simulated transaction: emitted ByzCoin instructions refused: %v", err)
+		return len(instrs), err.Error(), nil
+	}
+
+	return len(instrs), "", nil
+}
+
+// Simulate the execution of an EVM message with the given hash on a BEVM
+// instance, without modifying its state, aborting it at the given deadline
+func (s *Service) simulateMessage(rst byzcoin.ReadOnlyStateTrie, bs *State, bevmID byzcoin.InstanceID, bi *blockInfo,
+	msg types.Message, txHash common.Hash, deadline time.Time) (*SimulateResponse, error) {
+	before, err := NewEvmDb(bs, rst, bevmID)
+	if err != nil {
+		return nil, err
+	}
+
+	stateDb, err := NewEvmDb(bs, rst, bevmID)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker := newChangeTracker()
+
+	receipt, ret, feeRecipients, err := applyEvmMessage(rst, stateDb, bi, bs.GetParams(bevmID), msg, txHash, tracker, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	// The gas fees are distributed as for actual transactions
+	for _, recipient := range feeRecipients {
+		tracker.touch(recipient)
+	}
+	tracker.touch(nilAddress)
+	if msg.To() == nil {
+		tracker.touch(receipt.ContractAddress)
+	}
+
+	receiptData, err := encodeReceipt(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &SimulateResponse{
+		Receipt:    receiptData,
+		ReturnData: ret,
+		Changes:    tracker.changes(before, stateDb),
+	}
+	if receipt.Status == types.ReceiptStatusFailed {
+		resp.RevertReason = decodeRevertReason(ret)
+	}
+
+	instrCount, instrErr, err := s.simulateEmittedInstructions(rst, bevmID, receipt)
+	if err != nil {
+		return nil, err
+	}
+	resp.EmittedInstructions = uint64(instrCount)
+	resp.InstructionsError = instrErr
+
+	log.Lvlf2("Simulated transaction: status = %d, gas used = %d, %d accounts modified",
+		receipt.Status, receipt.GasUsed, len(resp.Changes))
+
+	return resp, nil
+}
+
+// Build the EVM message to simulate, as well as its hash, from a simulation
+// request. The gas of the message does not exceed the query gas cap.
+func simulatedMessage(req *SimulateRequest, bs *State, bevmID byzcoin.InstanceID) (types.Message, common.Hash, error) {
+	params := bs.GetParams(bevmID)
+
+	if len(req.Tx) == 0 {
+		// Unsigned transaction: the nonce is not checked
+		var to *common.Address
+		if len(req.To) != 0 {
+			address := common.BytesToAddress(req.To)
+			to = &address
+		}
+
+		gasLimit := req.GasLimit
+		if gasLimit == 0 || gasLimit > params.GasLimit {
+			gasLimit = params.GasLimit
+		}
+		gasLimit = capQueryGas(gasLimit)
+
+		msg := types.NewMessage(common.BytesToAddress(req.From), to, 0, new(big.Int).SetBytes(req.Value),
+			gasLimit, new(big.Int).SetBytes(req.GasPrice), req.Data, false)
+
+		return msg, common.Hash{}, nil
+	}
+
+	// Signed transaction, subject to the same checks as actual ones
+	var tx types.Transaction
+	err := tx.UnmarshalJSON(req.Tx)
+	if err != nil {
+		return types.Message{}, common.Hash{}, err
+	}
+
+	if !tx.Protected() {
+		return types.Message{}, common.Hash{}, errors.New("EVM transaction is not replay-protected (EIP-155)")
+	}
+
+	if tx.GasPrice().Cmp(new(big.Int).SetUint64(params.MinGasPrice)) < 0 {
+		return types.Message{}, common.Hash{}, errors.New("EVM transaction gas price is lower than the minimum")
+	}
+
+	// Its gas cannot be lowered without invalidating its signature
+	if tx.Gas() > queryGasCap {
+		return types.Message{}, common.Hash{}, fmt.Errorf("EVM transaction gas limit (%d) exceeds the maximum of simulations (%d)",
+			tx.Gas(), queryGasCap)
+	}
+
+	msg, err := tx.AsMessage(types.NewEIP155Signer(new(big.Int).SetUint64(params.ChainID)))
+	if err != nil {
+		return types.Message{}, common.Hash{}, err
+	}
+
+	return msg, tx.Hash(), nil
+}
@@ -0,0 +1,72 @@
+package bevm
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestSimulate_Limits(t *testing.T) {
+	log.LLvl1("Simulation limits")
+
+	bevmID := byzcoin.NewInstanceID(nil)
+	bs := &State{Params: Params{GasLimit: 1e18}}
+	loop := common.HexToAddress("0x2000")
+
+	// The gas of unsigned messages is capped, including when the gas limit
+	// of the instance is used
+	for _, gasLimit := range []uint64{0, 1e12} {
+		msg, _, err := simulatedMessage(&SimulateRequest{To: loop.Bytes(), GasLimit: gasLimit}, bs, bevmID)
+		require.Nil(t, err)
+		require.Equal(t, queryGasCap, msg.Gas())
+	}
+
+	msg, _, err := simulatedMessage(&SimulateRequest{To: loop.Bytes(), GasLimit: 100000}, bs, bevmID)
+	require.Nil(t, err)
+	require.Equal(t, uint64(100000), msg.Gas())
+
+	// Signed transactions exceeding the cap are refused
+	key, err := crypto.GenerateKey()
+	require.Nil(t, err)
+	signer := types.NewEIP155Signer(new(big.Int).SetUint64(bs.GetParams(bevmID).ChainID))
+
+	for _, gasLimit := range []uint64{queryGasCap, queryGasCap + 1} {
+		tx, err := types.SignTx(types.NewTransaction(0, loop, big.NewInt(0), gasLimit, big.NewInt(0), nil),
+			signer, key)
+		require.Nil(t, err)
+		txData, err := tx.MarshalJSON()
+		require.Nil(t, err)
+
+		_, _, err = simulatedMessage(&SimulateRequest{Tx: txData}, bs, bevmID)
+		if gasLimit > queryGasCap {
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), "exceeds the maximum")
+		} else {
+			require.Nil(t, err)
+		}
+	}
+
+	// The execution is aborted at the deadline:
+	// JUMPDEST PUSH1 0 JUMP (endless loop)
+	stateDb, err := newEvmMemDb()
+	require.Nil(t, err)
+	stateDb.SetCode(loop, []byte{0x5b, 0x60, 0x00, 0x56})
+
+	bi := &blockInfo{
+		number:  big.NewInt(1),
+		getHash: func(uint64) common.Hash { return common.Hash{} },
+	}
+	msg, _, err = simulatedMessage(&SimulateRequest{To: loop.Bytes()}, bs, bevmID)
+	require.Nil(t, err)
+
+	_, _, _, err = applyEvmMessage(nil, stateDb, bi, bs.GetParams(bevmID), msg, common.Hash{}, nil, time.Now())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "aborted")
+}
@@ -0,0 +1,176 @@
+package bevm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// Snapshot is a portable representation of the world state of a BEVM
+// instance: accounts with their balance, nonce, code and storage. Accounts use
+// the format of the "alloc" section of Ethereum genesis files.
+type Snapshot struct {
+	Root     common.Hash       `json:"root"` // Root hash of the EVM state
+	Accounts core.GenesisAlloc `json:"accounts"`
+}
+
+// LoadSnapshot reads a snapshot from a JSON file
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// Save writes the snapshot to a JSON file
+func (snapshot *Snapshot) Save(path string) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// LoadGenesisAlloc reads a genesis allocation from a JSON file, which can
+// either be an Ethereum genesis file (with an "alloc" section) or only
+// contain its "alloc" section
+func LoadGenesisAlloc(path string) (core.GenesisAlloc, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := fields["alloc"]; ok {
+		var genesis core.Genesis
+		err = json.Unmarshal(data, &genesis)
+		if err != nil {
+			return nil, errors.New("Invalid genesis file: " + err.Error())
+		}
+
+		return genesis.Alloc, nil
+	}
+
+	var alloc core.GenesisAlloc
+	err = json.Unmarshal(data, &alloc)
+	if err != nil {
+		return nil, errors.New("Invalid genesis allocation: " + err.Error())
+	}
+
+	return alloc, nil
+}
+
+// Take a snapshot of an EVM state database. Account addresses and storage
+// keys are hashed in the EVM state trie, so their preimages must be available.
+func takeSnapshot(stateDb *state.StateDB) (*Snapshot, error) {
+	root := stateDb.IntermediateRoot(false)
+	db := stateDb.Database()
+
+	accountTrie, err := db.OpenTrie(root)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Root:     root,
+		Accounts: make(core.GenesisAlloc),
+	}
+
+	it := trie.NewIterator(accountTrie.NodeIterator(nil))
+	for it.Next() {
+		addressBytes := accountTrie.GetKey(it.Key)
+		if addressBytes == nil {
+			return nil, fmt.Errorf("Missing preimage of account hash %x", it.Key)
+		}
+		address := common.BytesToAddress(addressBytes)
+
+		var data state.Account
+		err = rlp.DecodeBytes(it.Value, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		account := core.GenesisAccount{
+			Balance: data.Balance,
+			Nonce:   data.Nonce,
+			Code:    stateDb.GetCode(address),
+			Storage: make(map[common.Hash]common.Hash),
+		}
+
+		storageTrie, err := db.OpenStorageTrie(common.BytesToHash(it.Key), data.Root)
+		if err != nil {
+			return nil, err
+		}
+
+		storageIt := trie.NewIterator(storageTrie.NodeIterator(nil))
+		for storageIt.Next() {
+			keyBytes := storageTrie.GetKey(storageIt.Key)
+			if keyBytes == nil {
+				return nil, fmt.Errorf("Missing preimage of storage key hash %x", storageIt.Key)
+			}
+
+			// Storage values are RLP-encoded in the trie
+			_, content, _, err := rlp.Split(storageIt.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			account.Storage[common.BytesToHash(keyBytes)] = common.BytesToHash(content)
+		}
+		if storageIt.Err != nil {
+			return nil, storageIt.Err
+		}
+
+		snapshot.Accounts[address] = account
+	}
+	if it.Err != nil {
+		return nil, it.Err
+	}
+
+	return snapshot, nil
+}
+
+// Apply accounts to an EVM state database
+func applyGenesisAlloc(stateDb *state.StateDB, alloc core.GenesisAlloc) {
+	for address, account := range alloc {
+		if account.Balance != nil {
+			stateDb.SetBalance(address, account.Balance)
+		}
+		stateDb.SetNonce(address, account.Nonce)
+		stateDb.SetCode(address, account.Code)
+		for key, value := range account.Storage {
+			stateDb.SetState(address, key, value)
+		}
+	}
+}
+
+// Check that the state root of an EVM state database after importing a
+// snapshot is the one recorded in the snapshot
+func (snapshot *Snapshot) checkRoot(root common.Hash) error {
+	if snapshot.Root != (common.Hash{}) && snapshot.Root != root {
+		return errors.New("Snapshot state root mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package bevm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadGenesisAlloc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "bevm")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	load := func(content string) error {
+		path := filepath.Join(tmpDir, "genesis.json")
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		require.Nil(t, err)
+
+		alloc, err := LoadGenesisAlloc(path)
+		if err != nil {
+			return err
+		}
+
+		account, ok := alloc[common.HexToAddress("0x1000")]
+		require.True(t, ok)
+		require.Equal(t, int64(16), account.Balance.Int64())
+
+		return nil
+	}
+
+	// Ethereum genesis file
+	require.Nil(t, load(`{"config": {"chainId": 1234}, "gasLimit": "0x1000000",
+		"alloc": {"0x0000000000000000000000000000000000001000": {"balance": "0x10"}}}`))
+
+	// Only the "alloc" section
+	require.Nil(t, load(`{"0000000000000000000000000000000000001000": {"balance": "16"}}`))
+
+	// The errors of genesis files are reported as such
+	err = load(`{"gasLimit": "invalid",
+		"alloc": {"0x0000000000000000000000000000000000001000": {"balance": "0x10"}}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Invalid genesis file")
+
+	err = load(`{"0x0000000000000000000000000000000000001000": {"balance": "invalid"}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Invalid genesis allocation")
+
+	_, err = LoadGenesisAlloc(filepath.Join(tmpDir, "missing.json"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,622 @@
+package bevm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+)
+
+// Tracing of EVM transactions.
+//
+// A transaction is traced either by replaying an executed transaction, or by
+// simulating a new one. The execution is recorded by an EVM tracer, as a list
+// of opcode steps (similar to the struct logger of geth) and as a tree of the
+// calls made, flattened into a list where each call refers to its parent.
+//
+// An executed transaction is replayed on the EVM state of its instance before
+// the ByzCoin instruction executing it, after the transactions executed
+// earlier by the same instruction, using the records stored along with the
+// receipts. This requires the EVM state at that time not to have been pruned.
+// The transactions are executed again as they were by the instruction, in the
+// same EVM block, and their outcome is compared with the one recorded.
+//
+// As simulations, traces are bounded: the gas of a simulated transaction is
+// capped, the executions are aborted after the query timeout, and the traced
+// execution is aborted once the maximum number of steps is reached.
+
+// Maximum number of steps of a traced execution
+const traceMaxSteps = 10000
+
+// Number of topmost stack items recorded by a trace step
+const traceStackItems = 8
+
+// Number of leading memory bytes recorded by a trace step
+const traceMemoryBytes = 256
+
+// Call in progress during a traced execution
+type tracedCall struct {
+	index     int    // Index of the call in the trace
+	retOffset uint64 // Memory location receiving the returned data
+	retSize   uint64
+	started   bool   // Whether the called code has been entered
+	gasLeft   uint64 // Gas left after the latest step of the call
+}
+
+// EVM tracer aborting an execution once a deadline has passed (if any)
+type deadlineTracer struct {
+	deadline time.Time
+	aborted  bool
+}
+
+// Abort the execution if the deadline has passed
+func (t *deadlineTracer) checkDeadline(env *vm.EVM) {
+	if !t.aborted && !t.deadline.IsZero() && time.Now().After(t.deadline) {
+		t.aborted = true
+		env.Cancel()
+	}
+}
+
+// Return an error if the execution was aborted, as the EVM then reports it as
+// successful
+func (t *deadlineTracer) abortErr() error {
+	if t.aborted {
+		return errQueryTimeout
+	}
+
+	return nil
+}
+
+// CaptureStart implements vm.Tracer
+func (t *deadlineTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	return nil
+}
+
+// CaptureState implements vm.Tracer
+func (t *deadlineTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	t.checkDeadline(env)
+
+	return nil
+}
+
+// CaptureFault implements vm.Tracer
+func (t *deadlineTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd implements vm.Tracer
+func (t *deadlineTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+// EVM tracer recording the steps and the calls of an execution, and aborting
+// it at the maximum number of steps or at the deadline
+type evmTracer struct {
+	deadlineTracer
+	steps     []TraceStep
+	calls     []TraceCall
+	callStack []tracedCall
+	truncated bool // Set if the execution was aborted at the maximum number of steps
+}
+
+func newEvmTracer(deadline time.Time) *evmTracer {
+	return &evmTracer{deadlineTracer: deadlineTracer{deadline: deadline}}
+}
+
+// Data returned by the traced execution
+func (t *evmTracer) output() []byte {
+	if len(t.calls) == 0 {
+		return nil
+	}
+
+	return t.calls[0].Output
+}
+
+// CaptureStart implements vm.Tracer, and records the top-level call
+func (t *evmTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	callType := vm.CALL.String()
+	if create {
+		callType = vm.CREATE.String()
+	}
+
+	t.calls = append(t.calls, TraceCall{
+		Type:   callType,
+		From:   from.Bytes(),
+		To:     to.Bytes(),
+		Value:  value.Bytes(),
+		Gas:    gas,
+		Input:  common.CopyBytes(input),
+		Depth:  1,
+		Parent: -1,
+	})
+	t.callStack = []tracedCall{{index: 0, started: true, gasLeft: gas}}
+
+	return nil
+}
+
+// CaptureState implements vm.Tracer, and records an opcode step
+func (t *evmTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	t.checkDeadline(env)
+
+	// The execution is aborted rather than left running unrecorded: the
+	// current step, not recorded, is the last one executed
+	if len(t.steps) >= traceMaxSteps {
+		if !t.truncated {
+			t.truncated = true
+			env.Cancel()
+		}
+		return nil
+	}
+
+	// Calls whose depth is above the current one have returned
+	for len(t.callStack) > depth && len(t.callStack) > 1 {
+		t.returnCall(memory, stack)
+	}
+
+	t.recordStep(pc, op, gas, cost, memory, stack, depth, err)
+
+	if len(t.callStack) == depth {
+		current := &t.callStack[len(t.callStack)-1]
+		if !current.started {
+			// The gas actually available to the call is only known once
+			// its code is entered
+			current.started = true
+			t.calls[current.index].Gas = gas
+		}
+		if cost <= gas {
+			current.gasLeft = gas - cost
+		}
+	}
+
+	if err != nil {
+		t.setCallError(depth, err)
+		return nil
+	}
+
+	switch op {
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL, vm.CREATE, vm.CREATE2:
+		t.enterCall(op, memory, stack, contract, depth)
+	}
+
+	return nil
+}
+
+// CaptureFault implements vm.Tracer, and records the error of the latest step
+func (t *evmTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if len(t.steps) > 0 && !t.truncated {
+		t.steps[len(t.steps)-1].Error = err.Error()
+	}
+	t.setCallError(depth, err)
+
+	return nil
+}
+
+// CaptureEnd implements vm.Tracer, and completes the top-level call
+func (t *evmTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	if len(t.calls) == 0 {
+		return nil
+	}
+
+	root := &t.calls[0]
+	root.Output = common.CopyBytes(output)
+	root.GasUsed = gasUsed
+	if err != nil && root.Error == "" {
+		root.Error = err.Error()
+	}
+	t.callStack = nil
+
+	return nil
+}
+
+// Record an opcode step
+func (t *evmTracer) recordStep(pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, depth int, err error) {
+	step := TraceStep{
+		PC:         pc,
+		Op:         op.String(),
+		Gas:        gas,
+		GasCost:    cost,
+		Depth:      depth,
+		MemorySize: uint64(memory.Len()),
+	}
+
+	// The stack items are listed from the top
+	items := stack.Data()
+	for i := len(items) - 1; i >= 0 && len(step.Stack) < traceStackItems; i-- {
+		step.Stack = append(step.Stack, items[i].Bytes())
+	}
+
+	step.Memory = memorySlice(memory, 0, traceMemoryBytes)
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	t.steps = append(t.steps, step)
+}
+
+// Record a call made by an opcode, before it is executed
+func (t *evmTracer) enterCall(op vm.OpCode, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int) {
+	items := stack.Data()
+	arg := func(n int) *big.Int {
+		if n >= len(items) {
+			return new(big.Int)
+		}
+		return items[len(items)-1-n]
+	}
+
+	call := TraceCall{
+		Type:   op.String(),
+		From:   contract.Address().Bytes(),
+		Depth:  depth + 1,
+		Parent: t.callStack[len(t.callStack)-1].index,
+	}
+	traced := tracedCall{index: len(t.calls)}
+
+	switch op {
+	case vm.CREATE, vm.CREATE2:
+		// The address of the created contract is known once it returns
+		call.Value = arg(0).Bytes()
+		call.Input = memorySlice(memory, arg(1).Uint64(), arg(2).Uint64())
+		call.Gas = contract.Gas
+
+	case vm.CALL, vm.CALLCODE:
+		call.Gas = arg(0).Uint64()
+		call.To = common.BigToAddress(arg(1)).Bytes()
+		call.Value = arg(2).Bytes()
+		call.Input = memorySlice(memory, arg(3).Uint64(), arg(4).Uint64())
+		traced.retOffset, traced.retSize = arg(5).Uint64(), arg(6).Uint64()
+
+	default: // DELEGATECALL, STATICCALL
+		call.Gas = arg(0).Uint64()
+		call.To = common.BigToAddress(arg(1)).Bytes()
+		call.Input = memorySlice(memory, arg(2).Uint64(), arg(3).Uint64())
+		traced.retOffset, traced.retSize = arg(4).Uint64(), arg(5).Uint64()
+	}
+
+	t.calls = append(t.calls, call)
+	t.callStack = append(t.callStack, traced)
+}
+
+// Complete the innermost call in progress, which has returned to its caller.
+// The caller stack and memory are the ones following the call.
+func (t *evmTracer) returnCall(memory *vm.Memory, stack *vm.Stack) {
+	traced := t.callStack[len(t.callStack)-1]
+	t.callStack = t.callStack[:len(t.callStack)-1]
+
+	call := &t.calls[traced.index]
+	if traced.started {
+		call.GasUsed = call.Gas - traced.gasLeft
+	}
+
+	// The call pushes its outcome: the address of the created contract, or
+	// whether the call succeeded
+	items := stack.Data()
+	var result *big.Int
+	if len(items) > 0 {
+		result = items[len(items)-1]
+	} else {
+		result = new(big.Int)
+	}
+
+	switch call.Type {
+	case vm.CREATE.String(), vm.CREATE2.String():
+		if result.Sign() != 0 {
+			call.To = common.BigToAddress(result).Bytes()
+		}
+	default:
+		call.Output = memorySlice(memory, traced.retOffset, traced.retSize)
+	}
+
+	if result.Sign() == 0 && call.Error == "" {
+		call.Error = "call failed"
+	}
+}
+
+// Record the error of the call in progress at the given depth
+func (t *evmTracer) setCallError(depth int, err error) {
+	if depth < 1 || depth > len(t.callStack) {
+		return
+	}
+
+	call := &t.calls[t.callStack[depth-1].index]
+	if call.Error == "" {
+		call.Error = err.Error()
+	}
+}
+
+// Copy a region of the EVM memory, truncated to the memory size
+func memorySlice(memory *vm.Memory, offset, size uint64) []byte {
+	data := memory.Data()
+	if offset >= uint64(len(data)) || size == 0 {
+		return nil
+	}
+
+	end := offset + size
+	if end > uint64(len(data)) || end < offset {
+		end = uint64(len(data))
+	}
+
+	return common.CopyBytes(data[offset:end])
+}
+
+// Build the response to a trace request from the outcome of the traced
+// execution
+func newTraceResponse(receipt *types.Receipt, ret []byte, tracer *evmTracer) (*TraceResponse, error) {
+	receiptData, err := encodeReceipt(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &TraceResponse{
+		Receipt:    receiptData,
+		ReturnData: ret,
+		Steps:      tracer.steps,
+		Calls:      tracer.calls,
+		Truncated:  tracer.truncated,
+	}
+	if receipt.Status == types.ReceiptStatusFailed {
+		resp.RevertReason = decodeRevertReason(ret)
+	}
+
+	log.Lvlf2("Traced transaction: status = %d, %d steps, %d calls",
+		receipt.Status, len(resp.Steps), len(resp.Calls))
+
+	return resp, nil
+}
+
+// Execute an EVM message on a BEVM instance with a tracer, without modifying
+// its state, aborting it at the given deadline
+func traceMessage(rst byzcoin.ReadOnlyStateTrie, stateDb *state.StateDB, bi *blockInfo, params Params,
+	msg types.Message, txHash common.Hash, deadline time.Time) (*TraceResponse, error) {
+	// The deadline is enforced by applyEvmMessage()
+	tracer := newEvmTracer(time.Time{})
+
+	receipt, ret, _, err := applyEvmMessage(rst, stateDb, bi, params, msg, txHash, tracer, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTraceResponse(receipt, ret, tracer)
+}
+
+// Load the record of an executed transaction from the EVM state database
+func loadTxRecord(stateDb *state.StateDB, txHash common.Hash) (*txRecord, *types.Transaction, error) {
+	recordData, err := stateDb.Database().TrieDB().DiskDB().Get(getTxRecordKey(txHash))
+	if err != nil {
+		return nil, nil, fmt.Errorf("No record of EVM transaction '%s': %v", txHash.Hex(), err)
+	}
+
+	var record txRecord
+	err = protobuf.Decode(recordData, &record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tx types.Transaction
+	err = tx.UnmarshalJSON(record.Tx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &record, &tx, nil
+}
+
+// Execute an executed transaction again as the instruction did (see
+// executeTx()), as the next transaction of the given EVM block, and with the
+// chain ID for which it was signed. The tracer aborts it at the deadline.
+func replayTxExecution(rst byzcoin.ReadOnlyStateTrie, stateDb *state.StateDB, bi *blockInfo, params Params,
+	block *txBlock, tx *types.Transaction, tracer abortingTracer) (*types.Receipt, error) {
+	params.ChainID = tx.ChainId().Uint64()
+
+	receipt, err := applyTx(rst, stateDb, bi, params, block, tx, tracer)
+	if abortErr := tracer.abortErr(); abortErr != nil {
+		return nil, abortErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot replay EVM transaction '%s': %v", tx.Hash().Hex(), err)
+	}
+
+	return receipt, nil
+}
+
+// EVM tracer able to abort an execution
+type abortingTracer interface {
+	vm.Tracer
+	abortErr() error
+}
+
+// Replay an executed transaction of a BEVM instance with a tracer. The
+// transactions are replayed with the chain ID for which they were signed, but
+// the other parameters of the instance, the recipients of the gas fees and
+// the ByzCoin instances read by the precompiled contracts are the current
+// ones: if they changed in the meantime, the replay may diverge from the
+// actual execution, which is detected by comparing the outcome of each
+// replayed transaction with the recorded one.
+func (s *Service) replayTx(rst byzcoin.ReadOnlyStateTrie, bs *State, bevmID byzcoin.InstanceID,
+	txHash common.Hash, deadline time.Time) (*TraceResponse, error) {
+	currentDb, err := NewEvmDb(bs, rst, bevmID)
+	if err != nil {
+		return nil, err
+	}
+
+	record, tx, err := loadTxRecord(currentDb, txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	byzcoinID, err := s.getByzCoinID(rst)
+	if err != nil {
+		return nil, err
+	}
+
+	bi, err := s.getBlockInfoAt(byzcoinID, int(record.BlockIndex))
+	if err != nil {
+		return nil, err
+	}
+
+	// EVM state of the instance before the instruction
+	pastState := *bs
+	pastState.RootHash = common.BytesToHash(record.Root)
+
+	stateDb, err := NewEvmDb(&pastState, rst, bevmID)
+	if err != nil {
+		return nil, fmt.Errorf("EVM state preceding the transaction is not available anymore: %v", err)
+	}
+
+	// The transactions of the instruction share its EVM block
+	params := bs.GetParams(bevmID)
+	block := newTxBlock(params.GasLimit)
+	diverged := false
+
+	for _, previousHash := range record.Previous {
+		previousRecord, previousTx, err := loadTxRecord(currentDb, common.BytesToHash(previousHash))
+		if err != nil {
+			return nil, err
+		}
+
+		receipt, err := replayTxExecution(rst, stateDb, bi, params, block, previousTx,
+			&deadlineTracer{deadline: deadline})
+		if err != nil {
+			return nil, err
+		}
+
+		if !matchesExecution(currentDb, stateDb, bi, params, previousRecord, receipt) {
+			diverged = true
+		}
+	}
+
+	tracer := newEvmTracer(deadline)
+
+	receipt, err := replayTxExecution(rst, stateDb, bi, params, block, tx, tracer)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := newTraceResponse(receipt, tracer.output(), tracer)
+	if err != nil {
+		return nil, err
+	}
+
+	// A truncated execution was aborted, and its outcome is meaningless
+	resp.Diverged = !resp.Truncated && (diverged || !matchesExecution(currentDb, stateDb, bi, params, record, receipt))
+	if resp.Diverged {
+		log.Lvlf2("Replay of transaction '%s' diverges from its execution", txHash.Hex())
+	}
+
+	return resp, nil
+}
+
+// Check whether a replayed transaction matches its execution: its receipt
+// must match the stored one (status, gas used and logs), and the EVM state
+// following it the recorded one, if any (records stored by earlier versions
+// lack it)
+func matchesExecution(currentDb *state.StateDB, stateDb *state.StateDB, bi *blockInfo, params Params,
+	record *txRecord, receipt *types.Receipt) bool {
+	receiptData, err := currentDb.Database().TrieDB().DiskDB().Get(getReceiptKey(receipt.TxHash))
+	if err != nil {
+		return false
+	}
+
+	stored, err := decodeReceipt(receiptData)
+	if err != nil {
+		return false
+	}
+
+	if stored.Status != receipt.Status || stored.GasUsed != receipt.GasUsed ||
+		!equalLogs(stored.Logs, receipt.Logs) {
+		return false
+	}
+
+	if len(record.PostRoot) != 0 &&
+		postStateRoot(stateDb, bi, params) != common.BytesToHash(record.PostRoot) {
+		return false
+	}
+
+	return true
+}
+
+// Compare the content of two lists of logs
+func equalLogs(a []*types.Log, b []*types.Log) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Address != b[i].Address || !bytes.Equal(a[i].Data, b[i].Data) ||
+			len(a[i].Topics) != len(b[i].Topics) {
+			return false
+		}
+
+		for j := range a[i].Topics {
+			if a[i].Topics[j] != b[i].Topics[j] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Trace executes an EVM transaction on a BEVM instance with a tracer, and
+// returns the steps and calls of its execution. The transaction is either an
+// executed one, which is replayed, or a new one, which is simulated.
+func (s *Service) Trace(req *TraceRequest) (*TraceResponse, error) {
+	bs, proof, rst, err := s.getBEvmStateWithProof(req.ByzCoinID, req.BEvmID)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *TraceResponse
+	deadline := time.Now().Add(queryTimeout)
+
+	if len(req.TxHash) != 0 {
+		if len(req.Tx) != 0 {
+			return nil, errors.New("A trace request cannot provide both a transaction hash and a transaction")
+		}
+
+		resp, err = s.replayTx(rst, bs, req.BEvmID, common.BytesToHash(req.TxHash), deadline)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		bi, err := s.getBlockInfo(rst)
+		if err != nil {
+			return nil, err
+		}
+
+		msg, txHash, err := simulatedMessage(&SimulateRequest{
+			Tx:       req.Tx,
+			From:     req.From,
+			To:       req.To,
+			Value:    req.Value,
+			GasLimit: req.GasLimit,
+			GasPrice: req.GasPrice,
+			Data:     req.Data,
+		}, bs, req.BEvmID)
+		if err != nil {
+			return nil, err
+		}
+
+		stateDb, err := NewEvmDb(bs, rst, req.BEvmID)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err = traceMessage(rst, stateDb, bi, bs.GetParams(req.BEvmID), msg, txHash, deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp.Proof = *proof
+
+	return resp, nil
+}
@@ -0,0 +1,62 @@
+package bevm
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestTrace_Limits(t *testing.T) {
+	log.LLvl1("Trace limits")
+
+	bevmID := byzcoin.NewInstanceID(nil)
+	bs := &State{}
+	params := bs.GetParams(bevmID)
+	loop := common.HexToAddress("0x2000")
+
+	bi := &blockInfo{
+		number:  big.NewInt(1),
+		getHash: func(uint64) common.Hash { return common.Hash{} },
+	}
+
+	// JUMPDEST PUSH1 0 JUMP: endless loop
+	newStateDb := func() *state.StateDB {
+		stateDb, err := newEvmMemDb()
+		require.Nil(t, err)
+		stateDb.SetCode(loop, []byte{0x5b, 0x60, 0x00, 0x56})
+
+		return stateDb
+	}
+
+	msg, _, err := simulatedMessage(&SimulateRequest{To: loop.Bytes()}, bs, bevmID)
+	require.Nil(t, err)
+
+	// The execution is aborted once the maximum number of steps is reached,
+	// instead of running out of gas
+	resp, err := traceMessage(nil, newStateDb(), bi, params, msg, common.Hash{}, time.Time{})
+	require.Nil(t, err)
+	require.True(t, resp.Truncated)
+	require.Len(t, resp.Steps, traceMaxSteps)
+
+	receipt, err := decodeReceipt(resp.Receipt)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	require.True(t, receipt.GasUsed < msg.Gas()/2)
+
+	// The deadline also aborts it
+	_, err = traceMessage(nil, newStateDb(), bi, params, msg, common.Hash{}, time.Now())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "aborted")
+
+	tracer := &deadlineTracer{deadline: time.Now()}
+	_, _, _, err = applyEvmMessage(nil, newStateDb(), bi, params, msg, common.Hash{}, tracer, time.Time{})
+	require.Nil(t, err)
+	require.NotNil(t, tracer.abortErr())
+}
@@ -41,8 +41,9 @@ func (c *Client) GenBytecode(dst *network.ServerIdentity, sourceFiles map[string
 	return response, nil
 }
 
-func (c *Client) DeployContract(dst *network.ServerIdentity, gasLimit uint64, gasPrice uint64, amount uint64, nonce uint64, bytecode []byte, abi string, args ...string) (*TransactionHashResponse, error) {
-	request := &DeployRequest{
+func (c *Client) DeployContract(dst *network.ServerIdentity, chainID uint64, gasLimit uint64, gasPrice uint64, amount uint64, nonce uint64, bytecode []byte, abi string, args ...string) (*TransactionHashResponse, error) {
+	return c.deployContract(dst, &DeployRequest{
+		ChainID:  chainID,
 		GasLimit: gasLimit,
 		GasPrice: gasPrice,
 		Amount:   amount,
@@ -50,7 +51,29 @@ func (c *Client) DeployContract(dst *network.ServerIdentity, gasLimit uint64, ga
 		Bytecode: bytecode,
 		Abi:      abi,
 		Args:     args,
-	}
+	})
+}
+
+// DeployContractFrom prepares a contract deployment in the same way as
+// DeployContract(), using the current nonce of the sender account in the
+// given BEvm instance
+func (c *Client) DeployContractFrom(dst *network.ServerIdentity, chainID uint64, gasLimit uint64, gasPrice uint64, amount uint64, blockID []byte, serverConfig string, bevmInstanceID byzcoin.InstanceID, accountAddress []byte, bytecode []byte, abi string, args ...string) (*TransactionHashResponse, error) {
+	return c.deployContract(dst, &DeployRequest{
+		ChainID:        chainID,
+		GasLimit:       gasLimit,
+		GasPrice:       gasPrice,
+		Amount:         amount,
+		Bytecode:       bytecode,
+		Abi:            abi,
+		Args:           args,
+		BlockID:        blockID,
+		ServerConfig:   serverConfig,
+		BEvmInstanceID: bevmInstanceID[:],
+		AccountAddress: accountAddress,
+	})
+}
+
+func (c *Client) deployContract(dst *network.ServerIdentity, request *DeployRequest) (*TransactionHashResponse, error) {
 	response := &TransactionHashResponse{}
 
 	err := c.SendProtobuf(dst, request, response)
@@ -61,8 +84,9 @@ func (c *Client) DeployContract(dst *network.ServerIdentity, gasLimit uint64, ga
 	return response, err
 }
 
-func (c *Client) ExecuteTransaction(dst *network.ServerIdentity, gasLimit uint64, gasPrice uint64, amount uint64, contractAddress []byte, nonce uint64, abi string, method string, args ...string) (*TransactionHashResponse, error) {
+func (c *Client) ExecuteTransaction(dst *network.ServerIdentity, chainID uint64, gasLimit uint64, gasPrice uint64, amount uint64, contractAddress []byte, nonce uint64, abi string, method string, args ...string) (*TransactionHashResponse, error) {
 	request := &TransactionRequest{
+		ChainID:         chainID,
 		GasLimit:        gasLimit,
 		GasPrice:        gasPrice,
 		Amount:          amount,
@@ -82,8 +106,9 @@ func (c *Client) ExecuteTransaction(dst *network.ServerIdentity, gasLimit uint64
 	return response, err
 }
 
-func (c *Client) FinalizeTransaction(dst *network.ServerIdentity, tx []byte, signature []byte) (*TransactionResponse, error) {
+func (c *Client) FinalizeTransaction(dst *network.ServerIdentity, chainID uint64, tx []byte, signature []byte) (*TransactionResponse, error) {
 	request := &TransactionFinalizationRequest{
+		ChainID:     chainID,
 		Transaction: tx,
 		Signature:   signature,
 	}
@@ -117,3 +142,20 @@ func (c *Client) Call(dst *network.ServerIdentity, blockID []byte, serverConfig
 
 	return response, err
 }
+
+func (c *Client) GetNonce(dst *network.ServerIdentity, blockID []byte, serverConfig string, bevmInstanceID byzcoin.InstanceID, accountAddress []byte) (*NonceResponse, error) {
+	request := &NonceRequest{
+		BlockID:        blockID,
+		ServerConfig:   serverConfig,
+		BEvmInstanceID: bevmInstanceID[:],
+		AccountAddress: accountAddress,
+	}
+	response := &NonceResponse{}
+
+	err := c.SendProtobuf(dst, request, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, err
+}
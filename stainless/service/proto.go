@@ -37,16 +37,24 @@ type BytecodeGenResponse struct {
 }
 
 type DeployRequest struct {
+	ChainID  uint64 // EIP-155 chain ID of the BEvm instance
 	GasLimit uint64
 	GasPrice uint64
 	Amount   uint64
-	Nonce    uint64
+	Nonce    uint64 // Retrieved from the BEvm instance if zero and the account is given
 	Bytecode []byte
 	Abi      string   // JSON-encoded
 	Args     []string // JSON-encoded
+	// BEvm instance and account of the sender, used to retrieve its nonce
+	// (see NonceRequest)
+	BlockID        []byte
+	ServerConfig   string
+	BEvmInstanceID []byte
+	AccountAddress []byte
 }
 
 type TransactionRequest struct {
+	ChainID         uint64 // EIP-155 chain ID of the BEvm instance
 	GasLimit        uint64
 	GasPrice        uint64
 	Amount          uint64
@@ -63,6 +71,7 @@ type TransactionHashResponse struct {
 }
 
 type TransactionFinalizationRequest struct {
+	ChainID     uint64 // EIP-155 chain ID of the BEvm instance
 	Transaction []byte
 	Signature   []byte
 }
@@ -85,3 +94,16 @@ type CallRequest struct {
 type CallResponse struct {
 	Result string // JSON-encoded
 }
+
+// NonceRequest asks for the nonce of an Ethereum account in the state of a
+// BEvm instance, to be used by its next transaction
+type NonceRequest struct {
+	BlockID        []byte
+	ServerConfig   string
+	BEvmInstanceID []byte
+	AccountAddress []byte
+}
+
+type NonceResponse struct {
+	Nonce uint64
+}
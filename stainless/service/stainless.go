@@ -22,6 +22,7 @@ import (
 
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
@@ -315,6 +316,15 @@ func decodeArgs(encodedArgs []string) ([]interface{}, error) {
 	return args, nil
 }
 
+// Build the EIP-155 signer of a BEvm instance, given its chain ID
+func eip155Signer(chainID uint64) (types.Signer, error) {
+	if chainID == 0 {
+		return nil, errors.New("Missing chain ID of the BEvm instance")
+	}
+
+	return types.NewEIP155Signer(new(big.Int).SetUint64(chainID)), nil
+}
+
 func (service *Stainless) DeployContract(req *DeployRequest) (network.Message, error) {
 	abi, err := abi.JSON(strings.NewReader(req.Abi))
 	if err != nil {
@@ -333,9 +343,27 @@ func (service *Stainless) DeployContract(req *DeployRequest) (network.Message, e
 
 	callData := append(req.Bytecode, packedArgs...)
 
-	tx := types.NewContractCreation(req.Nonce, big.NewInt(int64(req.Amount)), req.GasLimit, big.NewInt(int64(req.GasPrice)), callData)
+	nonce := req.Nonce
+	if nonce == 0 && len(req.AccountAddress) != 0 {
+		response, err := service.GetNonce(&NonceRequest{
+			BlockID:        req.BlockID,
+			ServerConfig:   req.ServerConfig,
+			BEvmInstanceID: req.BEvmInstanceID,
+			AccountAddress: req.AccountAddress,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		nonce = response.(*NonceResponse).Nonce
+	}
+
+	tx := types.NewContractCreation(nonce, big.NewInt(int64(req.Amount)), req.GasLimit, big.NewInt(int64(req.GasPrice)), callData)
 
-	signer := types.HomesteadSigner{}
+	signer, err := eip155Signer(req.ChainID)
+	if err != nil {
+		return nil, err
+	}
 	hashedTx := signer.Hash(tx)
 
 	unsignedBuffer, err := tx.MarshalJSON()
@@ -366,7 +394,10 @@ func (service *Stainless) ExecuteTransaction(req *TransactionRequest) (network.M
 
 	tx := types.NewTransaction(req.Nonce, common.BytesToAddress(req.ContractAddress), big.NewInt(int64(req.Amount)), req.GasLimit, big.NewInt(int64(req.GasPrice)), callData)
 
-	signer := types.HomesteadSigner{}
+	signer, err := eip155Signer(req.ChainID)
+	if err != nil {
+		return nil, err
+	}
 	hashedTx := signer.Hash(tx)
 
 	unsignedBuffer, err := tx.MarshalJSON()
@@ -380,10 +411,13 @@ func (service *Stainless) ExecuteTransaction(req *TransactionRequest) (network.M
 }
 
 func (service *Stainless) FinalizeTransaction(req *TransactionFinalizationRequest) (network.Message, error) {
-	signer := types.HomesteadSigner{}
+	signer, err := eip155Signer(req.ChainID)
+	if err != nil {
+		return nil, err
+	}
 
 	var tx types.Transaction
-	err := tx.UnmarshalJSON(req.Transaction)
+	err = tx.UnmarshalJSON(req.Transaction)
 	if err != nil {
 		return nil, err
 	}
@@ -459,6 +493,33 @@ func (service *Stainless) Call(req *CallRequest) (network.Message, error) {
 	return &CallResponse{Result: string(resultJSON)}, nil
 }
 
+// GetNonce returns the nonce of an Ethereum account, to be provided to
+// DeployContract() and ExecuteTransaction()
+func (service *Stainless) GetNonce(req *NonceRequest) (network.Message, error) {
+	// Read server configuration from TOML data
+	grp, err := app.ReadGroupDescToml(strings.NewReader(req.ServerConfig))
+	if err != nil {
+		return nil, err
+	}
+	// Instantiate a new ByzCoin client
+	bcClient := byzcoin.NewClient(req.BlockID, *grp.Roster)
+
+	// Instantiate a new BEvm client (we don't need a darc to read proofs)
+	bevmClient, err := bevm.NewClient(bcClient, darc.Signer{}, byzcoin.NewInstanceID(req.BEvmInstanceID))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := bevmClient.GetNonce(common.BytesToAddress(req.AccountAddress))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Lvl4("Returning", nonce)
+
+	return &NonceResponse{Nonce: nonce}, nil
+}
+
 // newStainlessService creates a new service that is built for Status
 func newStainlessService(context *onet.Context) (onet.Service, error) {
 	service := &Stainless{
@@ -472,6 +533,7 @@ func newStainlessService(context *onet.Context) (onet.Service, error) {
 		service.ExecuteTransaction,
 		service.FinalizeTransaction,
 		service.Call,
+		service.GetNonce,
 	} {
 		err := service.RegisterHandler(srv)
 		if err != nil {
@@ -2,19 +2,31 @@ package stainless
 
 import (
 	"encoding/json"
+	"math/big"
 	"testing"
+	"time"
 
 	"encoding/hex"
 	"fmt"
+	"github.com/c4dt/cothority-stainless/bevm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/stretchr/testify/assert"
 	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/log"
 )
 
 var tSuite = suites.MustFind("Ed25519")
 
+// EIP-155 chain ID used for the transactions
+const testChainID = 1234
+
 func TestMain(m *testing.M) {
 	log.MainTest(m)
 }
@@ -251,13 +263,13 @@ func Test_Deploy(t *testing.T) {
 	candySupply, err := json.Marshal(100)
 	assert.Nil(t, err)
 
-	response, err := client.DeployContract(ro.List[0], 1e7, 1, 0, 0, candyBytecode, candyAbi, string(candySupply))
+	response, err := client.DeployContract(ro.List[0], testChainID, 1e7, 1, 0, 0, candyBytecode, candyAbi, string(candySupply))
 	assert.Nil(t, err)
 
 	expectedTx, err := hex.DecodeString("7b226e6f6e6365223a22307830222c226761735072696365223a22307831222c22676173223a223078393839363830222c22746f223a6e756c6c2c2276616c7565223a22307830222c22696e707574223a22307836303830363034303532333438303135363130303130353736303030383066643562353036303430353136303230383036313031636238333339383130313830363034303532383130313930383038303531393036303230303139303932393139303530353035303830363030303831393035353530383036303031383139303535353036303030363030323831393035353530353036313031373238303631303035393630303033393630303066333030363038303630343035323630303433363130363130303463353736303030333537633031303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303039303034363366666666666666663136383036336131666632663532313436313030353135373830363365613331396632383134363130303765353735623630303038306664356233343830313536313030356435373630303038306664356235303631303037633630303438303336303338313031393038303830333539303630323030313930393239313930353035303530363130306139353635623030356233343830313536313030386135373630303038306664356235303631303039333631303133633536356236303430353138303832383135323630323030313931353035303630343035313830393130333930663335623630303135343831313131353135313536313031323335373630343035313766303863333739613030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303831353236303034303138303830363032303031383238313033383235323630303538313532363032303031383037663635373237323666373230303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303038313532353036303230303139313530353036303430353138303931303339306664356238303630303135343033363030313831393035353530383036303032353430313630303238313930353535303530353635623630303036303031353439303530393035363030613136353632376137613732333035383230373732316134356631376330653066353765323535663333353735323831643137663161393064336435386235313638383233306439336334363061313961613030323930303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303634222c2276223a22307830222c2272223a22307830222c2273223a22307830222c2268617368223a22307837666631383834633430633664636561653534666361346331356131333063356133663639373032643466336537356665336163373862313735656339356139227d")
 	assert.Nil(t, err)
 
-	expectedHash, err := hex.DecodeString("c289e67875d147429d2ffc5cc58e9a1486d581bef5aeca63017ad7855f8dab26")
+	expectedHash, err := hex.DecodeString("51f6e166a185fd8a0ce57167a3bc925ea606c200c935d1ca94a72cf4359911a4")
 	assert.Nil(t, err)
 
 	assert.Equal(t, expectedTx, response.Transaction)
@@ -283,17 +295,21 @@ func Test_Transaction(t *testing.T) {
 
 	nonce := uint64(1) // First call right after deployment
 
-	response, err := client.ExecuteTransaction(ro.List[0], 1e7, 1, 0, contractAddress, nonce, candyAbi, "eatCandy", string(candiesToEat))
+	response, err := client.ExecuteTransaction(ro.List[0], testChainID, 1e7, 1, 0, contractAddress, nonce, candyAbi, "eatCandy", string(candiesToEat))
 	assert.Nil(t, err)
 
 	expectedTx, err := hex.DecodeString("7b226e6f6e6365223a22307831222c226761735072696365223a22307831222c22676173223a223078393839363830222c22746f223a22307838636461663063643235393838373235386263313361393263306136646139323639383634346330222c2276616c7565223a22307830222c22696e707574223a223078613166663266353230303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303061222c2276223a22307830222c2272223a22307830222c2273223a22307830222c2268617368223a22307865343264343137386465303032323636386433326637383033666564353637376437343666393238666465386430656339303532656432306138616466343362227d")
 	assert.Nil(t, err)
 
-	expectedHash, err := hex.DecodeString("e13b1cfe8797fa11bd7929158008033e585d302a6f4cb11cfcf2b0a8bebec3fd")
+	expectedHash, err := hex.DecodeString("f3dc93758432d600948127f5375476d18a94b529cbdebd9290be2efd1528c033")
 	assert.Nil(t, err)
 
 	assert.Equal(t, expectedTx, response.Transaction)
 	assert.Equal(t, expectedHash, response.TransactionHash)
+
+	// The chain ID is required
+	_, err = client.ExecuteTransaction(ro.List[0], 0, 1e7, 1, 0, contractAddress, nonce, candyAbi, "eatCandy", string(candiesToEat))
+	assert.NotNil(t, err)
 }
 
 func Test_FinalizeTx(t *testing.T) {
@@ -309,17 +325,21 @@ func Test_FinalizeTx(t *testing.T) {
 	unsignedTx, err := hex.DecodeString("7b226e6f6e6365223a22307831222c226761735072696365223a22307831222c22676173223a223078393839363830222c22746f223a22307838636461663063643235393838373235386263313361393263306136646139323639383634346330222c2276616c7565223a22307830222c22696e707574223a223078613166663266353230303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303061222c2276223a22307830222c2272223a22307830222c2273223a22307830222c2268617368223a22307865343264343137386465303032323636386433326637383033666564353637376437343666393238666465386430656339303532656432306138616466343362227d")
 	assert.Nil(t, err)
 
-	// Signature done with private key 0xc87509a1c067bbde78beb793e6fa76530b6382a4c0241e5e4a9ec0a0f44dc0d3
-	signature, err := hex.DecodeString("aa0b243e4ad97b6cb7c2a016567aa02b2e7bed159c221b7089b60688527f6e88679c9dfcb1ceb2477a36753645b564c2a14a7bc757f46b9b714c49a4c93ea0a401")
+	// EIP-155 signature (chain ID 1234) done with private key 0xc87509a1c067bbde78beb793e6fa76530b6382a4c0241e5e4a9ec0a0f44dc0d3
+	signature, err := hex.DecodeString("2e83efaa5fa318873dd86b1519fc660072ab23ab7c206d73f59c27903a610bc804dea9c67fe47ed9eb88f78435e390b17b413d5ec70fa042c45308c73b232c0201")
 	assert.Nil(t, err)
 
-	expectedTx, err := hex.DecodeString("7b226e6f6e6365223a22307831222c226761735072696365223a22307831222c22676173223a223078393839363830222c22746f223a22307838636461663063643235393838373235386263313361393263306136646139323639383634346330222c2276616c7565223a22307830222c22696e707574223a223078613166663266353230303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303061222c2276223a2230783163222c2272223a22307861613062323433653461643937623663623763326130313635363761613032623265376265643135396332323162373038396236303638383532376636653838222c2273223a22307836373963396466636231636562323437376133363735333634356235363463326131346137626337353766343662396237313463343961346339336561306134222c2268617368223a22307834633966336134343361663030326438373839666235616239393261376631346639396134303762616532613332643464653830313037366365613065353631227d")
+	expectedTx, err := hex.DecodeString("7b226e6f6e6365223a22307831222c226761735072696365223a22307831222c22676173223a223078393839363830222c22746f223a22307838636461663063643235393838373235386263313361393263306136646139323639383634346330222c2276616c7565223a22307830222c22696e707574223a223078613166663266353230303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303061222c2276223a223078396338222c2272223a22307832653833656661613566613331383837336464383662313531396663363630303732616232336162376332303664373366353963323739303361363130626338222c2273223a223078346465613963363766653437656439656238386637383433356533393062313762343133643565633730666130343263343533303863373362323332633032222c2268617368223a22307832653737646130313934383061306664626463633034363662623030646531336366366563326662653666623330653534333439363931346233303365613832227d")
 	assert.Nil(t, err)
 
-	response, err := client.FinalizeTransaction(ro.List[0], unsignedTx, signature)
+	response, err := client.FinalizeTransaction(ro.List[0], testChainID, unsignedTx, signature)
 	assert.Nil(t, err)
 
 	assert.Equal(t, expectedTx, response.Transaction)
+
+	// The chain ID is required
+	_, err = client.FinalizeTransaction(ro.List[0], 0, unsignedTx, signature)
+	assert.NotNil(t, err)
 }
 
 func Test_Call(t *testing.T) {
@@ -408,3 +428,132 @@ func Test_Call(t *testing.T) {
 	expectedResult := float64(55)
 	assert.Equal(t, expectedResult, result)
 }
+
+func Test_GetNonce(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer teardownTest(local)
+	local.Check = onet.CheckNone
+
+	_, ro, _ := local.GenTree(3, true)
+	client := &Client{Client: local.NewClient(ServiceName)}
+
+	// Create a ledger with a BEVM instance
+	signer := darc.NewSignerEd25519(nil, nil)
+	gMsg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, ro,
+		[]string{"spawn:bevm", "invoke:bevm.credit", "invoke:bevm.transaction"}, signer.Identity())
+	assert.Nil(t, err)
+	gMsg.BlockInterval = time.Second
+
+	bcClient, _, err := byzcoin.NewLedger(gMsg, false)
+	assert.Nil(t, err)
+
+	bevmInstanceID, err := bevm.NewBEvmWithParams(bcClient, signer, &gMsg.GenesisDarc, bevm.Params{ChainID: testChainID})
+	assert.Nil(t, err)
+
+	bevmClient, err := bevm.NewClient(bcClient, signer, bevmInstanceID)
+	assert.Nil(t, err)
+
+	account, err := bevm.GenerateEvmAccount()
+	assert.Nil(t, err)
+	err = bevmClient.CreditAccount(big.NewInt(bevm.WeiPerEther), account.Address)
+	assert.Nil(t, err)
+
+	serverConfig := groupToml(ro)
+
+	log.Lvl1("Sending request to service...")
+
+	response, err := client.GetNonce(ro.List[0], bcClient.ID, serverConfig, bevmInstanceID, account.Address.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), response.Nonce)
+
+	// Each transaction increments the nonce of its sender
+	tx, err := types.SignTx(types.NewTransaction(0, account.Address, big.NewInt(0), params.TxGas, big.NewInt(1), nil),
+		types.NewEIP155Signer(big.NewInt(testChainID)), account.PrivateKey)
+	assert.Nil(t, err)
+	_, err = bevmClient.SendSignedTx(tx)
+	assert.Nil(t, err)
+
+	response, err = client.GetNonce(ro.List[0], bcClient.ID, serverConfig, bevmInstanceID, account.Address.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), response.Nonce)
+
+	// Invalid server configurations are refused
+	_, err = client.GetNonce(ro.List[0], bcClient.ID, "invalid", bevmInstanceID, account.Address.Bytes())
+	assert.NotNil(t, err)
+
+	// The nonce of a deployment is retrieved when omitted
+	// (PUSH1 0 PUSH1 0 RETURN: empty contract)
+	deployResponse, err := client.DeployContractFrom(ro.List[0], testChainID, 1e5, 1, 0, bcClient.ID, serverConfig,
+		bevmInstanceID, account.Address.Bytes(), []byte{0x60, 0x00, 0x60, 0x00, 0xf3}, "[]")
+	assert.Nil(t, err)
+
+	var deployTx types.Transaction
+	err = deployTx.UnmarshalJSON(deployResponse.Transaction)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), deployTx.Nonce())
+}
+
+func Test_ChainID(t *testing.T) {
+	local, ro, client := setupTest()
+	defer teardownTest(local)
+
+	log.Lvl1("Sending request to service...")
+
+	privateKey, err := crypto.HexToECDSA("c87509a1c067bbde78beb793e6fa76530b6382a4c0241e5e4a9ec0a0f44dc0d3")
+	assert.Nil(t, err)
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+
+	contractAddress := common.HexToAddress("0x8cdaf0cd259887258bc13a92c0a6da92698644c0")
+	candyAbi := `[{"constant":false,"inputs":[{"name":"candies","type":"uint256"}],"name":"eatCandy","outputs":[],"payable":false,"stateMutability":"nonpayable","type":"function"}]`
+
+	// The hash to sign and the finalized transaction follow the chain ID
+	// given in the requests
+	var hashes [][]byte
+	for _, chainID := range []uint64{testChainID, testChainID + 1} {
+		signer := types.NewEIP155Signer(new(big.Int).SetUint64(chainID))
+
+		response, err := client.ExecuteTransaction(ro.List[0], chainID, 1e7, 1, 0, contractAddress.Bytes(), 1, candyAbi, "eatCandy", "10")
+		assert.Nil(t, err)
+
+		var unsignedTx types.Transaction
+		err = unsignedTx.UnmarshalJSON(response.Transaction)
+		assert.Nil(t, err)
+		assert.Equal(t, signer.Hash(&unsignedTx).Bytes(), response.TransactionHash)
+		hashes = append(hashes, response.TransactionHash)
+
+		signature, err := crypto.Sign(response.TransactionHash, privateKey)
+		assert.Nil(t, err)
+
+		finalized, err := client.FinalizeTransaction(ro.List[0], chainID, response.Transaction, signature)
+		assert.Nil(t, err)
+
+		var signedTx types.Transaction
+		err = signedTx.UnmarshalJSON(finalized.Transaction)
+		assert.Nil(t, err)
+		assert.Equal(t, new(big.Int).SetUint64(chainID), signedTx.ChainId())
+
+		sender, err := types.Sender(signer, &signedTx)
+		assert.Nil(t, err)
+		assert.Equal(t, address, sender)
+
+		// The transaction is not valid on another chain
+		_, err = types.Sender(types.NewEIP155Signer(new(big.Int).SetUint64(chainID+1)), &signedTx)
+		assert.NotNil(t, err)
+	}
+
+	assert.NotEqual(t, hashes[0], hashes[1])
+}
+
+// Build the server configuration (group TOML) describing a roster
+func groupToml(ro *onet.Roster) string {
+	var servers []*app.ServerToml
+	for _, si := range ro.List {
+		services := make(map[string]app.ServiceConfig)
+		for _, sid := range si.ServiceIdentities {
+			services[sid.Name] = app.ServiceConfig{Suite: sid.Suite, Public: sid.Public.String()}
+		}
+		servers = append(servers, app.NewServerToml(tSuite, si.Public, si.Address, si.Description, services))
+	}
+
+	return app.NewGroupToml(servers...).String()
+}